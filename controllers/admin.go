@@ -0,0 +1,260 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+const (
+	userSearchPageSize = 50
+)
+
+type AdminController interface {
+	GetUsers(w http.ResponseWriter, r *http.Request)
+	GetUser(w http.ResponseWriter, r *http.Request)
+	PostFreeze(w http.ResponseWriter, r *http.Request)
+	PostUnfreeze(w http.ResponseWriter, r *http.Request)
+	PutRole(w http.ResponseWriter, r *http.Request)
+	PostAdjustment(w http.ResponseWriter, r *http.Request)
+	GetAdjustments(w http.ResponseWriter, r *http.Request)
+}
+
+type adminController struct {
+	db storage.DB
+}
+
+func NewAdminController(db storage.DB) AdminController {
+	return &adminController{db}
+}
+
+// Searches users by username or email. Results are in username order; pass
+// the last username of a page as after to get the next
+func (a *adminController) GetUsers(w http.ResponseWriter, r *http.Request) {
+	var args models.UserSearchArgs
+	err := utils.ParseArgs(r, &args)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if args.Count <= 0 || args.Count > userSearchPageSize {
+		args.Count = userSearchPageSize
+	}
+
+	users, err := a.db.SearchUsers(&args)
+	if err != nil {
+		log.Printf("could not search users for '%v'\n%v", args.Query, err)
+		utils.SendError(w, "Error searching users", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, users, http.StatusOK)
+}
+
+func (a *adminController) GetUser(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	user, err := a.db.GetUser(username)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("User %v not found", username), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		return
+	}
+
+	user.Password = ""
+
+	utils.SendSuccess(w, user, http.StatusOK)
+}
+
+// Stops the user making deposits and payments until they are unfrozen
+func (a *adminController) PostFreeze(w http.ResponseWriter, r *http.Request) {
+	a.setFrozen(w, r, true)
+}
+
+func (a *adminController) PostUnfreeze(w http.ResponseWriter, r *http.Request) {
+	a.setFrozen(w, r, false)
+}
+
+func (a *adminController) setFrozen(w http.ResponseWriter, r *http.Request, frozen bool) {
+	username := mux.Vars(r)["username"]
+
+	action := auditUserUnfreeze
+	if frozen {
+		action = auditUserFreeze
+	}
+
+	err := a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		user, err := tx.GetUser(username)
+		if err != nil {
+			return err
+		}
+		if err := tx.SetUserFrozen(username, frozen); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, action, username,
+			map[string]bool{"frozen": user.Frozen}, map[string]bool{"frozen": frozen}))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("User %v not found", username), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not set frozen of user %v to %v\n%v", username, frozen, err)
+		utils.SendError(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Makes a user an admin or takes it away, with a body of {"role": ...}
+func (a *adminController) PutRole(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var user models.User
+	err := json.NewDecoder(r.Body).Decode(&user)
+	if err != nil {
+		log.Printf("could not unmarshal PutRole request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	if user.Role != models.RoleUser && user.Role != models.RoleAdmin {
+		utils.SendError(w, fmt.Sprintf("Role must be '%v' or '%v'", models.RoleUser, models.RoleAdmin), http.StatusBadRequest)
+		return
+	}
+
+	err = a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		old, err := tx.GetUser(username)
+		if err != nil {
+			return err
+		}
+		if err := tx.SetUserRole(username, user.Role); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditUserRole, username,
+			map[string]string{"role": old.Role}, map[string]string{"role": user.Role}))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("User %v not found", username), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not set role of user %v to %v\n%v", username, user.Role, err)
+		utils.SendError(w, "Error updating user", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Makes an existing user an admin, without going through the admin API. This
+// is how the first admin is created, from the command line, as nothing else
+// can grant the role until there is one
+func BootstrapAdmin(ctx context.Context, db storage.DB, username string) error {
+	return db.WithTx(ctx, func(tx storage.Tx) error {
+		user, err := tx.GetUser(username)
+		if err != nil {
+			return err
+		}
+		if user.Deleted {
+			return fmt.Errorf("user %v has been deleted", username)
+		}
+		if user.Role == models.RoleAdmin {
+			return nil
+		}
+		if err := tx.SetUserRole(username, models.RoleAdmin); err != nil {
+			return err
+		}
+		return tx.AppendAudit(&models.AuditEntry{
+			Time:   time.Now().UTC(),
+			Action: auditUserRole,
+			Target: username,
+			Before: auditJson(map[string]string{"role": user.Role}),
+			After:  auditJson(map[string]string{"role": models.RoleAdmin}),
+		})
+	})
+}
+
+// Credits or debits a user's balance. A reason is required, and is shown to
+// the user alongside the adjustment
+func (a *adminController) PostAdjustment(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var adjustment models.Adjustment
+	err := json.NewDecoder(r.Body).Decode(&adjustment)
+	if err != nil {
+		log.Printf("could not unmarshal PostAdjustment request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	if adjustment.Amount == 0 {
+		utils.SendError(w, "Adjustment amount cannot be 0", http.StatusBadRequest)
+		return
+	}
+
+	adjustment.Reason = strings.TrimSpace(adjustment.Reason)
+	if adjustment.Reason == "" {
+		utils.SendError(w, "Adjustment reason required", http.StatusBadRequest)
+		return
+	}
+
+	_, err = a.db.GetUser(username)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("User %v not found", username), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		return
+	}
+
+	adjustment.Id = uuid.NewV4().String()
+	adjustment.Username = username
+	adjustment.Admin = requestClaims(r).Username
+	adjustment.Time = time.Now().UTC()
+
+	err = a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.CreateAdjustment(&adjustment); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditAdjustmentCreate, username, nil,
+			map[string]interface{}{"adjustment": adjustment.Id, "amount": adjustment.Amount}))
+	})
+	if err != nil {
+		log.Printf("could not insert adjustment %v into database\n%v", adjustment, err)
+		utils.SendError(w, "Error inserting adjustment into database", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, adjustment, http.StatusCreated)
+}
+
+// Lists the adjustments to a user's balance. Routed both for admins and for
+// the user themselves
+func (a *adminController) GetAdjustments(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	adjustments, err := a.db.GetAdjustments(username)
+	if err != nil {
+		log.Printf("could not get adjustments of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting adjustments", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, adjustments, http.StatusOK)
+}
@@ -0,0 +1,312 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/funding"
+	"github.com/crowdpower/fund/mailer"
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+var errTopUpCapReached = errors.New("top-up cap reached")
+
+type AlertController interface {
+	GetBalanceAlert(w http.ResponseWriter, r *http.Request)
+	PutBalanceAlert(w http.ResponseWriter, r *http.Request)
+	DeleteBalanceAlert(w http.ResponseWriter, r *http.Request)
+	GetTopUps(w http.ResponseWriter, r *http.Request)
+}
+
+type alertController struct {
+	db      storage.DB
+	bus     *events.Bus
+	mailer  mailer.Mailer
+	funding funding.Provider
+}
+
+// Watches bus for balances dropping below users' thresholds. funding may be
+// nil, in which case top-ups can't be turned on
+func NewAlertController(db storage.DB, bus *events.Bus, mailer mailer.Mailer, funding funding.Provider) AlertController {
+	a := &alertController{db: db, bus: bus, mailer: mailer, funding: funding}
+	bus.Handle(a.handle)
+	return a
+}
+
+func (a *alertController) GetBalanceAlert(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	alert, err := a.db.GetBalanceAlert(username)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, "No balance alert set", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get balance alert of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting balance alert", http.StatusInternalServerError)
+		return
+	}
+
+	alert.ToppedUp, err = a.db.GetTopUpsSum(username, monthStart(time.Now().UTC()))
+	if err != nil {
+		log.Printf("could not get top-ups sum of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting balance alert", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, alert, http.StatusOK)
+}
+
+// Sets the threshold below which the user is alerted, and whether they're
+// emailed and topped up as well
+func (a *alertController) PutBalanceAlert(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var alert models.BalanceAlert
+	err := json.NewDecoder(r.Body).Decode(&alert)
+	if err != nil {
+		log.Printf("could not unmarshal PutBalanceAlert request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+	alert.Username = username
+	alert.ToppedUp = 0
+
+	if alert.Threshold <= 0 {
+		utils.SendError(w, "Threshold must be greater than 0", http.StatusBadRequest)
+		return
+	}
+	if alert.TopUpAmount < 0 || alert.TopUpCap < 0 {
+		utils.SendError(w, "Top-up amount and cap can't be negative", http.StatusBadRequest)
+		return
+	}
+	if alert.TopUpAmount > 0 {
+		if a.funding == nil {
+			utils.SendError(w, "Automatic top-ups are not available", http.StatusBadRequest)
+			return
+		}
+		if alert.TopUpCap < alert.TopUpAmount {
+			utils.SendError(w, "Top-up cap must be at least the top-up amount", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		var before interface{}
+		existing, err := tx.GetBalanceAlert(username)
+		if err == nil {
+			before = existing
+		} else if !storage.IsNotFound(err) {
+			return err
+		}
+		if err := tx.SetBalanceAlert(&alert); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditBalanceAlertSet, username, before, alert))
+	})
+	if err != nil {
+		log.Printf("could not set balance alert of user %v\n%v", username, err)
+		utils.SendError(w, "Error setting balance alert", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, alert, http.StatusOK)
+}
+
+func (a *alertController) DeleteBalanceAlert(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	err := a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		before, err := tx.GetBalanceAlert(username)
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteBalanceAlert(username); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditBalanceAlertDelete, username, before, nil))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, "No balance alert set", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not delete balance alert of user %v\n%v", username, err)
+		utils.SendError(w, "Error deleting balance alert", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+func (a *alertController) GetTopUps(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	topUps, err := a.db.GetTopUps(username)
+	if err != nil {
+		log.Printf("could not get top-ups of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting top-ups", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, topUps, http.StatusOK)
+}
+
+// Picks out balances that went down, and checks them against the user's
+// alert away from the publisher, which may be holding up a request
+func (a *alertController) handle(e events.Event) {
+	balance, ok := e.Data.(events.Balance)
+	if !ok || e.Type != events.TypeBalance || balance.Balance >= balance.Previous {
+		return
+	}
+	go a.balanceDropped(e.Username, balance)
+}
+
+func (a *alertController) balanceDropped(username string, balance events.Balance) {
+	alert, err := a.db.GetBalanceAlert(username)
+	if storage.IsNotFound(err) {
+		return
+	} else if err != nil {
+		log.Printf("could not get balance alert of user %v\n%v", username, err)
+		return
+	}
+	if balance.Balance >= alert.Threshold || balance.Previous < alert.Threshold {
+		return
+	}
+
+	a.bus.Publish(events.Event{
+		Type:     events.TypeLowBalance,
+		Username: username,
+		Time:     time.Now().UTC(),
+		Data:     events.LowBalance{Balance: balance.Balance, Threshold: alert.Threshold},
+	})
+
+	user, err := a.db.GetUser(username)
+	if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		return
+	}
+
+	body := fmt.Sprintf("The balance of your Fund account %v is down to %v, below the %v you asked to be told about.",
+		username, balance.Balance, alert.Threshold)
+	if alert.TopUpAmount > 0 {
+		body += " " + a.topUp(user, alert)
+	}
+	if alert.Email {
+		notifyLowBalance(a.mailer, user, body)
+	}
+}
+
+// Deposits the user's top-up amount, charging them through the funding
+// provider, unless it would take them over their monthly cap. Returns a
+// sentence for the user saying what happened
+func (a *alertController) topUp(user *models.User, alert *models.BalanceAlert) string {
+	username := user.Username
+	if a.funding == nil {
+		return "Automatic top-ups are no longer available, so your account wasn't topped up."
+	}
+	if user.Frozen {
+		return "Your account is frozen, so it wasn't topped up."
+	}
+
+	// recorded as pending before the charge, in the transaction that checks
+	// the cap, so concurrent top-ups can't take the user over it between them
+	now := time.Now().UTC()
+	topUp := models.TopUp{
+		Id:       uuid.NewV4().String(),
+		Username: username,
+		Amount:   alert.TopUpAmount,
+		Status:   models.TopUpPending,
+		Time:     now,
+	}
+	var toppedUp int
+	err := a.db.WithTx(context.Background(), func(tx storage.Tx) error {
+		var err error
+		toppedUp, err = tx.GetTopUpsSum(username, monthStart(now))
+		if err != nil {
+			return err
+		}
+		if toppedUp+topUp.Amount > alert.TopUpCap {
+			return errTopUpCapReached
+		}
+		return tx.CreateTopUp(&topUp)
+	})
+	if err == errTopUpCapReached {
+		return fmt.Sprintf("You've been topped up by %v this month, so another top-up of %v would go over "+
+			"your monthly cap of %v. Your account wasn't topped up.", toppedUp, alert.TopUpAmount, alert.TopUpCap)
+	} else if err != nil {
+		log.Printf("could not record top-up of user %v\n%v", username, err)
+		return "Your account couldn't be topped up."
+	}
+
+	reference, err := a.funding.Charge(username, topUp.Amount, topUp.Id)
+	if err != nil {
+		log.Printf("could not charge user %v for top-up %v\n%v", username, topUp.Id, err)
+		if err := a.db.SetTopUpStatus(topUp.Id, models.TopUpFailed, ""); err != nil {
+			log.Printf("could not mark top-up %v of user %v failed\n%v", topUp.Id, username, err)
+		}
+		return "The payment for your top-up didn't go through, so your account wasn't topped up."
+	}
+
+	deposit := models.Deposit{
+		Id:       topUp.Id,
+		Username: username,
+		Amount:   topUp.Amount,
+		Time:     time.Now().UTC(),
+	}
+	err = a.db.WithTx(context.Background(), func(tx storage.Tx) error {
+		if err := tx.CreateDeposit(&deposit); err != nil {
+			return err
+		}
+		if err := tx.SetTopUpStatus(topUp.Id, models.TopUpSettled, reference); err != nil {
+			return err
+		}
+		return tx.AppendAudit(&models.AuditEntry{
+			Time:   deposit.Time,
+			Action: auditTopUpCreate,
+			Target: username,
+			After:  auditJson(map[string]interface{}{"topUp": topUp.Id, "amount": topUp.Amount}),
+		})
+	})
+	if err != nil {
+		// the user has paid, so this needs putting right by hand
+		log.Printf("could not record top-up %v of user %v, charged as %v\n%v", topUp.Id, username, reference, err)
+		if err := a.db.SetTopUpStatus(topUp.Id, models.TopUpCharged, reference); err != nil {
+			log.Printf("could not mark top-up %v of user %v charged\n%v", topUp.Id, username, err)
+		}
+		return "Your account couldn't be topped up. If you were charged, contact us and we'll put it right."
+	}
+
+	return fmt.Sprintf("Your account has been topped up by %v.", deposit.Amount)
+}
+
+// Emails a user about their low balance, if they have a verified email
+func notifyLowBalance(m mailer.Mailer, user *models.User, body string) {
+	if user.Email == "" || !user.EmailVerified {
+		return
+	}
+
+	err := m.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Fund balance is low",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("could not send low balance email to user %v\n%v", user.Username, err)
+	}
+}
+
+// Returns the start of t's calendar month, in UTC
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
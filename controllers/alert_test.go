@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/mailer"
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+)
+
+// Charges by calling charge
+type testFunding struct {
+	charge func(username string, amount int, id string) (string, error)
+}
+
+func (f *testFunding) Charge(username string, amount int, id string) (string, error) {
+	return f.charge(username, amount, id)
+}
+
+func newTopUpTest(t *testing.T, charge func(username string, amount int, id string) (string, error)) (*alertController, storage.DB, *models.User) {
+	db := newTestDB(t)
+	if err := db.CreateUser(&models.User{Username: "alice", Password: "unused"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAlertController(db, events.NewBus(), mailer.NewMemoryMailer(), &testFunding{charge}).(*alertController)
+	return a, db, user
+}
+
+func topUpStatuses(t *testing.T, db storage.DB) []string {
+	topUps, err := db.GetTopUps("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := []string{}
+	for _, topUp := range topUps {
+		statuses = append(statuses, topUp.Status)
+	}
+	return statuses
+}
+
+func TestTopUp(t *testing.T) {
+	a, db, user := newTopUpTest(t, func(username string, amount int, id string) (string, error) {
+		return "charge-" + id, nil
+	})
+	alert := &models.BalanceAlert{Username: "alice", Threshold: 10, TopUpAmount: 50, TopUpCap: 100}
+
+	for i := 0; i < 2; i++ {
+		if message := a.topUp(user, alert); !strings.Contains(message, "topped up by 50") {
+			t.Fatalf("top-up %v said %q, want it topped up", i+1, message)
+		}
+	}
+	if message := a.topUp(user, alert); !strings.Contains(message, "monthly cap") {
+		t.Fatalf("top-up past the cap said %q, want it refused", message)
+	}
+
+	user, err := db.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Balance != 100 {
+		t.Fatalf("balance after top-ups %v, want 100", user.Balance)
+	}
+	topUps, err := db.GetTopUps("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topUps) != 2 || topUps[0].Status != models.TopUpSettled || topUps[0].Reference != "charge-"+topUps[0].Id {
+		t.Fatalf("top-ups %+v, want 2 settled with their charge's reference", topUps)
+	}
+}
+
+func TestTopUpPendingCountsAgainstCap(t *testing.T) {
+	var a *alertController
+	var user *models.User
+	alert := &models.BalanceAlert{Username: "alice", Threshold: 10, TopUpAmount: 50, TopUpCap: 50}
+
+	// a second top-up starting while the first is being charged must see it
+	var during string
+	a, db, user := newTopUpTest(t, func(username string, amount int, id string) (string, error) {
+		if during == "" {
+			during = a.topUp(user, alert)
+		}
+		return "charge-" + id, nil
+	})
+
+	if message := a.topUp(user, alert); !strings.Contains(message, "topped up by 50") {
+		t.Fatalf("top-up said %q, want it topped up", message)
+	}
+	if !strings.Contains(during, "monthly cap") {
+		t.Fatalf("top-up during another's charge said %q, want it refused by the cap", during)
+	}
+	if statuses := topUpStatuses(t, db); len(statuses) != 1 || statuses[0] != models.TopUpSettled {
+		t.Fatalf("top-up statuses %v, want one settled", statuses)
+	}
+}
+
+func TestTopUpChargeFailed(t *testing.T) {
+	fail := true
+	a, db, user := newTopUpTest(t, func(username string, amount int, id string) (string, error) {
+		if fail {
+			return "", errors.New("card declined")
+		}
+		return "charge-" + id, nil
+	})
+	alert := &models.BalanceAlert{Username: "alice", Threshold: 10, TopUpAmount: 50, TopUpCap: 50}
+
+	if message := a.topUp(user, alert); !strings.Contains(message, "didn't go through") {
+		t.Fatalf("top-up with a failed charge said %q, want it to say so", message)
+	}
+	if statuses := topUpStatuses(t, db); len(statuses) != 1 || statuses[0] != models.TopUpFailed {
+		t.Fatalf("top-up statuses %v, want one failed", statuses)
+	}
+
+	// a failed top-up took no money, so doesn't count against the cap
+	fail = false
+	if message := a.topUp(user, alert); !strings.Contains(message, "topped up by 50") {
+		t.Fatalf("top-up after a failed one said %q, want it topped up", message)
+	}
+	user, err := db.GetUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Balance != 50 {
+		t.Fatalf("balance after top-ups %v, want 50", user.Balance)
+	}
+}
@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+const (
+	auditPageSize = 100
+	// entries read at a time when verifying the hash chain
+	auditVerifyBatchSize = 1000
+)
+
+// Actions recorded in the audit log
+const (
+	auditUserCreate                = "user.create"
+	auditUserUpdate                = "user.update"
+	auditUserDelete                = "user.delete"
+	auditUserVerifyEmail           = "user.verify_email"
+	auditUserResetPassword         = "user.reset_password"
+	auditUserLock                  = "user.lock"
+	auditUserFreeze                = "user.freeze"
+	auditUserUnfreeze              = "user.unfreeze"
+	auditUserRole                  = "user.role"
+	auditSessionCreate             = "session.create"
+	auditSessionRevoke             = "session.revoke"
+	auditSessionRevokeAll          = "session.revoke_all"
+	auditSessionCompromise         = "session.compromise"
+	auditDelegationCreate          = "delegation.create"
+	auditDelegationRevoke          = "delegation.revoke"
+	auditApiKeyCreate              = "api_key.create"
+	auditApiKeyRotate              = "api_key.rotate"
+	auditApiKeyRevoke              = "api_key.revoke"
+	auditSiteDelete                = "site.delete"
+	auditOAuthClientCreate         = "oauth_client.create"
+	auditOAuthClientDelete         = "oauth_client.delete"
+	auditDepositCreate             = "deposit.create"
+	auditPaymentCreate             = "payment.create"
+	auditAdjustmentCreate          = "adjustment.create"
+	auditExportCreate              = "export.create"
+	auditBalanceAlertSet           = "balance_alert.set"
+	auditBalanceAlertDelete        = "balance_alert.delete"
+	auditTopUpCreate               = "top_up.create"
+	auditNotificationWebhookSet    = "notification_webhook.set"
+	auditNotificationWebhookDelete = "notification_webhook.delete"
+	auditPublicProfileSet          = "public_profile.set"
+	auditPublicProfileDelete       = "public_profile.delete"
+	auditSupporterSiteAdd          = "supporter_site.add"
+	auditSupporterSiteRemove       = "supporter_site.remove"
+)
+
+type AuditController interface {
+	GetAuditEntries(w http.ResponseWriter, r *http.Request)
+	GetAuditVerification(w http.ResponseWriter, r *http.Request)
+}
+
+type auditController struct {
+	db storage.DB
+}
+
+func NewAuditController(db storage.DB) AuditController {
+	return &auditController{db}
+}
+
+// Lists audit log entries, oldest first. Pass the seq of the last entry of a
+// page as after to get the next
+func (a *auditController) GetAuditEntries(w http.ResponseWriter, r *http.Request) {
+	var args models.AuditArgs
+	err := utils.ParseArgs(r, &args)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if args.Count <= 0 || args.Count > auditPageSize {
+		args.Count = auditPageSize
+	}
+
+	entries, err := a.db.GetAuditEntries(&args)
+	if err != nil {
+		log.Printf("could not get audit log entries\n%v", err)
+		utils.SendError(w, "Error getting audit log", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, entries, http.StatusOK)
+}
+
+// Walks the whole audit log checking every entry's hash and its link to the
+// entry before
+func (a *auditController) GetAuditVerification(w http.ResponseWriter, r *http.Request) {
+	verification := models.AuditVerification{Valid: true}
+	args := models.AuditArgs{Count: auditVerifyBatchSize}
+	prevHash := ""
+	for {
+		entries, err := a.db.GetAuditEntries(&args)
+		if err != nil {
+			log.Printf("could not get audit log entries\n%v", err)
+			utils.SendError(w, "Error getting audit log", http.StatusInternalServerError)
+			return
+		}
+
+		for _, e := range entries {
+			if e.PrevHash != prevHash || e.ComputeHash() != e.Hash {
+				verification.Valid = false
+				verification.FirstInvalid = e.Seq
+				log.Printf("audit log hash chain broken at entry %v", e.Seq)
+				utils.SendSuccess(w, verification, http.StatusOK)
+				return
+			}
+			prevHash = e.Hash
+			verification.Entries++
+		}
+
+		if len(entries) < args.Count {
+			break
+		}
+		args.After = int(entries[len(entries)-1].Seq)
+	}
+
+	utils.SendSuccess(w, verification, http.StatusOK)
+}
+
+// Describes an action taken in a request, for the audit log. The actor is the
+// user the request's token belongs to; requests made without a token must set
+// it themselves. before and after are marshalled to JSON, and may be nil
+func newAuditEntry(r *http.Request, action, target string, before, after interface{}) *models.AuditEntry {
+	entry := &models.AuditEntry{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Target:    target,
+		Before:    auditJson(before),
+		After:     auditJson(after),
+		Ip:        utils.ClientIp(r),
+		UserAgent: r.UserAgent(),
+	}
+	if claims := requestClaims(r); claims != nil {
+		entry.Actor = claims.Username
+		entry.Session = claims.SessionId
+	}
+	return entry
+}
+
+// Returns a reference to value, such as an email address, for the audit log
+// to hold in its place. References are keyed per user, so they can be checked
+// against a value while the account exists, and match nothing once the key is
+// deleted along with the account. An empty value has no reference
+func auditRef(tx storage.Tx, username, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	key, err := tx.GetAuditKey(username)
+	if storage.IsNotFound(err) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return "", err
+		}
+		err = tx.CreateAuditKey(username, key)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func auditJson(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("could not marshal audit log value %v\n%v", v, err)
+		return nil
+	}
+	return b
+}
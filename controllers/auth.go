@@ -1,6 +1,8 @@
 package controllers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,32 +10,70 @@ import (
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/duo-labs/webauthn/webauthn"
 	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/keys"
+	"github.com/crowdpower/fund/mailer"
+	"github.com/crowdpower/fund/models"
 	"github.com/crowdpower/fund/storage"
 	"github.com/crowdpower/fund/utils"
 )
 
 const (
-	AccessTokenType  = "access"
-	RefreshTokenType = "refresh"
-
-	refreshExpiryTime = (time.Minute * 60 * 24) * 60
-	accessExpiryTime  = time.Minute * 60 * 2
+	AccessTokenType        = "access"
+	RefreshTokenType       = "refresh"
+	VerifyEmailTokenType   = "verify-email"
+	ResetPasswordTokenType = "reset-password"
+	ExportTokenType        = "export"
+
+	refreshExpiryTime       = (time.Minute * 60 * 24) * 60
+	accessExpiryTime        = time.Minute * 60 * 2
+	verifyEmailExpiryTime   = (time.Minute * 60 * 24) * 7
+	resetPasswordExpiryTime = time.Minute * 60
 )
 
 type handler func(w http.ResponseWriter, r *http.Request)
 
+type contextKey string
+
+const claimsKey contextKey = "claims"
+
 type AuthController interface {
 	GetRefreshToken(w http.ResponseWriter, r *http.Request)
 	GetAuthToken(w http.ResponseWriter, r *http.Request)
-	Wrapper(tokenType string, h handler) handler
+	GetSessions(w http.ResponseWriter, r *http.Request)
+	DeleteSession(w http.ResponseWriter, r *http.Request)
+	DeleteSessions(w http.ResponseWriter, r *http.Request)
+	GetJWKS(w http.ResponseWriter, r *http.Request)
+	PostWebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request)
+	PostWebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request)
+	GetWebAuthnCredentials(w http.ResponseWriter, r *http.Request)
+	DeleteWebAuthnCredential(w http.ResponseWriter, r *http.Request)
+	PostWebAuthnLoginBegin(w http.ResponseWriter, r *http.Request)
+	PostWebAuthnLoginFinish(w http.ResponseWriter, r *http.Request)
+	PostOAuthClient(w http.ResponseWriter, r *http.Request)
+	GetOAuthClients(w http.ResponseWriter, r *http.Request)
+	DeleteOAuthClient(w http.ResponseWriter, r *http.Request)
+	GetOAuthAuthorize(w http.ResponseWriter, r *http.Request)
+	PostOAuthAuthorize(w http.ResponseWriter, r *http.Request)
+	PostOAuthToken(w http.ResponseWriter, r *http.Request)
+	PostDelegation(w http.ResponseWriter, r *http.Request)
+	GetDelegations(w http.ResponseWriter, r *http.Request)
+	DeleteDelegation(w http.ResponseWriter, r *http.Request)
+	Wrapper(tokenType string, scope string, h handler) handler
+	AdminWrapper(h handler) handler
 }
 
 type authController struct {
-	db        storage.DB
-	jwtSecret string
+	db       storage.DB
+	keys     *keys.Set
+	webAuthn *webauthn.WebAuthn
+	mailer   mailer.Mailer
+	bus      *events.Bus
 }
 
 type tokens struct {
@@ -42,13 +82,41 @@ type tokens struct {
 }
 
 type TokenClaims struct {
-	Type     string `json:"type"`
-	Username string `json:"username"`
+	Type      string `json:"type"`
+	Username  string `json:"username"`
+	SessionId string `json:"sid,omitempty"`
+	// the address an email verification token confirms
+	Email string `json:"email,omitempty"`
+	// fingerprint of the password hash a reset token was issued against, so
+	// the token stops working once the password has been changed
+	PasswordHash string `json:"pwh,omitempty"`
+	// the third-party app a token was granted to, and what it may do. Empty
+	// on tokens from a user logging in themselves
+	ClientId string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// set on access tokens of admins. The admin API checks the user is still
+	// an admin as well
+	Role string `json:"role,omitempty"`
 	jwt.StandardClaims
 }
 
-func NewAuthController(db storage.DB, jwtSecret string) AuthController {
-	return &authController{db, jwtSecret}
+// Tokens without a scope have every scope
+func (c *TokenClaims) HasScope(scope string) bool {
+	if c.Scope == "" {
+		return true
+	}
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// New logins are published to bus, so the user can be told
+func NewAuthController(db storage.DB, keys *keys.Set, webAuthn *webauthn.WebAuthn, mailer mailer.Mailer,
+	bus *events.Bus) AuthController {
+	return &authController{db, keys, webAuthn, mailer, bus}
 }
 
 func (a *authController) GetRefreshToken(w http.ResponseWriter, r *http.Request) {
@@ -64,101 +132,259 @@ func (a *authController) GetRefreshToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	now := time.Now().UTC()
+	ip := utils.ClientIp(r)
+	retry, locked, err := beginLoginAttempt(r.Context(), a.db, username, ip, now)
+	if err != nil {
+		log.Printf("could not check login throttle for user %v\n%v", username, err)
+		utils.SendError(w, "Error checking login attempts", http.StatusInternalServerError)
+		return
+	}
+	if retry > 0 {
+		sendRetryAfter(w, retry)
+		return
+	}
+
+	// a missing user fails the same way, and takes as long, as a wrong password
 	user, err := a.db.GetUser(username)
 	if storage.IsNotFound(err) {
-		utils.SendError(w, fmt.Sprintf("User %v not found", username), http.StatusNotFound)
-		return
+		user = nil
 	} else if err != nil {
 		log.Printf("could not get user %v from the database\n%v", username, err)
 		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
 		return
 	}
 
-	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
-		utils.SendError(w, "Password incorrect", http.StatusUnauthorized)
+	hash := dummyPasswordHash
+	if user != nil {
+		hash = []byte(user.Password)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || user == nil {
+		loginFailed(w, r, a.db, a.mailer, username, user, locked, now, "Username or password incorrect")
 		return
 	}
 
-	refreshToken, err := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
-		"exp":      time.Now().Add(refreshExpiryTime).Unix(),
-		"type":     RefreshTokenType,
-		"username": username,
-	}).SignedString([]byte(a.jwtSecret))
+	ok, err := verifySecondFactor(a.db, username, r)
 	if err != nil {
-		log.Printf("could not generate refresh token\n%v", err)
-		utils.SendError(w, "Error generating token", http.StatusInternalServerError)
+		log.Printf("could not verify second factor for user %v\n%v", username, err)
+		utils.SendError(w, "Error verifying two-factor code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		loginFailed(w, r, a.db, a.mailer, username, user, locked, now, "Valid two-factor code required")
+		return
+	}
+
+	err = loginSucceeded(r.Context(), a.db, username, ip)
+	if err != nil {
+		log.Printf("could not reset login throttle for user %v\n%v", username, err)
+	}
+
+	a.startSession(w, r, username)
+}
+
+// Creates a session for a user who has just authenticated, and sends them its
+// first refresh and access tokens
+func (a *authController) startSession(w http.ResponseWriter, r *http.Request, username string) {
+	now := time.Now().UTC()
+	session := models.Session{
+		Id:        uuid.NewV4().String(),
+		Username:  username,
+		RefreshId: uuid.NewV4().String(),
+		Device:    r.Header.Get("Device"),
+		UserAgent: r.UserAgent(),
+		Ip:        utils.ClientIp(r),
+		Created:   now,
+		LastUsed:  now,
+	}
+
+	audit := newAuditEntry(r, auditSessionCreate, username, nil, map[string]string{"session": session.Id, "device": session.Device})
+	audit.Actor = username
+	err := a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.CreateSession(&session); err != nil {
+			return err
+		}
+		return tx.AppendAudit(audit)
+	})
+	if err != nil {
+		log.Printf("could not create session for user %v\n%v", username, err)
+		utils.SendError(w, "Error creating session", http.StatusInternalServerError)
 		return
 	}
 
-	accessToken, err := a.getAccessToken(username)
+	a.bus.Publish(events.Event{
+		Type:     events.TypeLogin,
+		Username: username,
+		Time:     now,
+		Data:     events.Login{Session: session.Id, Device: session.Device, UserAgent: session.UserAgent, Ip: session.Ip},
+	})
+
+	t, err := a.sessionTokens(&session)
 	if err != nil {
-		log.Printf("could not generate access token\n%v", err)
+		log.Printf("could not generate tokens\n%v", err)
 		utils.SendError(w, "Error generating token", http.StatusInternalServerError)
 		return
 	}
 
-	t := tokens{
-		RefreshToken: refreshToken,
-		AccessToken:  accessToken,
+	utils.SendSuccess(w, t, http.StatusOK)
+}
+
+// Exchanges a refresh token for a new access token and a new refresh token.
+// Each refresh token can only be used once, so if one is presented again it
+// has leaked, and the whole session is revoked and flagged as compromised
+func (a *authController) GetAuthToken(w http.ResponseWriter, r *http.Request) {
+	t, err := a.rotateTokens(r, requestClaims(r))
+	if storage.IsNotFound(err) {
+		utils.SendError(w, "Refresh token has already been used, session revoked", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("could not generate tokens\n%v", err)
+		utils.SendError(w, "Error generating token", http.StatusInternalServerError)
+		return
 	}
 
 	utils.SendSuccess(w, t, http.StatusOK)
+}
 
-	err = a.db.UpdateTokenValidity(username, true)
-	if err != nil {
-		log.Printf("could not set user token validity to valid\n%v", err)
+// Swaps the refresh token the claims came from for a new one, along with a
+// new access token. A refresh token that has already been swapped must have
+// leaked, so its session is revoked and NotFound returned
+func (a *authController) rotateTokens(r *http.Request, claims *TokenClaims) (tokens, error) {
+	session := &models.Session{
+		Id:        claims.SessionId,
+		Username:  claims.Username,
+		RefreshId: uuid.NewV4().String(),
+		ClientId:  claims.ClientId,
+		Scope:     claims.Scope,
+	}
+
+	err := a.db.RotateSessionRefreshToken(session.Id, claims.Id, session.RefreshId, time.Now().UTC())
+	if storage.IsNotFound(err) {
+		log.Printf("refresh token %v of session %v reused, revoking session", claims.Id, claims.SessionId)
+		revokeErr := a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+			if err := tx.CompromiseSession(claims.Username, claims.SessionId); err != nil {
+				return err
+			}
+			return tx.AppendAudit(newAuditEntry(r, auditSessionCompromise, claims.Username, nil,
+				map[string]string{"session": claims.SessionId}))
+		})
+		if revokeErr != nil {
+			log.Printf("could not revoke compromised session %v\n%v", claims.SessionId, revokeErr)
+		}
+		return tokens{}, err
+	} else if err != nil {
+		return tokens{}, err
 	}
+
+	return a.sessionTokens(session)
 }
 
-func (a *authController) GetAuthToken(w http.ResponseWriter, r *http.Request) {
-	var bearerToken string
-	bearerTokens, ok := r.Header["Authorization"]
-	if ok && len(bearerTokens) >= 1 {
-		bearerToken = strings.TrimPrefix(bearerTokens[0], "Bearer ")
+// Signs the session's current refresh token, and a new access token carrying
+// the user's role if the session has full access
+func (a *authController) sessionTokens(session *models.Session) (tokens, error) {
+	var role string
+	if session.Scope == "" {
+		user, err := a.db.GetUser(session.Username)
+		if err != nil {
+			return tokens{}, err
+		}
+		role = user.Role
 	}
 
-	if bearerToken == "" {
-		utils.SendError(w, "Bearer token required", http.StatusUnauthorized)
-		return
+	refreshToken, err := a.getToken(RefreshTokenType, session, "", session.RefreshId, refreshExpiryTime)
+	if err != nil {
+		return tokens{}, err
+	}
+
+	accessToken, err := a.getToken(AccessTokenType, session, role, uuid.NewV4().String(), accessExpiryTime)
+	if err != nil {
+		return tokens{}, err
 	}
 
+	return tokens{
+		RefreshToken: refreshToken,
+		AccessToken:  accessToken,
+	}, nil
+}
+
+func (a *authController) GetSessions(w http.ResponseWriter, r *http.Request) {
 	username := mux.Vars(r)["username"]
-	if username == "" {
-		utils.SendError(w, "Username required", http.StatusBadRequest)
+
+	sessions, err := a.db.GetSessions(username)
+	if err != nil {
+		log.Printf("could not get sessions for user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting sessions from database", http.StatusInternalServerError)
 		return
 	}
 
-	user, err := a.db.GetUser(username)
+	current := requestClaims(r).SessionId
+	for i := range sessions {
+		sessions[i].Current = sessions[i].Id == current
+	}
+
+	utils.SendSuccess(w, sessions, http.StatusOK)
+}
+
+func (a *authController) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["id"]
+
+	err := a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.RevokeSession(username, id); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditSessionRevoke, username, nil, map[string]string{"session": id}))
+	})
 	if storage.IsNotFound(err) {
-		utils.SendError(w, fmt.Sprintf("User %v not found", username), http.StatusNotFound)
+		utils.SendError(w, fmt.Sprintf("Session %v not found", id), http.StatusNotFound)
 		return
 	} else if err != nil {
-		log.Printf("could not get user %v from the database\n%v", username, err)
-		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		log.Printf("could not revoke session %v for user %v\n%v", id, username, err)
+		utils.SendError(w, "Error revoking session", http.StatusInternalServerError)
 		return
 	}
 
-	if user.InvalidatedTokens {
-		utils.SendError(w, "Refresh token has been invalidated", http.StatusUnauthorized)
-		return
-	}
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+func (a *authController) DeleteSessions(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
 
-	if err := a.validateAccessToken(bearerToken, user.Username, RefreshTokenType); err != nil {
-		utils.SendError(w, err.Error(), http.StatusBadRequest)
+	err := a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.RevokeSessions(username); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditSessionRevokeAll, username, nil, nil))
+	})
+	if err != nil {
+		log.Printf("could not revoke sessions for user %v\n%v", username, err)
+		utils.SendError(w, "Error revoking sessions", http.StatusInternalServerError)
 		return
 	}
 
-	accessToken, err := a.getAccessToken(username)
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Publishes the public keys access tokens are signed with, so that other
+// services can verify them. Follows RFC 7517 rather than our response format
+func (a *authController) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	respBody, err := json.Marshal(a.keys.JWKS())
 	if err != nil {
-		log.Printf("could not generate access token\n%v", err)
-		utils.SendError(w, "Error generating token", http.StatusInternalServerError)
+		log.Printf("could not marshal JWKS\n%v", err)
+		utils.SendError(w, "Could not convert response to JSON", http.StatusInternalServerError)
 		return
 	}
 
-	utils.SendSuccess(w, tokens{AccessToken: accessToken}, http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
 }
 
-func (a *authController) Wrapper(tokenType string, h handler) handler {
+// Checks the bearer token is a valid token of tokenType for the user in the
+// path, with scope unless scope is empty, and that its session has not been
+// revoked. The token's claims are passed on to h in the request context
+func (a *authController) Wrapper(tokenType string, scope string, h handler) handler {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var bearerToken string
 		bearerTokens, ok := r.Header["Authorization"]
@@ -177,39 +403,126 @@ func (a *authController) Wrapper(tokenType string, h handler) handler {
 			return
 		}
 
-		err := a.validateAccessToken(bearerToken, username, tokenType)
+		claims, err := validateToken(a.keys, bearerToken, username, tokenType)
 		if err != nil {
 			utils.SendError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		h(w, r)
+		if scope != "" && !claims.HasScope(scope) {
+			utils.SendError(w, fmt.Sprintf("Token does not have the '%v' scope", scope), http.StatusForbidden)
+			return
+		}
+
+		session, err := a.db.GetSession(username, claims.SessionId)
+		if storage.IsNotFound(err) || (err == nil && session.Revoked) {
+			utils.SendError(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Printf("could not get session %v from the database\n%v", claims.SessionId, err)
+			utils.SendError(w, "Error checking token", http.StatusInternalServerError)
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
 		return
 	}
 }
 
-func (a *authController) validateAccessToken(token string, username string, tokenType string) error {
-	refreshToken, err := jwt.ParseWithClaims(token, &TokenClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(a.jwtSecret), nil
-		},
-	)
+// Checks the request has a valid access token of an admin before passing it
+// on to h. Unlike Wrapper, the token can be for any user, as admin routes act
+// on other users' accounts
+func (a *authController) AdminWrapper(h handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearerToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if bearerToken == "" {
+			utils.SendError(w, "Bearer token required", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := parseToken(a.keys, bearerToken, AccessTokenType)
+		if err != nil {
+			utils.SendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if claims.Role != models.RoleAdmin || claims.Scope != "" {
+			utils.SendError(w, "Admin token required", http.StatusForbidden)
+			return
+		}
+
+		session, err := a.db.GetSession(claims.Username, claims.SessionId)
+		if storage.IsNotFound(err) || (err == nil && session.Revoked) {
+			utils.SendError(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Printf("could not get session %v from the database\n%v", claims.SessionId, err)
+			utils.SendError(w, "Error checking token", http.StatusInternalServerError)
+			return
+		}
 
-	if claims, ok := refreshToken.Claims.(*TokenClaims); ok && refreshToken.Valid && err == nil {
-		if claims.Type != tokenType {
-			return fmt.Errorf("Invalid token provided, '%v' token expected, got token with type '%v'", tokenType, claims.Type)
+		// the role may have been taken away since the token was issued
+		admin, err := a.db.GetUser(claims.Username)
+		if err != nil {
+			log.Printf("could not get user %v from the database\n%v", claims.Username, err)
+			utils.SendError(w, "Error checking token", http.StatusInternalServerError)
+			return
+		}
+		if admin.Role != models.RoleAdmin {
+			utils.SendError(w, "Admin token required", http.StatusForbidden)
+			return
 		}
-	} else {
-		return fmt.Errorf("Invalid token")
+
+		h(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
+	}
+}
+
+// Returns the claims of the token a request was authorized with by Wrapper
+func requestClaims(r *http.Request) *TokenClaims {
+	claims, _ := r.Context().Value(claimsKey).(*TokenClaims)
+	return claims
+}
+
+func validateToken(keySet *keys.Set, token string, username string, tokenType string) (*TokenClaims, error) {
+	claims, err := parseToken(keySet, token, tokenType)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Username != username {
+		return nil, fmt.Errorf("Invalid token provided, token was not issued for user %v", username)
+	}
+
+	return claims, nil
+}
+
+// Checks the signature, expiry and type of a token, whoever it was issued for
+func parseToken(keySet *keys.Set, token string, tokenType string) (*TokenClaims, error) {
+	parsed, err := jwt.ParseWithClaims(token, &TokenClaims{}, keySet.Keyfunc)
+	if err != nil || !parsed.Valid {
+		return nil, fmt.Errorf("Invalid token")
+	}
+
+	claims, ok := parsed.Claims.(*TokenClaims)
+	if !ok {
+		return nil, fmt.Errorf("Invalid token")
+	}
+	if claims.Type != tokenType {
+		return nil, fmt.Errorf("Invalid token provided, '%v' token expected, got token with type '%v'", tokenType, claims.Type)
 	}
 
-	return nil
+	return claims, nil
 }
 
-func (a *authController) getAccessToken(username string) (string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
-		"exp":      time.Now().Add(accessExpiryTime).Unix(),
-		"type":     AccessTokenType,
-		"username": username,
-	}).SignedString([]byte(a.jwtSecret))
+func (a *authController) getToken(tokenType string, session *models.Session, role string, id string, expiry time.Duration) (string, error) {
+	standardClaims := newStandardClaims(expiry)
+	standardClaims.Id = id
+	return a.keys.Sign(TokenClaims{
+		Type:           tokenType,
+		Username:       session.Username,
+		SessionId:      session.Id,
+		ClientId:       session.ClientId,
+		Scope:          session.Scope,
+		Role:           role,
+		StandardClaims: standardClaims,
+	})
 }
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/storage"
+)
+
+// Returns a database with the current schema, in a file removed once the test
+// ends
+func newTestDB(t *testing.T) storage.DB {
+	path := filepath.Join(t.TempDir(), "fund.db")
+	schema, err := ioutil.ReadFile("../storage/db.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	db, err := storage.GetDB("sqlite3", path, events.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+const (
+	delegationMaxExpiryTime = (time.Minute * 60 * 24) * 365
+)
+
+// Mints a delegated token. The body gives the delegation's name, domains,
+// spendCap and expires, and optionally its scope, which defaults to making
+// payments. The token is only ever sent in this response
+func (a *authController) PostDelegation(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var delegation models.Delegation
+	err := json.NewDecoder(r.Body).Decode(&delegation)
+	if err != nil {
+		log.Printf("could not unmarshal PostDelegation request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	delegation.Name = strings.TrimSpace(delegation.Name)
+	if delegation.Name == "" {
+		utils.SendError(w, "Delegation name required", http.StatusBadRequest)
+		return
+	}
+
+	if len(delegation.Domains) == 0 {
+		utils.SendError(w, "At least one domain required", http.StatusBadRequest)
+		return
+	}
+	for i, d := range delegation.Domains {
+		domain := utils.Domain(d)
+		if domain == "" {
+			utils.SendError(w, fmt.Sprintf("Domain '%v' is not valid", d), http.StatusBadRequest)
+			return
+		}
+		delegation.Domains[i] = domain
+	}
+
+	if delegation.SpendCap <= 0 {
+		utils.SendError(w, "Spend cap must be greater than 0", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	if !delegation.Expires.After(now) || delegation.Expires.Sub(now) > delegationMaxExpiryTime {
+		utils.SendError(w, fmt.Sprintf("Expiry must be in the future and within %v days",
+			int(delegationMaxExpiryTime.Hours()/24)), http.StatusBadRequest)
+		return
+	}
+
+	if delegation.Scope == "" {
+		delegation.Scope = models.ScopePaymentsCreate
+	}
+	scopes, err := parseScope(delegation.Scope, models.ScopeDescriptions)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	session := &models.Session{
+		Id:        uuid.NewV4().String(),
+		Username:  username,
+		Device:    delegation.Name,
+		UserAgent: r.UserAgent(),
+		Ip:        utils.ClientIp(r),
+		Scope:     strings.Join(scopes, " "),
+		Created:   now,
+		LastUsed:  now,
+	}
+
+	delegation.Id = session.Id
+	delegation.Username = username
+	delegation.Scope = session.Scope
+	delegation.Spent = 0
+	delegation.Created = now
+	delegation.Expires = delegation.Expires.UTC()
+
+	err = a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.CreateSession(session); err != nil {
+			return err
+		}
+		if err := tx.CreateDelegation(&delegation); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditDelegationCreate, username, nil, map[string]interface{}{
+			"delegation": delegation.Id,
+			"scope":      delegation.Scope,
+			"expires":    delegation.Expires,
+		}))
+	})
+	if err != nil {
+		log.Printf("could not create delegation for user %v\n%v", username, err)
+		utils.SendError(w, "Error creating delegation", http.StatusInternalServerError)
+		return
+	}
+
+	delegation.Token, err = a.getToken(AccessTokenType, session, "", uuid.NewV4().String(), delegation.Expires.Sub(now))
+	if err != nil {
+		log.Printf("could not generate delegated token\n%v", err)
+		utils.SendError(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, delegation, http.StatusCreated)
+}
+
+func (a *authController) GetDelegations(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	delegations, err := a.db.GetDelegations(username)
+	if err != nil {
+		log.Printf("could not get delegations of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting delegations", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, delegations, http.StatusOK)
+}
+
+// Revokes a delegated token. Revoking its session does the same
+func (a *authController) DeleteDelegation(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["id"]
+
+	err := a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if _, err := tx.GetDelegation(username, id); err != nil {
+			return err
+		}
+		if err := tx.RevokeSession(username, id); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditDelegationRevoke, username, nil, map[string]string{"delegation": id}))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Delegation %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not revoke delegation %v of user %v\n%v", id, username, err)
+		utils.SendError(w, "Error revoking delegation", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
@@ -50,10 +50,19 @@ func (d *depositController) PostDeposit(w http.ResponseWriter, r *http.Request)
 
 	deposit.Username = mux.Vars(r)["username"]
 	deposit.Id = uuid.NewV4().String()
-	deposit.Time = time.Now().Format(storage.TimeFormat)
-
-	err = d.db.CreateDeposit(&deposit)
-	if err != nil {
+	deposit.Time = time.Now().UTC()
+
+	err = d.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.CreateDeposit(&deposit); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditDepositCreate, deposit.Username, nil,
+			map[string]interface{}{"deposit": deposit.Id, "amount": deposit.Amount}))
+	})
+	if storage.IsAccountFrozen(err) {
+		utils.SendError(w, "Account is frozen", http.StatusForbidden)
+		return
+	} else if err != nil {
 		log.Printf("could not insert deposit %v into database\n%v", deposit, err)
 		utils.SendError(w, "Error inserting deposit into database", http.StatusInternalServerError)
 		return
@@ -91,6 +100,17 @@ func (d *depositController) GetDeposits(w http.ResponseWriter, r *http.Request)
 	err := utils.ParseArgs(r, args)
 	if err != nil {
 		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, err := ledgerFormat(r)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format != ledgerFormatJson {
+		d.streamDeposits(w, username, args, format)
+		return
 	}
 
 	if args.Count == 0 {
@@ -98,13 +118,51 @@ func (d *depositController) GetDeposits(w http.ResponseWriter, r *http.Request)
 	}
 
 	deposits, err := d.db.GetDeposits(username, args)
-	if err != nil {
+	if storage.IsBadQuery(err) {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		log.Printf("could not get deposits for user %v from the database\n%v", username, err)
 		utils.SendError(w, "Error getting deposits from database", http.StatusInternalServerError)
 		return
 	}
 
-	utils.SendPage(w, r, deposits, args.Offset+depositPageSize, depositPageSize, len(deposits) == args.Count)
+	var next utils.Cursor
+	if len(deposits) == args.Count {
+		last := deposits[len(deposits)-1]
+		next = last.Cursor(args)
+	}
+
+	utils.SendPage(w, r, deposits, next)
+}
+
+// Streams every deposit matching the request as CSV or OFX, rather than a
+// page of them
+func (d *depositController) streamDeposits(w http.ResponseWriter, username string, args *models.DepositArgs, format string) {
+	args.Order = ledgerOrder(args.Sort, args.Order)
+
+	user, err := d.db.GetUser(username)
+	if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		return
+	}
+
+	ledger := newLedgerWriter(w, format, "deposits", username, user.Balance, args.Oldest, args.Newest)
+	err = d.db.EachDeposit(username, args, func(d *models.Deposit) error {
+		return ledger.Write(ledgerEntry{Id: d.Id, Time: d.Time, Amount: d.Amount})
+	})
+	if err == nil {
+		err = ledger.Close()
+	}
+	if err != nil && ledger.Started() {
+		log.Printf("could not stream deposits for user %v\n%v", username, err)
+	} else if storage.IsBadQuery(err) {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+	} else if err != nil {
+		log.Printf("could not get deposits for user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting deposits from database", http.StatusInternalServerError)
+	}
 }
 
 func (d *depositController) GetDepositsSum(w http.ResponseWriter, r *http.Request) {
@@ -114,10 +172,14 @@ func (d *depositController) GetDepositsSum(w http.ResponseWriter, r *http.Reques
 	err := utils.ParseArgs(r, args)
 	if err != nil {
 		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	sum, err := d.db.GetDepositsSum(username, args)
-	if err != nil {
+	if storage.IsBadQuery(err) {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		log.Printf("could not get deposits sum for user %v from the database\n%v", username, err)
 		utils.SendError(w, "Error getting deposits sum from database", http.StatusInternalServerError)
 		return
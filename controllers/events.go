@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+// how often a comment is sent on an idle stream, so proxies don't close it
+const eventKeepAliveInterval = time.Second * 30
+
+type EventController interface {
+	GetEvents(w http.ResponseWriter, r *http.Request)
+}
+
+type eventController struct {
+	db  storage.DB
+	bus *events.Bus
+}
+
+func NewEventController(db storage.DB, bus *events.Bus) EventController {
+	return &eventController{db, bus}
+}
+
+// Streams the user's events as server-sent events, starting with their
+// current balance. Deposit and payment events are only sent to tokens that
+// can read deposits and payments, logins, revoked sessions and notifications
+// only to tokens that can manage the account
+func (e *eventController) GetEvents(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	claims := requestClaims(r)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("could not stream events, response writer %T can't flush", w)
+		utils.SendError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribed before reading the balance, so no change can fall between
+	ch, unsubscribe := e.bus.Subscribe(username)
+	defer unsubscribe()
+
+	user, err := e.db.GetUser(username)
+	if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	current := events.Event{
+		Type:     events.TypeBalance,
+		Username: username,
+		Time:     time.Now().UTC(),
+		Data:     events.Balance{Balance: user.Balance, Previous: user.Balance},
+	}
+	if err := writeEvent(w, current); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	// the stream ends when its token expires or its session is revoked, and
+	// within a keep-alive of the account being deleted, as requests made with
+	// the token from then on would be refused
+	expired := time.NewTimer(time.Until(time.Unix(claims.ExpiresAt, 0)))
+	defer expired.Stop()
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-expired.C:
+			return
+		case <-keepAlive.C:
+			if !e.sessionActive(username, claims.SessionId) {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event := <-ch:
+			if revoked, ok := event.Data.(events.SessionRevoked); ok && revoked.Session == claims.SessionId {
+				return
+			}
+			if !eventAllowed(claims, event) {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// Whether the session a stream's token belongs to still exists and hasn't
+// been revoked
+func (e *eventController) sessionActive(username, id string) bool {
+	session, err := e.db.GetSession(username, id)
+	if err != nil {
+		if !storage.IsNotFound(err) {
+			log.Printf("could not get session %v from the database\n%v", id, err)
+		}
+		return false
+	}
+	return !session.Revoked
+}
+
+func eventAllowed(claims *TokenClaims, event events.Event) bool {
+	switch event.Type {
+	case events.TypeDeposit:
+		return claims.HasScope(models.ScopeDepositsRead)
+	case events.TypePayment, events.TypePaymentFailed:
+		return claims.HasScope(models.ScopePaymentsRead)
+	case events.TypeLogin, events.TypeSessionRevoked, events.TypeNotification:
+		return claims.HasScope(models.ScopeAccountAdmin)
+	}
+	return true
+}
+
+func writeEvent(w http.ResponseWriter, event events.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("could not marshal %v event for user %v\n%v", event.Type, event.Username, err)
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event.Type, data)
+	return err
+}
+
+// Lets a request carry its bearer token in the access_token parameter, for
+// clients like EventSource that can't set headers. Only for routes that
+// don't change anything, as the token may end up in logs
+func QueryTokenWrapper(h handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		h(w, r)
+	}
+}
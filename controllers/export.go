@@ -0,0 +1,380 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+
+	"github.com/crowdpower/fund/keys"
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+const (
+	// how long a finished archive is kept
+	exportExpiryTime = (time.Minute * 60 * 24) * 7
+	// how long each download link works for
+	exportLinkExpiryTime = time.Minute * 60
+	// after which a pending export is taken to have been lost, e.g. to a
+	// restart, and another can be started
+	exportBuildTimeout = time.Minute * 60
+)
+
+type ExportController interface {
+	PostExport(w http.ResponseWriter, r *http.Request)
+	GetExports(w http.ResponseWriter, r *http.Request)
+	GetExport(w http.ResponseWriter, r *http.Request)
+	GetExportArchive(w http.ResponseWriter, r *http.Request)
+}
+
+type exportController struct {
+	db   storage.DB
+	keys *keys.Set
+}
+
+func NewExportController(db storage.DB, keys *keys.Set) ExportController {
+	return &exportController{db, keys}
+}
+
+// Starts building an archive of everything held about the user. It's built in
+// the background, poll the export until its status is ready to get the link
+func (e *exportController) PostExport(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	now := time.Now().UTC()
+
+	err := e.db.DeleteExpiredExports(now)
+	if err != nil {
+		log.Printf("could not delete expired exports\n%v", err)
+	}
+
+	exports, err := e.db.GetExports(username)
+	if err != nil {
+		log.Printf("could not get exports of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting exports", http.StatusInternalServerError)
+		return
+	}
+	for _, export := range exports {
+		if export.Status == models.ExportPending && now.Sub(export.Created) < exportBuildTimeout {
+			utils.SendError(w, "An export is already being prepared", http.StatusConflict)
+			return
+		}
+	}
+
+	export := models.Export{
+		Id:       uuid.NewV4().String(),
+		Username: username,
+		Status:   models.ExportPending,
+		Created:  now,
+	}
+
+	err = e.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.CreateExport(&export); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditExportCreate, username, nil, map[string]string{"export": export.Id}))
+	})
+	if err != nil {
+		log.Printf("could not create export for user %v\n%v", username, err)
+		utils.SendError(w, "Error creating export", http.StatusInternalServerError)
+		return
+	}
+
+	built := export
+	go e.build(&built)
+
+	utils.SendSuccess(w, export, http.StatusAccepted)
+}
+
+func (e *exportController) GetExports(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	exports, err := e.db.GetExports(username)
+	if err != nil {
+		log.Printf("could not get exports of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting exports", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range exports {
+		err := e.setLink(&exports[i], r.URL.Path+"/"+exports[i].Id)
+		if err != nil {
+			log.Printf("could not generate export download token\n%v", err)
+			utils.SendError(w, "Error generating token", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	utils.SendSuccess(w, exports, http.StatusOK)
+}
+
+func (e *exportController) GetExport(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["id"]
+
+	export, err := e.db.GetExport(username, id)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Export %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get export %v of user %v\n%v", id, username, err)
+		utils.SendError(w, "Error getting export", http.StatusInternalServerError)
+		return
+	}
+
+	err = e.setLink(export, r.URL.Path)
+	if err != nil {
+		log.Printf("could not generate export download token\n%v", err)
+		utils.SendError(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, export, http.StatusOK)
+}
+
+// Downloads a ready export. Authorised by the token in the link rather than
+// an access token, so the link can be opened directly in a browser
+func (e *exportController) GetExportArchive(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["id"]
+
+	claims, err := validateToken(e.keys, r.URL.Query().Get("token"), username, ExportTokenType)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claims.Subject != id {
+		utils.SendError(w, fmt.Sprintf("Invalid token provided, token was not issued for export %v", id), http.StatusUnauthorized)
+		return
+	}
+
+	export, err := e.db.GetExport(username, id)
+	if err == nil && export.Expires != nil && export.Expires.Before(time.Now()) {
+		utils.SendError(w, fmt.Sprintf("Export %v has expired", id), http.StatusNotFound)
+		return
+	}
+	var archive []byte
+	if err == nil {
+		archive, err = e.db.GetExportArchive(username, id)
+	}
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Export %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get archive of export %v of user %v\n%v", id, username, err)
+		utils.SendError(w, "Error getting export", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="fund-%v-%v.zip"`,
+		username, export.Created.Format("2006-01-02")))
+	w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(archive)
+}
+
+// Gives a ready export a link to download it from, at path/archive
+func (e *exportController) setLink(export *models.Export, path string) error {
+	if export.Status != models.ExportReady {
+		return nil
+	}
+
+	standardClaims := newStandardClaims(exportLinkExpiryTime)
+	standardClaims.Subject = export.Id
+	token, err := e.keys.Sign(TokenClaims{
+		Type:           ExportTokenType,
+		Username:       export.Username,
+		StandardClaims: standardClaims,
+	})
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("token", token)
+	export.Url = fmt.Sprintf("%v/archive?%v", path, query.Encode())
+	return nil
+}
+
+// Builds the archive of an export and stores it, or marks the export failed
+func (e *exportController) build(export *models.Export) {
+	archive, err := buildExportArchive(e.db, export.Username)
+
+	now := time.Now().UTC()
+	export.Completed = &now
+	if err != nil {
+		log.Printf("could not build export %v of user %v\n%v", export.Id, export.Username, err)
+		export.Status = models.ExportFailed
+		archive = nil
+	} else {
+		expires := now.Add(exportExpiryTime)
+		export.Status = models.ExportReady
+		export.Expires = &expires
+	}
+
+	err = e.db.FinishExport(export, archive)
+	if err != nil {
+		log.Printf("could not store export %v of user %v\n%v", export.Id, export.Username, err)
+	}
+}
+
+// Zips up a user's profile, ledger, sessions, audit log entries,
+// notifications and public profile, each as both JSON and CSV
+func buildExportArchive(db storage.DB, username string) ([]byte, error) {
+	user, err := db.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	user.Password = ""
+
+	deposits, err := db.GetDeposits(username, &models.DepositArgs{Order: models.OrderAsc})
+	if err != nil {
+		return nil, err
+	}
+	payments, err := db.GetPayments(username, &models.PaymentArgs{Order: models.OrderAsc})
+	if err != nil {
+		return nil, err
+	}
+	adjustments, err := db.GetAdjustments(username)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := db.GetSessions(username)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications, err := db.GetNotifications(username, &models.NotificationArgs{})
+	if err != nil {
+		return nil, err
+	}
+
+	var profile *models.PublicProfile
+	profile, err = db.GetPublicProfile(username)
+	if err != nil && !storage.IsNotFound(err) {
+		return nil, err
+	}
+	supporterSites, err := db.GetSupporterSites(username)
+	if err != nil {
+		return nil, err
+	}
+
+	// entries about the user, and entries of what the user did to others
+	audit, err := db.GetAuditEntries(&models.AuditArgs{Target: username})
+	if err != nil {
+		return nil, err
+	}
+	acted, err := db.GetAuditEntries(&models.AuditArgs{Actor: username})
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range acted {
+		if entry.Target != username {
+			audit = append(audit, entry)
+		}
+	}
+	sort.Slice(audit, func(i, j int) bool { return audit[i].Seq < audit[j].Seq })
+
+	files := []struct {
+		name   string
+		value  interface{}
+		header []string
+		rows   [][]string
+	}{
+		{"profile", user, []string{"username", "email", "emailVerified", "role", "frozen", "balance"},
+			[][]string{{user.Username, user.Email, strconv.FormatBool(user.EmailVerified), user.Role,
+				strconv.FormatBool(user.Frozen), strconv.Itoa(user.Balance)}}},
+		{"deposits", deposits, []string{"id", "amount", "time"}, nil},
+		{"payments", payments, []string{"id", "amount", "time", "url"}, nil},
+		{"adjustments", adjustments, []string{"id", "amount", "reason", "admin", "time"}, nil},
+		{"sessions", sessions, []string{"id", "device", "userAgent", "ip", "clientId", "scope", "created",
+			"lastUsed", "revoked", "compromised"}, nil},
+		{"audit", audit, []string{"seq", "time", "actor", "session", "action", "target", "before", "after", "ip",
+			"userAgent"}, nil},
+		{"notifications", notifications, []string{"id", "kind", "title", "body", "created", "read"}, nil},
+		{"public_profile", profile, []string{"id", "displayName", "bio", "showAmounts", "created"}, nil},
+		{"supporter_sites", supporterSites, []string{"id", "siteId", "created"}, nil},
+	}
+	for _, d := range deposits {
+		files[1].rows = append(files[1].rows, []string{d.Id, strconv.Itoa(d.Amount), exportTime(d.Time)})
+	}
+	for _, p := range payments {
+		files[2].rows = append(files[2].rows, []string{p.Id, strconv.Itoa(p.Amount), exportTime(p.Time), p.Url})
+	}
+	for _, a := range adjustments {
+		files[3].rows = append(files[3].rows, []string{a.Id, strconv.Itoa(a.Amount), a.Reason, a.Admin,
+			exportTime(a.Time)})
+	}
+	for _, s := range sessions {
+		files[4].rows = append(files[4].rows, []string{s.Id, s.Device, s.UserAgent, s.Ip, s.ClientId, s.Scope,
+			exportTime(s.Created), exportTime(s.LastUsed), strconv.FormatBool(s.Revoked),
+			strconv.FormatBool(s.Compromised)})
+	}
+	for _, a := range audit {
+		files[5].rows = append(files[5].rows, []string{strconv.FormatInt(a.Seq, 10), exportTime(a.Time), a.Actor,
+			a.Session, a.Action, a.Target, string(a.Before), string(a.After), a.Ip, a.UserAgent})
+	}
+
+	for _, n := range notifications {
+		var read string
+		if n.Read != nil {
+			read = exportTime(*n.Read)
+		}
+		files[6].rows = append(files[6].rows, []string{n.Id, n.Kind, n.Title, n.Body, exportTime(n.Created), read})
+	}
+
+	if profile != nil {
+		files[7].rows = [][]string{{profile.Id, profile.DisplayName, profile.Bio,
+			strconv.FormatBool(profile.ShowAmounts), exportTime(profile.Created)}}
+	}
+	for _, s := range supporterSites {
+		files[8].rows = append(files[8].rows, []string{s.Id, s.SiteId, exportTime(s.Created)})
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, f := range files {
+		jsonFile, err := archive.Create(f.name + ".json")
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(jsonFile)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(f.value); err != nil {
+			return nil, err
+		}
+
+		csvFile, err := archive.Create(f.name + ".csv")
+		if err != nil {
+			return nil, err
+		}
+		writer := csv.NewWriter(csvFile)
+		if err := writer.Write(f.header); err != nil {
+			return nil, err
+		}
+		if err := writer.WriteAll(f.rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func exportTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
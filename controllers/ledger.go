@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+// Formats deposits and payments can be listed in. JSON is paged, the others
+// stream the whole listing
+const (
+	ledgerFormatJson = "json"
+	ledgerFormatCsv  = "csv"
+	ledgerFormatOfx  = "ofx"
+)
+
+var ledgerMediaTypes = map[string]string{
+	"application/json":  ledgerFormatJson,
+	"text/csv":          ledgerFormatCsv,
+	"application/x-ofx": ledgerFormatOfx,
+}
+
+const (
+	ofxTimeFormat = "20060102150405.000[0:GMT]"
+	// balances are in credits rather than a real currency
+	ofxCurrency = "XXX"
+	// the longest NAME and MEMO OFX allows
+	ofxNameLength = 32
+	ofxMemoLength = 255
+)
+
+// Picks the format of a listing from its format parameter, or failing that
+// the first supported type in its Accept header. Defaults to JSON
+func ledgerFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("format"); format != "" {
+		for _, f := range ledgerMediaTypes {
+			if f == format {
+				return format, nil
+			}
+		}
+		return "", fmt.Errorf("Format must be '%v', '%v' or '%v'", ledgerFormatJson, ledgerFormatCsv, ledgerFormatOfx)
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if format, ok := ledgerMediaTypes[mediaType]; ok {
+			return format, nil
+		}
+	}
+	return ledgerFormatJson, nil
+}
+
+// A deposit or payment, as written to a CSV or OFX listing. Amount is always
+// positive, payments are debits
+type ledgerEntry struct {
+	Id     string
+	Time   time.Time
+	Amount int
+	Debit  bool
+	Url    string
+}
+
+// Writes a listing row by row. Nothing is written until the first entry, or
+// Close if there are none, so errors from before the listing starts can still
+// be sent as JSON
+type ledgerWriter interface {
+	Write(entry ledgerEntry) error
+	Close() error
+	Started() bool
+}
+
+// Starts a listing of name, e.g. "payments", for username. OFX statements
+// end with the balance, and cover from oldest to newest, which default to
+// the epoch and now
+func newLedgerWriter(w http.ResponseWriter, format, name, username string, balance int, oldest, newest time.Time) ledgerWriter {
+	if oldest.IsZero() {
+		oldest = time.Unix(0, 0)
+	}
+	if newest.IsZero() {
+		newest = time.Now()
+	}
+	if format == ledgerFormatOfx {
+		return &ofxLedgerWriter{w: w, name: name, username: username, balance: balance, oldest: oldest, newest: newest}
+	}
+	return &csvLedgerWriter{w: w, name: name, withUrl: name == "payments"}
+}
+
+type csvLedgerWriter struct {
+	w       http.ResponseWriter
+	csv     *csv.Writer
+	name    string
+	withUrl bool
+}
+
+func (c *csvLedgerWriter) start() error {
+	c.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	c.w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v.csv"`, c.name))
+	c.w.WriteHeader(http.StatusOK)
+
+	c.csv = csv.NewWriter(c.w)
+	header := []string{"id", "time", "amount"}
+	if c.withUrl {
+		header = append(header, "url")
+	}
+	return c.csv.Write(header)
+}
+
+func (c *csvLedgerWriter) Started() bool {
+	return c.csv != nil
+}
+
+func (c *csvLedgerWriter) Write(entry ledgerEntry) error {
+	if !c.Started() {
+		if err := c.start(); err != nil {
+			return err
+		}
+	}
+
+	row := []string{entry.Id, entry.Time.UTC().Format(time.RFC3339Nano), strconv.Itoa(entry.Amount)}
+	if c.withUrl {
+		row = append(row, entry.Url)
+	}
+	return c.csv.Write(row)
+}
+
+func (c *csvLedgerWriter) Close() error {
+	if !c.Started() {
+		if err := c.start(); err != nil {
+			return err
+		}
+	}
+	c.csv.Flush()
+	return c.csv.Error()
+}
+
+// Writes an OFX 2.2 bank statement, the user's account standing in for a bank
+// account
+type ofxLedgerWriter struct {
+	w        http.ResponseWriter
+	xml      *xml.Encoder
+	name     string
+	username string
+	balance  int
+	oldest   time.Time
+	newest   time.Time
+}
+
+type ofxTransaction struct {
+	XMLName xml.Name `xml:"STMTTRN"`
+	Type    string   `xml:"TRNTYPE"`
+	Posted  string   `xml:"DTPOSTED"`
+	Amount  int      `xml:"TRNAMT"`
+	Id      string   `xml:"FITID"`
+	Name    string   `xml:"NAME"`
+	Memo    string   `xml:"MEMO,omitempty"`
+}
+
+func (o *ofxLedgerWriter) start() error {
+	o.w.Header().Set("Content-Type", "application/x-ofx")
+	o.w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v.ofx"`, o.name))
+	o.w.WriteHeader(http.StatusOK)
+
+	o.xml = xml.NewEncoder(o.w)
+	now := time.Now().UTC().Format(ofxTimeFormat)
+	_, err := fmt.Fprintf(o.w, `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS><DTSERVER>%v</DTSERVER><LANGUAGE>ENG</LANGUAGE></SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1><STMTTRNRS><TRNUID>0</TRNUID><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>
+<STMTRS><CURDEF>%v</CURDEF>
+<BANKACCTFROM><BANKID>fund</BANKID><ACCTID>%v</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>
+<BANKTRANLIST><DTSTART>%v</DTSTART><DTEND>%v</DTEND>
+`, now, ofxCurrency, ofxEscape(o.username), o.oldest.UTC().Format(ofxTimeFormat), o.newest.UTC().Format(ofxTimeFormat))
+	return err
+}
+
+func (o *ofxLedgerWriter) Started() bool {
+	return o.xml != nil
+}
+
+func (o *ofxLedgerWriter) Write(entry ledgerEntry) error {
+	if !o.Started() {
+		if err := o.start(); err != nil {
+			return err
+		}
+	}
+
+	t := ofxTransaction{
+		Type:   "CREDIT",
+		Posted: entry.Time.UTC().Format(ofxTimeFormat),
+		Amount: entry.Amount,
+		Id:     entry.Id,
+		Name:   "Deposit",
+	}
+	if entry.Debit {
+		t.Type = "DEBIT"
+		t.Amount = -entry.Amount
+		t.Name = truncate(entry.Url, ofxNameLength)
+		if domain := utils.Domain(entry.Url); domain != "" {
+			t.Name = truncate(domain, ofxNameLength)
+		}
+		t.Memo = truncate(entry.Url, ofxMemoLength)
+	}
+	if err := o.xml.Encode(t); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(o.w)
+	return err
+}
+
+func (o *ofxLedgerWriter) Close() error {
+	if !o.Started() {
+		if err := o.start(); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(o.w, `</BANKTRANLIST>
+<LEDGERBAL><BALAMT>%v</BALAMT><DTASOF>%v</DTASOF></LEDGERBAL>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`, o.balance, time.Now().UTC().Format(ofxTimeFormat))
+	return err
+}
+
+func ofxEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Cuts s down to at most length bytes, without splitting a character
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	for length > 0 && !utf8.RuneStart(s[length]) {
+		length--
+	}
+	return s[:length]
+}
+
+// Sets the default order of a streamed listing to oldest first, as budgeting
+// tools expect, unless another was asked for
+func ledgerOrder(sort, order string) string {
+	if sort == "" && order == "" {
+		return models.OrderAsc
+	}
+	return order
+}
@@ -0,0 +1,398 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/mailer"
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+	"github.com/crowdpower/fund/webhook"
+)
+
+const (
+	notificationPageSize = 20
+	notificationMaxCount = 100
+)
+
+type NotificationController interface {
+	GetNotifications(w http.ResponseWriter, r *http.Request)
+	PostNotificationsRead(w http.ResponseWriter, r *http.Request)
+	PutNotificationRead(w http.ResponseWriter, r *http.Request)
+	DeleteNotification(w http.ResponseWriter, r *http.Request)
+	GetNotificationPreferences(w http.ResponseWriter, r *http.Request)
+	PutNotificationPreferences(w http.ResponseWriter, r *http.Request)
+	GetNotificationWebhook(w http.ResponseWriter, r *http.Request)
+	PutNotificationWebhook(w http.ResponseWriter, r *http.Request)
+	DeleteNotificationWebhook(w http.ResponseWriter, r *http.Request)
+}
+
+type notificationController struct {
+	db      storage.DB
+	bus     *events.Bus
+	mailer  mailer.Mailer
+	webhook webhook.Sender
+}
+
+// Turns events published to bus into notifications, delivered through each
+// user's preferred channels
+func NewNotificationController(db storage.DB, bus *events.Bus, mailer mailer.Mailer, webhook webhook.Sender) NotificationController {
+	n := &notificationController{db, bus, mailer, webhook}
+	bus.Handle(n.handle)
+	return n
+}
+
+// Lists the user's inbox, newest first. Pass the created time of the last
+// notification of a page as newest to get the next, which repeats that one
+func (n *notificationController) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var args models.NotificationArgs
+	err := utils.ParseArgs(r, &args)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if args.Count <= 0 {
+		args.Count = notificationPageSize
+	} else if args.Count > notificationMaxCount {
+		args.Count = notificationMaxCount
+	}
+
+	notifications, err := n.db.GetNotifications(username, &args)
+	if storage.IsBadQuery(err) {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("could not get notifications of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting notifications", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, notifications, http.StatusOK)
+}
+
+// Marks every notification in the user's inbox read
+func (n *notificationController) PostNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	err := n.db.ReadNotifications(username, time.Now().UTC())
+	if err != nil {
+		log.Printf("could not mark notifications of user %v read\n%v", username, err)
+		utils.SendError(w, "Error marking notifications read", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+func (n *notificationController) PutNotificationRead(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["id"]
+
+	err := n.db.ReadNotification(username, id, time.Now().UTC())
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Notification %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not mark notification %v of user %v read\n%v", id, username, err)
+		utils.SendError(w, "Error marking notification read", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+func (n *notificationController) DeleteNotification(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["id"]
+
+	err := n.db.DeleteNotification(username, id)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Notification %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not delete notification %v of user %v\n%v", id, username, err)
+		utils.SendError(w, "Error deleting notification", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Returns where every kind of notification goes, including kinds the user
+// has left at their defaults
+func (n *notificationController) GetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	preferences, err := n.preferences(username)
+	if err != nil {
+		log.Printf("could not get notification preferences of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	list := []models.NotificationPreference{}
+	for _, p := range preferences {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Kind < list[j].Kind })
+
+	utils.SendSuccess(w, list, http.StatusOK)
+}
+
+// Sets where the kinds of notification given go. Kinds left out keep their
+// current preferences
+func (n *notificationController) PutNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var preferences []models.NotificationPreference
+	err := json.NewDecoder(r.Body).Decode(&preferences)
+	if err != nil {
+		log.Printf("could not unmarshal PutNotificationPreferences request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	for i := range preferences {
+		if _, ok := models.NotificationDefaults[preferences[i].Kind]; !ok {
+			utils.SendError(w, fmt.Sprintf("Unknown notification kind '%v'", preferences[i].Kind), http.StatusBadRequest)
+			return
+		}
+		preferences[i].Username = username
+	}
+
+	err = n.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		for i := range preferences {
+			if err := tx.SetNotificationPreference(&preferences[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("could not set notification preferences of user %v\n%v", username, err)
+		utils.SendError(w, "Error setting notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	n.GetNotificationPreferences(w, r)
+}
+
+func (n *notificationController) GetNotificationWebhook(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	hook, err := n.db.GetNotificationWebhook(username)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, "No notification webhook set", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get notification webhook of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting notification webhook", http.StatusInternalServerError)
+		return
+	}
+	hook.Secret = ""
+
+	utils.SendSuccess(w, hook, http.StatusOK)
+}
+
+// Sets the https url notifications sent by webhook are POSTed to, with a new
+// secret to check their signatures with. The secret is only returned here
+func (n *notificationController) PutNotificationWebhook(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var hook models.NotificationWebhook
+	err := json.NewDecoder(r.Body).Decode(&hook)
+	if err != nil {
+		log.Printf("could not unmarshal PutNotificationWebhook request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(hook.Url)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.User != nil {
+		utils.SendError(w, "Url must be an absolute https url", http.StatusBadRequest)
+		return
+	}
+	// names are checked when the webhook is sent, as what they resolve to
+	// can change
+	if ip := net.ParseIP(u.Hostname()); u.Hostname() == "localhost" || (ip != nil && !webhook.PublicIp(ip)) {
+		utils.SendError(w, "Url must be of a public host", http.StatusBadRequest)
+		return
+	}
+
+	hook.Username = username
+	hook.Created = time.Now().UTC()
+	hook.Secret, err = newOAuthSecret()
+	if err != nil {
+		log.Printf("could not generate notification webhook secret\n%v", err)
+		utils.SendError(w, "Error generating secret", http.StatusInternalServerError)
+		return
+	}
+
+	err = n.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.SetNotificationWebhook(&hook); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditNotificationWebhookSet, username, nil, nil))
+	})
+	if err != nil {
+		log.Printf("could not set notification webhook of user %v\n%v", username, err)
+		utils.SendError(w, "Error setting notification webhook", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, hook, http.StatusOK)
+}
+
+func (n *notificationController) DeleteNotificationWebhook(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	err := n.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.DeleteNotificationWebhook(username); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditNotificationWebhookDelete, username, nil, nil))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, "No notification webhook set", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not delete notification webhook of user %v\n%v", username, err)
+		utils.SendError(w, "Error deleting notification webhook", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Returns the user's preference for every kind of notification
+func (n *notificationController) preferences(username string) (map[string]models.NotificationPreference, error) {
+	set, err := n.db.GetNotificationPreferences(username)
+	if err != nil {
+		return nil, err
+	}
+
+	preferences := map[string]models.NotificationPreference{}
+	for kind, p := range models.NotificationDefaults {
+		preferences[kind] = p
+	}
+	for _, p := range set {
+		if _, ok := preferences[p.Kind]; ok {
+			preferences[p.Kind] = p
+		}
+	}
+	return preferences, nil
+}
+
+// Writes the notification for events users are notified of, and delivers it
+// away from the publisher, which may be holding up a request
+func (n *notificationController) handle(e events.Event) {
+	notification := models.Notification{
+		Id:       uuid.NewV4().String(),
+		Username: e.Username,
+		Created:  e.Time,
+	}
+
+	switch data := e.Data.(type) {
+	case *models.Deposit:
+		notification.Kind = models.NotificationDeposit
+		notification.Title = "Deposit to your Fund account"
+		notification.Body = fmt.Sprintf("%v credits have been added to your Fund account %v.", data.Amount, e.Username)
+	case events.PaymentFailed:
+		notification.Kind = models.NotificationPaymentFailed
+		notification.Title = "A payment from your Fund account was refused"
+		notification.Body = fmt.Sprintf("A payment of %v from your Fund account %v to %v was refused: %v.",
+			data.Amount, e.Username, data.Url, data.Reason)
+	case events.Login:
+		notification.Kind = models.NotificationLogin
+		notification.Title = "New login to your Fund account"
+		notification.Body = fmt.Sprintf("Your Fund account %v was logged in to at %v from %v, using %v. If this "+
+			"wasn't you, change your password and log out of your other sessions.", e.Username,
+			e.Time.Format("2 January 2006 15:04 MST"), data.Ip, data.UserAgent)
+	default:
+		return
+	}
+
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		log.Printf("could not marshal %v event for user %v\n%v", e.Type, e.Username, err)
+		return
+	}
+	notification.Data = data
+
+	go n.deliver(&notification)
+}
+
+// Sends a notification through each channel the user wants its kind sent to
+func (n *notificationController) deliver(notification *models.Notification) {
+	username := notification.Username
+
+	preferences, err := n.preferences(username)
+	if err != nil {
+		log.Printf("could not get notification preferences of user %v\n%v", username, err)
+		return
+	}
+	preference := preferences[notification.Kind]
+
+	if preference.Inbox {
+		if err := n.db.CreateNotification(notification); err != nil {
+			log.Printf("could not store notification %v for user %v\n%v", notification.Id, username, err)
+		} else {
+			n.bus.Publish(events.Event{
+				Type:     events.TypeNotification,
+				Username: username,
+				Time:     notification.Created,
+				Data:     notification,
+			})
+		}
+	}
+
+	if preference.Email {
+		user, err := n.db.GetUser(username)
+		if err != nil {
+			log.Printf("could not get user %v from the database\n%v", username, err)
+		} else if user.Email != "" && user.EmailVerified {
+			err := n.mailer.Send(mailer.Message{
+				To:      user.Email,
+				Subject: notification.Title,
+				Body:    notification.Body,
+			})
+			if err != nil {
+				log.Printf("could not email notification %v to user %v\n%v", notification.Id, username, err)
+			}
+		}
+	}
+
+	if preference.Webhook {
+		hook, err := n.db.GetNotificationWebhook(username)
+		if storage.IsNotFound(err) {
+			return
+		} else if err != nil {
+			log.Printf("could not get notification webhook of user %v\n%v", username, err)
+			return
+		}
+
+		body, err := json.Marshal(notification)
+		if err != nil {
+			log.Printf("could not marshal notification %v\n%v", notification.Id, err)
+			return
+		}
+		err = n.webhook.Send(webhook.Message{Url: hook.Url, Secret: hook.Secret, Body: body})
+		if err != nil {
+			log.Printf("could not send notification %v to webhook of user %v\n%v", notification.Id, username, err)
+		}
+	}
+}
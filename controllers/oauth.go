@@ -0,0 +1,498 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+const (
+	oauthCodeExpiryTime = time.Minute * 5
+	oauthSecretBytes    = 32
+
+	oauthGrantAuthorizationCode = "authorization_code"
+	oauthGrantRefreshToken      = "refresh_token"
+)
+
+// The token endpoint answers in the format of RFC 6749 rather than the
+// usual response envelope, so standard OAuth libraries can use it
+type oauthTokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+type oauthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Registers a third-party app, owned by the user. The secret of a
+// confidential client is only ever sent in this response
+func (a *authController) PostOAuthClient(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var client models.OAuthClient
+	err := json.NewDecoder(r.Body).Decode(&client)
+	if err != nil {
+		log.Printf("could not unmarshal PostOAuthClient request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	client.Name = strings.TrimSpace(client.Name)
+	if client.Name == "" {
+		utils.SendError(w, "Client name required", http.StatusBadRequest)
+		return
+	}
+	if len(client.RedirectUris) == 0 {
+		utils.SendError(w, "At least one redirect uri required", http.StatusBadRequest)
+		return
+	}
+	for _, uri := range client.RedirectUris {
+		if err := checkRedirectUri(uri); err != nil {
+			utils.SendError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	client.Id = uuid.NewV4().String()
+	client.Username = username
+	client.Created = time.Now().UTC()
+	client.Secret = ""
+	client.SecretHash = ""
+	if client.Confidential {
+		client.Secret, err = newOAuthSecret()
+		if err != nil {
+			log.Printf("could not generate oauth client secret\n%v", err)
+			utils.SendError(w, "Error generating client secret", http.StatusInternalServerError)
+			return
+		}
+		client.SecretHash = hashOAuthSecret(client.Secret)
+	}
+
+	err = a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.CreateOAuthClient(&client); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditOAuthClientCreate, username, nil,
+			map[string]string{"client": client.Id, "name": client.Name}))
+	})
+	if err != nil {
+		log.Printf("could not create oauth client for user %v\n%v", username, err)
+		utils.SendError(w, "Error creating client", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, client, http.StatusCreated)
+}
+
+func (a *authController) GetOAuthClients(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	clients, err := a.db.GetOAuthClients(username)
+	if err != nil {
+		log.Printf("could not get oauth clients of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting clients", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, clients, http.StatusOK)
+}
+
+// Deletes a client and revokes every session granted to it
+func (a *authController) DeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["id"]
+
+	err := a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.DeleteOAuthClient(username, id); err != nil {
+			return err
+		}
+		if err := tx.RevokeOAuthClientSessions(id); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditOAuthClientDelete, username, map[string]string{"client": id}, nil))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Client %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not delete oauth client %v of user %v\n%v", id, username, err)
+		utils.SendError(w, "Error deleting client", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Checks an authorization request and describes it for the consent screen.
+// Takes the query string the app sent the user to the consent screen with
+func (a *authController) GetOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	var args models.OAuthAuthorizeArgs
+	err := utils.ParseArgs(r, &args)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, scopes, ok := a.authorizationClient(w, &args)
+	if !ok {
+		return
+	}
+
+	consent := models.OAuthConsent{
+		ClientId:    client.Id,
+		ClientName:  client.Name,
+		RedirectUri: args.RedirectUri,
+		State:       args.State,
+	}
+	for _, scope := range scopes {
+		consent.Scopes = append(consent.Scopes, models.OAuthScope{Name: scope, Description: models.ScopeDescriptions[scope]})
+	}
+
+	utils.SendSuccess(w, consent, http.StatusOK)
+}
+
+// Records the user's answer to an authorization request. Responds with the
+// uri to send the user back to the app with, carrying an authorization code
+// if they approved
+func (a *authController) PostOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var args models.OAuthAuthorizeArgs
+	err := json.NewDecoder(r.Body).Decode(&args)
+	if err != nil {
+		log.Printf("could not unmarshal PostOAuthAuthorize request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	client, scopes, ok := a.authorizationClient(w, &args)
+	if !ok {
+		return
+	}
+
+	params := url.Values{}
+	if args.State != "" {
+		params.Set("state", args.State)
+	}
+
+	if !args.Approve {
+		params.Set("error", "access_denied")
+		utils.SendSuccess(w, map[string]string{"redirectUri": withQuery(args.RedirectUri, params)}, http.StatusOK)
+		return
+	}
+
+	code, err := newOAuthSecret()
+	if err != nil {
+		log.Printf("could not generate oauth code\n%v", err)
+		utils.SendError(w, "Error generating authorization code", http.StatusInternalServerError)
+		return
+	}
+
+	err = a.db.CreateOAuthCode(&models.OAuthCode{
+		Code:          hashOAuthSecret(code),
+		ClientId:      client.Id,
+		Username:      username,
+		RedirectUri:   args.RedirectUri,
+		Scope:         strings.Join(scopes, " "),
+		CodeChallenge: args.CodeChallenge,
+		Expires:       time.Now().UTC().Add(oauthCodeExpiryTime),
+	})
+	if err != nil {
+		log.Printf("could not store oauth code for user %v\n%v", username, err)
+		utils.SendError(w, "Error generating authorization code", http.StatusInternalServerError)
+		return
+	}
+
+	params.Set("code", code)
+	utils.SendSuccess(w, map[string]string{"redirectUri": withQuery(args.RedirectUri, params)}, http.StatusOK)
+}
+
+// The OAuth token endpoint. Exchanges an authorization code, or a refresh
+// token, for a refresh token and an access token limited to the granted scope
+func (a *authController) PostOAuthToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		sendOAuthError(w, "invalid_request", "Could not parse body as a form", http.StatusBadRequest)
+		return
+	}
+
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientId = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+
+	client, err := a.db.GetOAuthClient(clientId)
+	if storage.IsNotFound(err) {
+		sendOAuthError(w, "invalid_client", "Unknown client", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Printf("could not get oauth client %v from the database\n%v", clientId, err)
+		sendOAuthError(w, "server_error", "Error getting client", http.StatusInternalServerError)
+		return
+	}
+
+	if client.Confidential &&
+		subtle.ConstantTimeCompare([]byte(hashOAuthSecret(clientSecret)), []byte(client.SecretHash)) != 1 {
+		sendOAuthError(w, "invalid_client", "Client secret incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	var session *models.Session
+	var t tokens
+	switch r.PostForm.Get("grant_type") {
+	case oauthGrantAuthorizationCode:
+		session, t, ok = a.exchangeOAuthCode(w, r, client)
+	case oauthGrantRefreshToken:
+		session, t, ok = a.refreshOAuthTokens(w, r, client)
+	default:
+		sendOAuthError(w, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token", http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(oauthTokens{
+		AccessToken:  t.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessExpiryTime.Seconds()),
+		RefreshToken: t.RefreshToken,
+		Scope:        session.Scope,
+	})
+}
+
+func (a *authController) exchangeOAuthCode(w http.ResponseWriter, r *http.Request, client *models.OAuthClient) (*models.Session, tokens, bool) {
+	now := time.Now().UTC()
+	code, err := a.db.TakeOAuthCode(hashOAuthSecret(r.PostForm.Get("code")), now)
+	if storage.IsNotFound(err) {
+		sendOAuthError(w, "invalid_grant", "Authorization code is invalid, expired or already used", http.StatusBadRequest)
+		return nil, tokens{}, false
+	} else if err != nil {
+		log.Printf("could not get oauth code from the database\n%v", err)
+		sendOAuthError(w, "server_error", "Error checking authorization code", http.StatusInternalServerError)
+		return nil, tokens{}, false
+	}
+
+	if code.ClientId != client.Id || code.RedirectUri != r.PostForm.Get("redirect_uri") {
+		sendOAuthError(w, "invalid_grant", "Authorization code was issued to another client or redirect uri", http.StatusBadRequest)
+		return nil, tokens{}, false
+	}
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(challenge[:])), []byte(code.CodeChallenge)) != 1 {
+		sendOAuthError(w, "invalid_grant", "code_verifier does not match code_challenge", http.StatusBadRequest)
+		return nil, tokens{}, false
+	}
+
+	session := &models.Session{
+		Id:        uuid.NewV4().String(),
+		Username:  code.Username,
+		RefreshId: uuid.NewV4().String(),
+		Device:    client.Name,
+		UserAgent: r.UserAgent(),
+		Ip:        utils.ClientIp(r),
+		ClientId:  client.Id,
+		Scope:     code.Scope,
+		Created:   now,
+		LastUsed:  now,
+	}
+
+	audit := newAuditEntry(r, auditSessionCreate, code.Username, nil,
+		map[string]string{"session": session.Id, "device": session.Device, "clientId": client.Id, "scope": session.Scope})
+	audit.Actor = code.Username
+	err = a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.CreateSession(session); err != nil {
+			return err
+		}
+		return tx.AppendAudit(audit)
+	})
+	if err != nil {
+		log.Printf("could not create session for user %v and oauth client %v\n%v", code.Username, client.Id, err)
+		sendOAuthError(w, "server_error", "Error creating session", http.StatusInternalServerError)
+		return nil, tokens{}, false
+	}
+
+	t, err := a.sessionTokens(session)
+	if err != nil {
+		log.Printf("could not generate tokens\n%v", err)
+		sendOAuthError(w, "server_error", "Error generating token", http.StatusInternalServerError)
+		return nil, tokens{}, false
+	}
+
+	return session, t, true
+}
+
+func (a *authController) refreshOAuthTokens(w http.ResponseWriter, r *http.Request, client *models.OAuthClient) (*models.Session, tokens, bool) {
+	claims, err := parseToken(a.keys, r.PostForm.Get("refresh_token"), RefreshTokenType)
+	if err != nil || claims.ClientId != client.Id {
+		sendOAuthError(w, "invalid_grant", "Invalid refresh token", http.StatusBadRequest)
+		return nil, tokens{}, false
+	}
+
+	session, err := a.db.GetSession(claims.Username, claims.SessionId)
+	if storage.IsNotFound(err) || (err == nil && session.Revoked) {
+		sendOAuthError(w, "invalid_grant", "Refresh token has been revoked", http.StatusBadRequest)
+		return nil, tokens{}, false
+	} else if err != nil {
+		log.Printf("could not get session %v from the database\n%v", claims.SessionId, err)
+		sendOAuthError(w, "server_error", "Error checking token", http.StatusInternalServerError)
+		return nil, tokens{}, false
+	}
+
+	t, err := a.rotateTokens(r, claims)
+	if storage.IsNotFound(err) {
+		sendOAuthError(w, "invalid_grant", "Refresh token has already been used, session revoked", http.StatusBadRequest)
+		return nil, tokens{}, false
+	} else if err != nil {
+		log.Printf("could not generate tokens\n%v", err)
+		sendOAuthError(w, "server_error", "Error generating token", http.StatusInternalServerError)
+		return nil, tokens{}, false
+	}
+
+	return session, t, true
+}
+
+// Looks up the client of an authorization request and checks the request
+// against it, returning the requested scopes. Sends an error and returns
+// false if the request is invalid
+func (a *authController) authorizationClient(w http.ResponseWriter, args *models.OAuthAuthorizeArgs) (*models.OAuthClient, []string, bool) {
+	client, err := a.db.GetOAuthClient(args.ClientId)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Client %v not found", args.ClientId), http.StatusBadRequest)
+		return nil, nil, false
+	} else if err != nil {
+		log.Printf("could not get oauth client %v from the database\n%v", args.ClientId, err)
+		utils.SendError(w, "Error getting client", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	registered := false
+	for _, uri := range client.RedirectUris {
+		registered = registered || uri == args.RedirectUri
+	}
+	if !registered {
+		utils.SendError(w, "redirect_uri is not registered for this client", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if args.ResponseType != "code" {
+		utils.SendError(w, "response_type must be code", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	// PKCE is required of every client, confidential ones included
+	if args.CodeChallengeMethod != "S256" {
+		utils.SendError(w, "code_challenge_method must be S256", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if _, err := base64.RawURLEncoding.DecodeString(args.CodeChallenge); err != nil || len(args.CodeChallenge) != 43 {
+		utils.SendError(w, "code_challenge must be a base64url encoded SHA-256 hash", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	scopes, err := parseScope(args.Scope, models.ScopeDescriptions)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	return client, scopes, true
+}
+
+// Splits a space separated scope into scopes from known, sorted and without
+// repeats
+func parseScope(scope string, known map[string]string) ([]string, error) {
+	seen := map[string]bool{}
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		if _, ok := known[s]; !ok {
+			return nil, fmt.Errorf("Unknown scope '%v'", s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("scope required")
+	}
+
+	sort.Strings(scopes)
+	return scopes, nil
+}
+
+// Redirect uris must be absolute, and only use plain http for loopback
+// addresses. Custom schemes are allowed for browser extensions and apps
+func checkRedirectUri(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("Redirect uri '%v' must be an absolute uri", uri)
+	}
+	if u.Fragment != "" {
+		return fmt.Errorf("Redirect uri '%v' must not have a fragment", uri)
+	}
+	if u.Scheme == "http" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1" && u.Hostname() != "::1" {
+		return fmt.Errorf("Redirect uri '%v' must use https", uri)
+	}
+	return nil
+}
+
+// Adds params to the query string of a redirect uri, keeping any it has
+func withQuery(uri string, params url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func newOAuthSecret() (string, error) {
+	b := make([]byte, oauthSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Codes and client secrets are random, so a fast hash is enough
+func hashOAuthSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func sendOAuthError(w http.ResponseWriter, code, description string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(oauthError{Error: code, Description: description})
+}
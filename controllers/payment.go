@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/satori/go.uuid"
 
+	"github.com/crowdpower/fund/events"
 	"github.com/crowdpower/fund/models"
 	"github.com/crowdpower/fund/storage"
 	"github.com/crowdpower/fund/utils"
@@ -19,19 +21,24 @@ const (
 	paymentPageSize = 20
 )
 
+var errDomainNotDelegated = errors.New("domain not delegated")
+
 type PaymentController interface {
 	PostPayment(w http.ResponseWriter, r *http.Request)
 	GetPayment(w http.ResponseWriter, r *http.Request)
 	GetPayments(w http.ResponseWriter, r *http.Request)
 	GetPaymentsSum(w http.ResponseWriter, r *http.Request)
+	GetPaymentsAggregate(w http.ResponseWriter, r *http.Request)
 }
 
 type paymentController struct {
-	db storage.DB
+	db  storage.DB
+	bus *events.Bus
 }
 
-func NewPaymentController(db storage.DB) PaymentController {
-	return &paymentController{db}
+// Refused payments are published to bus, so the user can be told
+func NewPaymentController(db storage.DB, bus *events.Bus) PaymentController {
+	return &paymentController{db, bus}
 }
 
 func (d *paymentController) PostPayment(w http.ResponseWriter, r *http.Request) {
@@ -55,14 +62,51 @@ func (d *paymentController) PostPayment(w http.ResponseWriter, r *http.Request)
 
 	payment.Username = mux.Vars(r)["username"]
 	payment.Id = uuid.NewV4().String()
-	payment.Time = time.Now().Format(storage.TimeFormat)
+	payment.Time = time.Now().UTC()
+
+	// payments made with a delegated token must go to one of its domains, and
+	// are counted against its spend cap
+	claims := requestClaims(r)
+	err = d.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		delegation, err := tx.GetDelegation(payment.Username, claims.SessionId)
+		if err == nil {
+			if !delegation.AllowsDomain(utils.Domain(payment.Url)) {
+				return errDomainNotDelegated
+			}
+			if err := tx.AddDelegationSpend(delegation.Id, payment.Amount); err != nil {
+				return err
+			}
+		} else if !storage.IsNotFound(err) {
+			return err
+		}
 
-	err = d.db.CreatePayment(&payment)
+		if err := tx.CreatePayment(&payment); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditPaymentCreate, payment.Username, nil,
+			map[string]interface{}{"payment": payment.Id, "amount": payment.Amount}))
+	})
 	if err != nil {
 		if storage.IsInsufficientFunds(err) {
+			d.paymentFailed(&payment, "Insufficient funds")
 			utils.SendError(w, "Insufficient funds", http.StatusBadRequest)
 			return
 		}
+		if storage.IsAccountFrozen(err) {
+			d.paymentFailed(&payment, "Account is frozen")
+			utils.SendError(w, "Account is frozen", http.StatusForbidden)
+			return
+		}
+		if err == errDomainNotDelegated {
+			d.paymentFailed(&payment, "Token cannot make payments to this domain")
+			utils.SendError(w, "Token cannot make payments to this domain", http.StatusForbidden)
+			return
+		}
+		if storage.IsSpendCapExceeded(err) {
+			d.paymentFailed(&payment, "Payment would exceed the token's spend cap")
+			utils.SendError(w, "Payment would exceed the token's spend cap", http.StatusForbidden)
+			return
+		}
 		log.Printf("could not insert payment %v into database\n%v", payment, err)
 		utils.SendError(w, "Error inserting payment into database", http.StatusInternalServerError)
 		return
@@ -71,6 +115,15 @@ func (d *paymentController) PostPayment(w http.ResponseWriter, r *http.Request)
 	utils.SendSuccess(w, nil, http.StatusNoContent)
 }
 
+func (d *paymentController) paymentFailed(payment *models.Payment, reason string) {
+	d.bus.Publish(events.Event{
+		Type:     events.TypePaymentFailed,
+		Username: payment.Username,
+		Time:     payment.Time,
+		Data:     events.PaymentFailed{Url: payment.Url, Amount: payment.Amount, Reason: reason},
+	})
+}
+
 func (d *paymentController) GetPayment(w http.ResponseWriter, r *http.Request) {
 	username := mux.Vars(r)["username"]
 
@@ -103,18 +156,66 @@ func (d *paymentController) GetPayments(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	format, err := ledgerFormat(r)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format != ledgerFormatJson {
+		d.streamPayments(w, username, args, format)
+		return
+	}
+
 	if args.Count == 0 {
 		args.Count = paymentPageSize
 	}
 
 	payments, err := d.db.GetPayments(username, args)
-	if err != nil {
+	if storage.IsBadQuery(err) {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		log.Printf("could not get payments for user %v from the database\n%v", username, err)
 		utils.SendError(w, "Error getting payments from database", http.StatusInternalServerError)
 		return
 	}
 
-	utils.SendPage(w, r, payments, args.Offset+paymentPageSize, paymentPageSize, len(payments) == args.Count)
+	var next utils.Cursor
+	if len(payments) == args.Count {
+		last := payments[len(payments)-1]
+		next = last.Cursor(args)
+	}
+
+	utils.SendPage(w, r, payments, next)
+}
+
+// Streams every payment matching the request as CSV or OFX, rather than a
+// page of them
+func (d *paymentController) streamPayments(w http.ResponseWriter, username string, args *models.PaymentArgs, format string) {
+	args.Order = ledgerOrder(args.Sort, args.Order)
+
+	user, err := d.db.GetUser(username)
+	if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		return
+	}
+
+	ledger := newLedgerWriter(w, format, "payments", username, user.Balance, args.Oldest, args.Newest)
+	err = d.db.EachPayment(username, args, func(p *models.Payment) error {
+		return ledger.Write(ledgerEntry{Id: p.Id, Time: p.Time, Amount: p.Amount, Debit: true, Url: p.Url})
+	})
+	if err == nil {
+		err = ledger.Close()
+	}
+	if err != nil && ledger.Started() {
+		log.Printf("could not stream payments for user %v\n%v", username, err)
+	} else if storage.IsBadQuery(err) {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+	} else if err != nil {
+		log.Printf("could not get payments for user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting payments from database", http.StatusInternalServerError)
+	}
 }
 
 func (d *paymentController) GetPaymentsSum(w http.ResponseWriter, r *http.Request) {
@@ -128,7 +229,10 @@ func (d *paymentController) GetPaymentsSum(w http.ResponseWriter, r *http.Reques
 	}
 
 	sum, err := d.db.GetPaymentsSum(username, args)
-	if err != nil {
+	if storage.IsBadQuery(err) {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
 		log.Printf("could not get payments sum for user %v from the database\n%v", username, err)
 		utils.SendError(w, "Error getting payments sum from database", http.StatusInternalServerError)
 		return
@@ -136,3 +240,32 @@ func (d *paymentController) GetPaymentsSum(w http.ResponseWriter, r *http.Reques
 
 	utils.SendSuccess(w, map[string]int{"sum": sum}, http.StatusOK)
 }
+
+func (d *paymentController) GetPaymentsAggregate(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		utils.SendError(w, "Parameter 'group' required", http.StatusBadRequest)
+		return
+	}
+
+	args := &models.PaymentArgs{}
+	err := utils.ParseArgs(r, args)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	aggregates, err := d.db.GetPaymentsAggregate(username, group, args)
+	if storage.IsBadQuery(err) {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("could not aggregate payments for user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error aggregating payments from database", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, aggregates, http.StatusOK)
+}
@@ -0,0 +1,515 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+const (
+	apiKeyPrefix      = "fund"
+	apiKeyPrefixBytes = 4
+	apiKeySecretBytes = 32
+
+	// how long a rotated key keeps working
+	apiKeyRotationGraceTime = time.Minute * 60 * 24
+
+	siteVerificationRecord = "fund-site-verification="
+)
+
+type SiteController interface {
+	PostSite(w http.ResponseWriter, r *http.Request)
+	GetSites(w http.ResponseWriter, r *http.Request)
+	DeleteSite(w http.ResponseWriter, r *http.Request)
+	PostSiteVerification(w http.ResponseWriter, r *http.Request)
+	PostApiKey(w http.ResponseWriter, r *http.Request)
+	GetApiKeys(w http.ResponseWriter, r *http.Request)
+	PostApiKeyRotation(w http.ResponseWriter, r *http.Request)
+	DeleteApiKey(w http.ResponseWriter, r *http.Request)
+	GetSite(w http.ResponseWriter, r *http.Request)
+	GetEntitlement(w http.ResponseWriter, r *http.Request)
+	Wrapper(scope string, h handler) handler
+}
+
+type siteController struct {
+	db         storage.DB
+	supporters SupporterController
+}
+
+// supporters has the cached supporter lists of deleted sites dropped
+func NewSiteController(db storage.DB, supporters SupporterController) SiteController {
+	return &siteController{db, supporters}
+}
+
+// Registers a site owned by the user. It must be verified before its keys
+// can check entitlements
+func (s *siteController) PostSite(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var site models.Site
+	err := json.NewDecoder(r.Body).Decode(&site)
+	if err != nil {
+		log.Printf("could not unmarshal PostSite request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	site.Name = strings.TrimSpace(site.Name)
+	if site.Name == "" {
+		utils.SendError(w, "Site name required", http.StatusBadRequest)
+		return
+	}
+
+	domain := utils.Domain(site.Domain)
+	if domain == "" || !strings.Contains(domain, ".") {
+		utils.SendError(w, fmt.Sprintf("Domain '%v' is not valid", site.Domain), http.StatusBadRequest)
+		return
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		log.Printf("could not generate site verification token\n%v", err)
+		utils.SendError(w, "Error generating verification token", http.StatusInternalServerError)
+		return
+	}
+
+	site.Id = uuid.NewV4().String()
+	site.Username = username
+	site.Domain = domain
+	site.VerificationToken = hex.EncodeToString(token)
+	site.Verified = false
+	site.Created = time.Now().UTC()
+
+	err = s.db.CreateSite(&site)
+	if err != nil {
+		log.Printf("could not create site for user %v\n%v", username, err)
+		utils.SendError(w, "Error creating site", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, site, http.StatusCreated)
+}
+
+func (s *siteController) GetSites(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	sites, err := s.db.GetSites(username)
+	if err != nil {
+		log.Printf("could not get sites of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting sites", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, sites, http.StatusOK)
+}
+
+// Deletes a site along with its keys, taking it off its supporters' lists
+func (s *siteController) DeleteSite(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["site"]
+
+	err := s.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.DeleteSite(username, id); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditSiteDelete, username, map[string]string{"site": id}, nil))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Site %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not delete site %v of user %v\n%v", id, username, err)
+		utils.SendError(w, "Error deleting site", http.StatusInternalServerError)
+		return
+	}
+	s.supporters.ForgetSupporters(id)
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Verifies the owner controls the site's domain, by looking for a TXT record
+// on it of fund-site-verification=<verificationToken>
+func (s *siteController) PostSiteVerification(w http.ResponseWriter, r *http.Request) {
+	site, ok := s.ownedSite(w, r)
+	if !ok {
+		return
+	}
+
+	if site.Verified {
+		utils.SendSuccess(w, nil, http.StatusNoContent)
+		return
+	}
+
+	records, err := net.LookupTXT(site.Domain)
+	if err != nil {
+		log.Printf("could not look up TXT records of %v\n%v", site.Domain, err)
+	}
+
+	found := false
+	for _, record := range records {
+		found = found || record == siteVerificationRecord+site.VerificationToken
+	}
+	if !found {
+		utils.SendError(w, fmt.Sprintf("No TXT record of '%v%v' found on %v", siteVerificationRecord,
+			site.VerificationToken, site.Domain), http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.VerifySite(site.Id)
+	if err != nil {
+		log.Printf("could not verify site %v\n%v", site.Id, err)
+		utils.SendError(w, "Error verifying site", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Creates a key for the site with the name and scope in the body. The key is
+// only ever sent in this response
+func (s *siteController) PostApiKey(w http.ResponseWriter, r *http.Request) {
+	site, ok := s.ownedSite(w, r)
+	if !ok {
+		return
+	}
+
+	var key models.ApiKey
+	err := json.NewDecoder(r.Body).Decode(&key)
+	if err != nil {
+		log.Printf("could not unmarshal PostApiKey request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	key.Name = strings.TrimSpace(key.Name)
+	if key.Name == "" {
+		utils.SendError(w, "Key name required", http.StatusBadRequest)
+		return
+	}
+
+	scopes, err := parseScope(key.Scope, models.SiteScopeDescriptions)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	created, err := newApiKey(site.Id, key.Name, strings.Join(scopes, " "))
+	if err != nil {
+		log.Printf("could not generate api key\n%v", err)
+		utils.SendError(w, "Error generating key", http.StatusInternalServerError)
+		return
+	}
+
+	err = s.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.CreateApiKey(created); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditApiKeyCreate, site.Username, nil,
+			map[string]string{"site": site.Id, "key": created.Id, "scope": created.Scope}))
+	})
+	if err != nil {
+		log.Printf("could not create api key for site %v\n%v", site.Id, err)
+		utils.SendError(w, "Error creating key", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, created, http.StatusCreated)
+}
+
+func (s *siteController) GetApiKeys(w http.ResponseWriter, r *http.Request) {
+	site, ok := s.ownedSite(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := s.db.GetApiKeys(site.Id)
+	if err != nil {
+		log.Printf("could not get api keys of site %v\n%v", site.Id, err)
+		utils.SendError(w, "Error getting keys", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, keys, http.StatusOK)
+}
+
+// Replaces a key with a new one with the same name and scope. The old key
+// keeps working for a day, so the site can switch over without downtime
+func (s *siteController) PostApiKeyRotation(w http.ResponseWriter, r *http.Request) {
+	site, ok := s.ownedSite(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	old, err := s.db.GetApiKey(site.Id, id)
+	if storage.IsNotFound(err) || (err == nil && old.Revoked) {
+		utils.SendError(w, fmt.Sprintf("Key %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get api key %v of site %v\n%v", id, site.Id, err)
+		utils.SendError(w, "Error getting key", http.StatusInternalServerError)
+		return
+	}
+
+	if old.Expires != nil {
+		utils.SendError(w, "Key has already been rotated", http.StatusConflict)
+		return
+	}
+
+	created, err := newApiKey(site.Id, old.Name, old.Scope)
+	if err != nil {
+		log.Printf("could not generate api key\n%v", err)
+		utils.SendError(w, "Error generating key", http.StatusInternalServerError)
+		return
+	}
+
+	err = s.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.ExpireApiKey(site.Id, old.Id, created.Created.Add(apiKeyRotationGraceTime)); err != nil {
+			return err
+		}
+		if err := tx.CreateApiKey(created); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditApiKeyRotate, site.Username,
+			map[string]string{"site": site.Id, "key": old.Id},
+			map[string]string{"site": site.Id, "key": created.Id}))
+	})
+	if err != nil {
+		log.Printf("could not rotate api key %v of site %v\n%v", id, site.Id, err)
+		utils.SendError(w, "Error rotating key", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, created, http.StatusCreated)
+}
+
+func (s *siteController) DeleteApiKey(w http.ResponseWriter, r *http.Request) {
+	site, ok := s.ownedSite(w, r)
+	if !ok {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	err := s.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.RevokeApiKey(site.Id, id); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditApiKeyRevoke, site.Username, nil,
+			map[string]string{"site": site.Id, "key": id}))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Key %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not revoke api key %v of site %v\n%v", id, site.Id, err)
+		utils.SendError(w, "Error revoking key", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Returns the site a key belongs to, so sites can check their key works
+func (s *siteController) GetSite(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["site"]
+
+	site, err := s.db.GetSite(id)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Site %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get site %v from the database\n%v", id, err)
+		utils.SendError(w, "Error getting site", http.StatusInternalServerError)
+		return
+	}
+
+	site.VerificationToken = ""
+	utils.SendSuccess(w, site, http.StatusOK)
+}
+
+// Returns how much a user has paid to pages on the site's domain, or to one
+// url if given, so the site can decide whether to unlock content for them
+func (s *siteController) GetEntitlement(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["site"]
+
+	var args models.EntitlementArgs
+	err := utils.ParseArgs(r, &args)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if args.Username == "" {
+		utils.SendError(w, "Username required", http.StatusBadRequest)
+		return
+	}
+
+	site, err := s.db.GetSite(id)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Site %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get site %v from the database\n%v", id, err)
+		utils.SendError(w, "Error getting site", http.StatusInternalServerError)
+		return
+	}
+
+	if !site.Verified {
+		utils.SendError(w, "Site must verify its domain before checking entitlements", http.StatusForbidden)
+		return
+	}
+
+	paymentArgs := models.PaymentArgs{Oldest: args.Since, Url: &site.Domain, UrlMatch: models.UrlMatchContains}
+	entitlement := models.Entitlement{Username: args.Username, Domain: site.Domain}
+	if args.Url != nil {
+		if !utils.InDomain(utils.Domain(*args.Url), site.Domain) {
+			utils.SendError(w, fmt.Sprintf("Url is not on %v", site.Domain), http.StatusBadRequest)
+			return
+		}
+		paymentArgs.Url = args.Url
+		paymentArgs.UrlMatch = models.UrlMatchExact
+		entitlement.Url = *args.Url
+	}
+
+	byUrl, err := s.db.GetPaymentsAggregate(args.Username, models.GroupUrl, &paymentArgs)
+	if err != nil {
+		log.Printf("could not get payments of user %v to site %v\n%v", args.Username, site.Id, err)
+		utils.SendError(w, "Error getting payments", http.StatusInternalServerError)
+		return
+	}
+
+	// a url containing the domain may still point elsewhere
+	for _, a := range byUrl {
+		if utils.InDomain(utils.Domain(a.Key), site.Domain) {
+			entitlement.Paid += a.Sum
+			entitlement.Payments += a.Count
+		}
+	}
+	entitlement.Entitled = entitlement.Paid > 0
+
+	utils.SendSuccess(w, entitlement, http.StatusOK)
+}
+
+// Checks the request has a valid API key for the site in its path, with scope,
+// before passing it on to h. Sites send their key as a bearer token
+func (s *siteController) Wrapper(scope string, h handler) handler {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if key == "" {
+			utils.SendError(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+
+		parts := strings.SplitN(key, "_", 3)
+		if len(parts) != 3 || parts[0] != apiKeyPrefix {
+			utils.SendError(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		apiKey, err := s.db.GetApiKeyByPrefix(parts[1])
+		if storage.IsNotFound(err) {
+			utils.SendError(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Printf("could not get api key %v from the database\n%v", parts[1], err)
+			utils.SendError(w, "Error checking API key", http.StatusInternalServerError)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(hashApiKey(key)), []byte(apiKey.Hash)) != 1 {
+			utils.SendError(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		now := time.Now().UTC()
+		if apiKey.Revoked || (apiKey.Expires != nil && !now.Before(*apiKey.Expires)) {
+			utils.SendError(w, "API key has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		if apiKey.SiteId != mux.Vars(r)["site"] {
+			utils.SendError(w, "API key belongs to another site", http.StatusForbidden)
+			return
+		}
+
+		allowed := false
+		for _, granted := range strings.Fields(apiKey.Scope) {
+			allowed = allowed || granted == scope
+		}
+		if !allowed {
+			utils.SendError(w, fmt.Sprintf("API key does not have the '%v' scope", scope), http.StatusForbidden)
+			return
+		}
+
+		err = s.db.UpdateApiKeyUse(apiKey.Id, now)
+		if err != nil {
+			log.Printf("could not record use of api key %v\n%v", apiKey.Id, err)
+		}
+
+		h(w, r)
+	}
+}
+
+// Returns the site in the request path if it belongs to the user, otherwise
+// sends an error and returns false
+func (s *siteController) ownedSite(w http.ResponseWriter, r *http.Request) (*models.Site, bool) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["site"]
+
+	site, err := s.db.GetSite(id)
+	if storage.IsNotFound(err) || (err == nil && site.Username != username) {
+		utils.SendError(w, fmt.Sprintf("Site %v not found", id), http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		log.Printf("could not get site %v from the database\n%v", id, err)
+		utils.SendError(w, "Error getting site", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return site, true
+}
+
+func newApiKey(siteId, name, scope string) (*models.ApiKey, error) {
+	prefix := make([]byte, apiKeyPrefixBytes)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, apiKeySecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	key := &models.ApiKey{
+		Id:      uuid.NewV4().String(),
+		SiteId:  siteId,
+		Name:    name,
+		Prefix:  hex.EncodeToString(prefix),
+		Scope:   scope,
+		Created: time.Now().UTC(),
+	}
+	key.Key = fmt.Sprintf("%v_%v_%v", apiKeyPrefix, key.Prefix, base64.RawURLEncoding.EncodeToString(secret))
+	key.Hash = hashApiKey(key.Key)
+	return key, nil
+}
+
+// Keys are random, so a fast hash is enough
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
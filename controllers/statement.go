@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"formatDate": func(t time.Time) string { return t.Format("2 January 2006") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Fund statement for {{.Username}}, {{.Start.Format "January 2006"}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.25em 0.5em; border-bottom: 1px solid #ddd; }
+td.amount, th.amount { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Statement for {{.Username}}</h1>
+<p>{{.Start.Format "2 January 2006"}} to {{.End.AddDate 0 0 -1 | formatDate}}{{if not .Closed}}, so far{{end}}</p>
+<table>
+<tr><td>Opening balance</td><td class="amount">{{.OpeningBalance}}</td></tr>
+<tr><td>Deposits ({{.DepositCount}})</td><td class="amount">{{.Deposits}}</td></tr>
+<tr><td>Payments ({{.PaymentCount}})</td><td class="amount">{{if .Payments}}-{{end}}{{.Payments}}</td></tr>
+<tr><td>Adjustments ({{len .Adjustments}})</td><td class="amount">{{.AdjustmentsTotal}}</td></tr>
+<tr><th>Closing balance</th><th class="amount">{{.ClosingBalance}}</th></tr>
+</table>
+{{if .PaymentsBySite}}
+<h2>Payments by site</h2>
+<table>
+<tr><th>Site</th><th class="amount">Payments</th><th class="amount">Total</th></tr>
+{{range .PaymentsBySite}}<tr><td>{{.Key}}</td><td class="amount">{{.Count}}</td><td class="amount">{{.Sum}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Adjustments}}
+<h2>Adjustments</h2>
+<table>
+<tr><th>Date</th><th>Reason</th><th class="amount">Amount</th></tr>
+{{range .Adjustments}}<tr><td>{{formatDate .Time}}</td><td>{{.Reason}}</td><td class="amount">{{.Amount}}</td></tr>
+{{end}}</table>
+{{end}}
+<p>Generated {{.Generated.Format "2 January 2006 15:04 MST"}}</p>
+</body>
+</html>
+`))
+
+type StatementController interface {
+	GetStatement(w http.ResponseWriter, r *http.Request)
+}
+
+type statementController struct {
+	db storage.DB
+}
+
+func NewStatementController(db storage.DB) StatementController {
+	return &statementController{db}
+}
+
+// Returns the statement for a month, as JSON or, if the format parameter or
+// Accept header asks for it, as an HTML page. The statement of the current
+// month covers it so far
+func (s *statementController) GetStatement(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	month := mux.Vars(r)["month"]
+
+	start, err := time.Parse(models.StatementMonthFormat, month)
+	if err != nil {
+		utils.SendError(w, "Month must be formatted as yyyy-mm", http.StatusBadRequest)
+		return
+	}
+
+	html, err := statementHtml(r)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// times are stored as nanoseconds since 1970, and far enough before that
+	// they overflow, so a statement for such a month would come out wrong,
+	// and be stored wrong for good
+	if start.Before(time.Unix(0, 0)) {
+		utils.SendError(w, "Month can't be before 1970", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	if start.After(now) {
+		utils.SendError(w, fmt.Sprintf("Month %v hasn't started yet", month), http.StatusBadRequest)
+		return
+	}
+
+	statement, err := s.db.GetStatement(username, month)
+	if storage.IsNotFound(err) {
+		err = s.db.WithTx(r.Context(), func(tx storage.Tx) error {
+			statement, err = generateStatement(tx, username, start, now)
+			return err
+		})
+		if err == nil && statement.Closed {
+			if err := s.db.CreateStatement(statement); err != nil {
+				log.Printf("could not store statement %v of user %v\n%v", month, username, err)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("could not get statement %v of user %v\n%v", month, username, err)
+		utils.SendError(w, "Error getting statement", http.StatusInternalServerError)
+		return
+	}
+
+	if !html {
+		utils.SendSuccess(w, statement, http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := statementTemplate.Execute(w, statement); err != nil {
+		log.Printf("could not render statement %v of user %v\n%v", month, username, err)
+	}
+}
+
+// Whether a statement should be sent as HTML rather than JSON, asked for by
+// the format parameter or else the first of the two in the Accept header
+func statementHtml(r *http.Request) (bool, error) {
+	switch r.URL.Query().Get("format") {
+	case "html":
+		return true, nil
+	case "json":
+		return false, nil
+	case "":
+	default:
+		return false, fmt.Errorf("Format must be 'json' or 'html'")
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/html":
+			return true, nil
+		case "application/json":
+			return false, nil
+		}
+	}
+	return false, nil
+}
+
+// Works out the statement of the month starting at start from the ledger.
+// Should be called on a transaction, so every figure is read from the same
+// state
+func generateStatement(tx storage.Tx, username string, start, now time.Time) (*models.Statement, error) {
+	end := start.AddDate(0, 1, 0)
+	statement := &models.Statement{
+		Username:       username,
+		Month:          start.Format(models.StatementMonthFormat),
+		Start:          start,
+		End:            end,
+		PaymentsBySite: []models.PaymentAggregate{},
+		Adjustments:    []models.Adjustment{},
+		Closed:         !now.Before(end),
+		Generated:      now,
+	}
+
+	// listings filter on inclusive bounds
+	beforeStart := start.Add(-time.Nanosecond)
+	lastOfMonth := end.Add(-time.Nanosecond)
+
+	depositedBefore, err := tx.GetDepositsSum(username, &models.DepositArgs{Newest: beforeStart})
+	if err != nil {
+		return nil, err
+	}
+	paidBefore, err := tx.GetPaymentsSum(username, &models.PaymentArgs{Newest: beforeStart})
+	if err != nil {
+		return nil, err
+	}
+	statement.OpeningBalance = depositedBefore - paidBefore
+
+	adjustments, err := tx.GetAdjustments(username)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range adjustments {
+		if a.Time.Before(start) {
+			statement.OpeningBalance += a.Amount
+		} else if a.Time.Before(end) {
+			statement.Adjustments = append(statement.Adjustments, a)
+			statement.AdjustmentsTotal += a.Amount
+		}
+	}
+	sort.Slice(statement.Adjustments, func(i, j int) bool {
+		return statement.Adjustments[i].Time.Before(statement.Adjustments[j].Time)
+	})
+
+	err = tx.EachDeposit(username, &models.DepositArgs{Oldest: start, Newest: lastOfMonth}, func(d *models.Deposit) error {
+		statement.Deposits += d.Amount
+		statement.DepositCount++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	statement.PaymentsBySite, err = tx.GetPaymentsAggregate(username, models.GroupDomain,
+		&models.PaymentArgs{Oldest: start, Newest: lastOfMonth})
+	if err != nil {
+		return nil, err
+	}
+	for _, site := range statement.PaymentsBySite {
+		statement.Payments += site.Sum
+		statement.PaymentCount += site.Count
+	}
+
+	statement.ClosingBalance = statement.OpeningBalance + statement.Deposits - statement.Payments +
+		statement.AdjustmentsTotal
+	return statement, nil
+}
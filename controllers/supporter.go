@@ -0,0 +1,464 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+const (
+	displayNameMaxLength = 64
+	bioMaxLength         = 280
+	// the most supporters a site's supporter list shows
+	supporterListMaxSize = 1000
+	// how long a site's supporters over a window are reused before being
+	// worked out again, as anyone can ask for them
+	supporterCacheTime = time.Minute
+)
+
+var errDisplayNameTaken = errors.New("display name taken")
+
+// How supporter lists and leaderboards are computed. Windows maps the names
+// clients choose a window by to its length in days, 0 meaning all time.
+// Leaderboards show the top Size supporters
+type LeaderboardConfig struct {
+	Windows       map[string]int `mapstructure:"windows"`
+	DefaultWindow string         `mapstructure:"defaultWindow"`
+	Size          int            `mapstructure:"size"`
+}
+
+type SupporterController interface {
+	GetPublicProfile(w http.ResponseWriter, r *http.Request)
+	PutPublicProfile(w http.ResponseWriter, r *http.Request)
+	DeletePublicProfile(w http.ResponseWriter, r *http.Request)
+	GetSupporterSites(w http.ResponseWriter, r *http.Request)
+	PutSupporterSite(w http.ResponseWriter, r *http.Request)
+	DeleteSupporterSite(w http.ResponseWriter, r *http.Request)
+	GetSupporterProfile(w http.ResponseWriter, r *http.Request)
+	GetSupporters(w http.ResponseWriter, r *http.Request)
+	GetLeaderboard(w http.ResponseWriter, r *http.Request)
+	ForgetSupporters(site string)
+}
+
+type supporterController struct {
+	db     storage.DB
+	config LeaderboardConfig
+
+	mu    sync.Mutex
+	cache map[supporterCacheKey]*cachedSupporters
+}
+
+type supporterCacheKey struct {
+	site   string
+	window string
+}
+
+type cachedSupporters struct {
+	list    *models.SupporterList
+	expires time.Time
+}
+
+func NewSupporterController(db storage.DB, config LeaderboardConfig) SupporterController {
+	return &supporterController{db: db, config: config, cache: map[supporterCacheKey]*cachedSupporters{}}
+}
+
+// Returns the user's own public profile, NotFound if they haven't opted in
+func (s *supporterController) GetPublicProfile(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	profile, err := s.db.GetPublicProfile(username)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, "No public profile", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get public profile of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting public profile", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, profile, http.StatusOK)
+}
+
+// Sets how the user appears on the supporter lists and leaderboards of the
+// sites they choose. Amounts stay hidden unless showAmounts is set
+func (s *supporterController) PutPublicProfile(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var profile models.PublicProfile
+	err := json.NewDecoder(r.Body).Decode(&profile)
+	if err != nil {
+		log.Printf("could not unmarshal PutPublicProfile request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	profile.DisplayName = strings.TrimSpace(profile.DisplayName)
+	profile.Bio = strings.TrimSpace(profile.Bio)
+	if profile.DisplayName == "" || utf8.RuneCountInString(profile.DisplayName) > displayNameMaxLength {
+		utils.SendError(w, fmt.Sprintf("Display name must be 1 to %v characters", displayNameMaxLength), http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(profile.Bio) > bioMaxLength {
+		utils.SendError(w, fmt.Sprintf("Bio must be at most %v characters", bioMaxLength), http.StatusBadRequest)
+		return
+	}
+	// a display name matching a username would give the username away, or
+	// let the user pass themselves off as someone else
+	if strings.EqualFold(profile.DisplayName, username) {
+		utils.SendError(w, "Display name can't be your username", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.db.GetUser(profile.DisplayName); err == nil {
+		utils.SendError(w, "Display name can't be a username", http.StatusBadRequest)
+		return
+	} else if !storage.IsNotFound(err) {
+		log.Printf("could not check display name against usernames\n%v", err)
+		utils.SendError(w, "Error setting public profile", http.StatusInternalServerError)
+		return
+	}
+
+	profile.Username = username
+	err = s.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		taken, err := tx.DisplayNameTaken(profile.DisplayName, username)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return errDisplayNameTaken
+		}
+
+		existing, err := tx.GetPublicProfile(username)
+		if err == nil {
+			profile.Id = existing.Id
+			profile.Created = existing.Created
+		} else if storage.IsNotFound(err) {
+			profile.Id = uuid.NewV4().String()
+			profile.Created = time.Now().UTC()
+		} else {
+			return err
+		}
+
+		if err := tx.SetPublicProfile(&profile); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditPublicProfileSet, username, nil,
+			map[string]bool{"showAmounts": profile.ShowAmounts}))
+	})
+	if err == errDisplayNameTaken {
+		utils.SendError(w, "Display name is already taken", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("could not set public profile of user %v\n%v", username, err)
+		utils.SendError(w, "Error setting public profile", http.StatusInternalServerError)
+		return
+	}
+	s.ForgetSupporters("")
+
+	utils.SendSuccess(w, profile, http.StatusOK)
+}
+
+// Opts the user out, taking them off the supporter lists and leaderboards of
+// every site they chose
+func (s *supporterController) DeletePublicProfile(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	err := s.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.DeletePublicProfile(username); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditPublicProfileDelete, username, nil, nil))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, "No public profile", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not delete public profile of user %v\n%v", username, err)
+		utils.SendError(w, "Error deleting public profile", http.StatusInternalServerError)
+		return
+	}
+	s.ForgetSupporters("")
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Lists the sites the user has chosen to appear on the lists of, with their
+// id on each
+func (s *supporterController) GetSupporterSites(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	sites, err := s.db.GetSupporterSites(username)
+	if err != nil {
+		log.Printf("could not get supporter sites of user %v\n%v", username, err)
+		utils.SendError(w, "Error getting supporter sites", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, sites, http.StatusOK)
+}
+
+// Puts the user on the supporter list and leaderboard of a site, under an id
+// of their own for that site. Needs a public profile
+func (s *supporterController) PutSupporterSite(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["site"]
+
+	site, err := s.db.GetSite(id)
+	if storage.IsNotFound(err) || (err == nil && !site.Verified) {
+		utils.SendError(w, fmt.Sprintf("Site %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get site %v from the database\n%v", id, err)
+		utils.SendError(w, "Error getting site", http.StatusInternalServerError)
+		return
+	}
+
+	var supporterSite *models.SupporterSite
+	err = s.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if _, err := tx.GetPublicProfile(username); err != nil {
+			return err
+		}
+
+		existing, err := tx.GetSupporterSite(username, site.Id)
+		if err == nil {
+			supporterSite = existing
+			return nil
+		} else if !storage.IsNotFound(err) {
+			return err
+		}
+
+		supporterSite = &models.SupporterSite{
+			Id:       uuid.NewV4().String(),
+			Username: username,
+			SiteId:   site.Id,
+			Created:  time.Now().UTC(),
+		}
+		if err := tx.CreateSupporterSite(supporterSite); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditSupporterSiteAdd, username, nil, map[string]string{"site": site.Id}))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, "No public profile", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not add supporter site %v of user %v\n%v", site.Id, username, err)
+		utils.SendError(w, "Error adding supporter site", http.StatusInternalServerError)
+		return
+	}
+	s.ForgetSupporters(site.Id)
+
+	utils.SendSuccess(w, supporterSite, http.StatusOK)
+}
+
+// Takes the user off a site's supporter list and leaderboard
+func (s *supporterController) DeleteSupporterSite(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["site"]
+
+	err := s.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.DeleteSupporterSite(username, id); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditSupporterSiteRemove, username, map[string]string{"site": id}, nil))
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Not on the lists of site %v", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not delete supporter site %v of user %v\n%v", id, username, err)
+		utils.SendError(w, "Error deleting supporter site", http.StatusInternalServerError)
+		return
+	}
+	s.ForgetSupporters(id)
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Returns the public profile of one of a site's supporters to anyone, by
+// their id on the site's lists
+func (s *supporterController) GetSupporterProfile(w http.ResponseWriter, r *http.Request) {
+	site := mux.Vars(r)["site"]
+	id := mux.Vars(r)["id"]
+
+	profile, err := s.db.GetSupporterProfile(site, id)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Supporter %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get supporter %v of site %v\n%v", id, site, err)
+		utils.SendError(w, "Error getting profile", http.StatusInternalServerError)
+		return
+	}
+	// the profile's own id and created time would link the supporter across
+	// sites, and whether amounts are shown is the user's business
+	profile.Id = id
+	profile.ShowAmounts = false
+
+	utils.SendSuccess(w, profile, http.StatusOK)
+}
+
+// Lists the supporters of a site over a window, by display name, without
+// amounts
+func (s *supporterController) GetSupporters(w http.ResponseWriter, r *http.Request) {
+	list, ok := s.supporterList(w, r)
+	if !ok {
+		return
+	}
+
+	sort.SliceStable(list.Supporters, func(i, j int) bool {
+		return strings.ToLower(list.Supporters[i].DisplayName) < strings.ToLower(list.Supporters[j].DisplayName)
+	})
+	if len(list.Supporters) > supporterListMaxSize {
+		list.Supporters = list.Supporters[:supporterListMaxSize]
+	}
+	for i := range list.Supporters {
+		list.Supporters[i].Total = 0
+	}
+
+	utils.SendSuccess(w, list, http.StatusOK)
+}
+
+// Ranks the top supporters of a site over a window by how much they paid.
+// Totals are only shown for supporters who chose to show amounts
+func (s *supporterController) GetLeaderboard(w http.ResponseWriter, r *http.Request) {
+	list, ok := s.supporterList(w, r)
+	if !ok {
+		return
+	}
+
+	if len(list.Supporters) > s.config.Size {
+		list.Supporters = list.Supporters[:s.config.Size]
+	}
+	for i := range list.Supporters {
+		// supporters with equal totals share a rank
+		list.Supporters[i].Rank = i + 1
+		if i > 0 && list.Supporters[i].Total == list.Supporters[i-1].Total {
+			list.Supporters[i].Rank = list.Supporters[i-1].Rank
+		}
+	}
+	for i := range list.Supporters {
+		if !list.Supporters[i].ShowAmounts {
+			list.Supporters[i].Total = 0
+		}
+	}
+
+	utils.SendSuccess(w, list, http.StatusOK)
+}
+
+// Gets the supporters of the site in the path over the window in the query,
+// largest total first. Sends the error response if it can't
+func (s *supporterController) supporterList(w http.ResponseWriter, r *http.Request) (*models.SupporterList, bool) {
+	id := mux.Vars(r)["site"]
+
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = s.config.DefaultWindow
+	}
+	days, ok := s.config.Windows[window]
+	if !ok {
+		names := []string{}
+		for name := range s.config.Windows {
+			names = append(names, "'"+name+"'")
+		}
+		sort.Strings(names)
+		utils.SendError(w, fmt.Sprintf("Window must be one of %v", strings.Join(names, ", ")), http.StatusBadRequest)
+		return nil, false
+	}
+
+	key := supporterCacheKey{id, window}
+	if list, ok := s.cachedSupporters(key); ok {
+		return list, true
+	}
+
+	site, err := s.db.GetSite(id)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Site %v not found", id), http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		log.Printf("could not get site %v from the database\n%v", id, err)
+		utils.SendError(w, "Error getting site", http.StatusInternalServerError)
+		return nil, false
+	}
+	// anyone can register a site for any domain, only its verified owner can
+	// show who supports it
+	if !site.Verified {
+		utils.SendError(w, fmt.Sprintf("Site %v not found", id), http.StatusNotFound)
+		return nil, false
+	}
+
+	list := &models.SupporterList{Site: site.Name, Domain: site.Domain, Window: window}
+	var since time.Time
+	if days > 0 {
+		since = time.Now().UTC().AddDate(0, 0, -days)
+		list.Since = &since
+	}
+
+	list.Supporters, err = s.db.GetSupporters(site.Id, site.Domain, since)
+	if err != nil {
+		log.Printf("could not get supporters of site %v\n%v", site.Id, err)
+		utils.SendError(w, "Error getting supporters", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	s.cacheSupporters(key, list)
+	return list, true
+}
+
+// Returns a copy of the cached list, if it hasn't expired
+func (s *supporterController) cachedSupporters(key supporterCacheKey) (*models.SupporterList, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cached, ok := s.cache[key]
+	if !ok || time.Now().After(cached.expires) {
+		return nil, false
+	}
+	return copySupporterList(cached.list), true
+}
+
+// Keeps a copy of the list, and drops lists that have expired
+func (s *supporterController) cacheSupporters(key supporterCacheKey, list *models.SupporterList) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, cached := range s.cache {
+		if now.After(cached.expires) {
+			delete(s.cache, k)
+		}
+	}
+	s.cache[key] = &cachedSupporters{copySupporterList(list), now.Add(supporterCacheTime)}
+}
+
+// Drops the cached lists of a site, or of every site if site is empty, once
+// who appears on them has changed
+func (s *supporterController) ForgetSupporters(site string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k := range s.cache {
+		if site == "" || k.site == site {
+			delete(s.cache, k)
+		}
+	}
+}
+
+func copySupporterList(list *models.SupporterList) *models.SupporterList {
+	c := *list
+	c.Supporters = append([]models.Supporter{}, list.Supporters...)
+	return &c
+}
@@ -0,0 +1,215 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/crowdpower/fund/mailer"
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+const (
+	loginThrottleUser = "user"
+	loginThrottleIp   = "ip"
+
+	// failures older than this are forgotten
+	loginFailureWindow = time.Hour * 24
+)
+
+type throttlePolicy struct {
+	// failures allowed before attempts are slowed down
+	freeAttempts int
+	// wait after the first failure past freeAttempts, doubling with each
+	// further failure up to backoffMax
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	// failures that lock the subject out for lockoutTime, 0 never locks
+	lockoutAttempts int
+	lockoutTime     time.Duration
+}
+
+var (
+	// a username is locked after a handful of failures, but an address is only
+	// slowed down, since many users can share one
+	userThrottlePolicy = throttlePolicy{
+		freeAttempts:    3,
+		backoffBase:     time.Second,
+		backoffMax:      time.Minute * 15,
+		lockoutAttempts: 10,
+		lockoutTime:     time.Hour,
+	}
+	ipThrottlePolicy = throttlePolicy{
+		freeAttempts: 20,
+		backoffBase:  time.Second,
+		backoffMax:   time.Minute * 15,
+	}
+)
+
+// Compared against when the user doesn't exist, so a login for a missing user
+// takes as long as one with the wrong password
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Returns how long the subject of t must wait before trying again
+func (p throttlePolicy) retryAfter(t *models.LoginThrottle, now time.Time) time.Duration {
+	if now.Before(t.LockedUntil) {
+		return t.LockedUntil.Sub(now)
+	}
+	if now.Sub(t.LastFailure) > loginFailureWindow || t.Failures < p.freeAttempts {
+		return 0
+	}
+
+	wait := p.backoffBase
+	for i := p.freeAttempts; i < t.Failures && wait < p.backoffMax; i++ {
+		wait *= 2
+	}
+	if wait > p.backoffMax {
+		wait = p.backoffMax
+	}
+
+	if retry := t.LastFailure.Add(wait).Sub(now); retry > 0 {
+		return retry
+	}
+	return 0
+}
+
+// Returns how long a login for username from ip must wait, 0 if it may go ahead
+func loginRetryAfter(db storage.Tx, username, ip string, now time.Time) (time.Duration, error) {
+	user, err := db.GetLoginThrottle(loginThrottleUser, username)
+	if err != nil {
+		return 0, err
+	}
+	address, err := db.GetLoginThrottle(loginThrottleIp, ip)
+	if err != nil {
+		return 0, err
+	}
+
+	retry := userThrottlePolicy.retryAfter(user, now)
+	if r := ipThrottlePolicy.retryAfter(address, now); r > retry {
+		retry = r
+	}
+	return retry, nil
+}
+
+// Counts a failed login against username and ip. Returns true if the failure
+// locked the username
+func recordLoginFailure(tx storage.Tx, username, ip string, now time.Time) (bool, error) {
+	locked := false
+	for _, s := range []struct {
+		kind    string
+		subject string
+		policy  throttlePolicy
+	}{
+		{loginThrottleUser, username, userThrottlePolicy},
+		{loginThrottleIp, ip, ipThrottlePolicy},
+	} {
+		t, err := tx.GetLoginThrottle(s.kind, s.subject)
+		if err != nil {
+			return false, err
+		}
+
+		if now.Sub(t.LastFailure) > loginFailureWindow {
+			t.Failures = 0
+		}
+		t.Failures++
+		t.LastFailure = now
+
+		// start counting again once the lockout ends
+		if s.policy.lockoutAttempts > 0 && t.Failures >= s.policy.lockoutAttempts {
+			t.Failures = 0
+			t.LockedUntil = now.Add(s.policy.lockoutTime)
+			locked = true
+		}
+
+		if err := tx.SetLoginThrottle(t); err != nil {
+			return false, err
+		}
+	}
+	return locked, nil
+}
+
+// Checks a password attempt for username from ip may go ahead and, in the
+// same transaction, counts it as failed until loginSucceeded takes that back,
+// so concurrent attempts can't all get through before any is counted. Returns
+// how long the attempt must wait instead, 0 if it went ahead, and whether
+// counting it locked the username
+func beginLoginAttempt(ctx context.Context, db storage.DB, username, ip string, now time.Time) (time.Duration, bool, error) {
+	var retry time.Duration
+	locked := false
+	err := db.WithTx(ctx, func(tx storage.Tx) error {
+		var err error
+		retry, err = loginRetryAfter(tx, username, ip, now)
+		if err != nil || retry > 0 {
+			return err
+		}
+		locked, err = recordLoginFailure(tx, username, ip, now)
+		return err
+	})
+	return retry, locked, err
+}
+
+// Takes back the failure beginLoginAttempt counted: the username's failures
+// are forgotten, and the one counted against ip undone
+func loginSucceeded(ctx context.Context, db storage.DB, username, ip string) error {
+	return db.WithTx(ctx, func(tx storage.Tx) error {
+		if err := tx.DeleteLoginThrottle(loginThrottleUser, username); err != nil {
+			return err
+		}
+		t, err := tx.GetLoginThrottle(loginThrottleIp, ip)
+		if err != nil || t.Failures == 0 {
+			return err
+		}
+		t.Failures--
+		return tx.SetLoginThrottle(t)
+	})
+}
+
+// Responds to a failed password check with message. If counting the attempt
+// locked the account, the lock is audited and the account's owner told
+func loginFailed(w http.ResponseWriter, r *http.Request, db storage.DB, m mailer.Mailer, username string,
+	user *models.User, locked bool, now time.Time, message string) {
+	if locked && user != nil {
+		err := db.AppendAudit(newAuditEntry(r, auditUserLock, username, nil,
+			map[string]string{"until": now.Add(userThrottlePolicy.lockoutTime).Format(time.RFC3339)}))
+		if err != nil {
+			log.Printf("could not record lockout of user %v in the audit log\n%v", username, err)
+		}
+		notifyLockout(m, user)
+	}
+
+	utils.SendError(w, message, http.StatusUnauthorized)
+}
+
+// Refuses a password check that came too soon after failed ones
+func sendRetryAfter(w http.ResponseWriter, retry time.Duration) {
+	seconds := int(math.Ceil(retry.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	utils.SendError(w, fmt.Sprintf("Too many failed login attempts, try again in %v seconds", seconds),
+		http.StatusTooManyRequests)
+}
+
+// Tells a user their account has been locked, if they have a verified email
+func notifyLockout(m mailer.Mailer, user *models.User) {
+	if user.Email == "" || !user.EmailVerified {
+		return
+	}
+
+	err := m.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Fund account has been locked",
+		Body: fmt.Sprintf("There have been %v failed attempts to log in to your Fund account %v, so logging in "+
+			"with a password has been disabled for %v. If these weren't you, consider changing your password "+
+			"once the lock ends.", userThrottlePolicy.lockoutAttempts, user.Username, userThrottlePolicy.lockoutTime),
+	})
+	if err != nil {
+		log.Printf("could not send lockout email to user %v\n%v", user.Username, err)
+	}
+}
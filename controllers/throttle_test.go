@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleBacksOff(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC()
+
+	for i := 0; i < userThrottlePolicy.freeAttempts; i++ {
+		retry, _, err := beginLoginAttempt(context.Background(), db, "alice", "1.2.3.4", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retry != 0 {
+			t.Fatalf("attempt %v told to wait %v, want it let through", i+1, retry)
+		}
+	}
+
+	retry, _, err := beginLoginAttempt(context.Background(), db, "alice", "1.2.3.4", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry != userThrottlePolicy.backoffBase {
+		t.Fatalf("attempt past the free ones told to wait %v, want %v", retry, userThrottlePolicy.backoffBase)
+	}
+
+	// a refused attempt isn't counted, so waiting it out is enough
+	retry, _, err = beginLoginAttempt(context.Background(), db, "alice", "1.2.3.4", now.Add(retry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry != 0 {
+		t.Fatalf("attempt after waiting told to wait %v, want it let through", retry)
+	}
+}
+
+func TestLoginThrottleLocksOut(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC()
+
+	// from a different address each time, so only the username is locked
+	for i := 1; i <= userThrottlePolicy.lockoutAttempts; i++ {
+		retry, locked, err := beginLoginAttempt(context.Background(), db, "alice", fmt.Sprintf("1.2.3.%v", i), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retry != 0 {
+			t.Fatalf("attempt %v told to wait %v, want it let through after waiting", i, retry)
+		}
+		if locked != (i == userThrottlePolicy.lockoutAttempts) {
+			t.Fatalf("attempt %v locked the user %v, want %v", i, locked, !locked)
+		}
+		now = now.Add(userThrottlePolicy.backoffMax)
+	}
+
+	retry, _, err := beginLoginAttempt(context.Background(), db, "alice", "5.6.7.8", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := userThrottlePolicy.lockoutTime - userThrottlePolicy.backoffMax; retry != want {
+		t.Fatalf("attempt on a locked user told to wait %v, want %v", retry, want)
+	}
+}
+
+func TestLoginSucceededForgetsFailures(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC()
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := beginLoginAttempt(context.Background(), db, "alice", "1.2.3.4", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loginSucceeded(context.Background(), db, "alice", "1.2.3.4"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := db.GetLoginThrottle(loginThrottleUser, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Failures != 0 {
+		t.Fatalf("user failures after a successful login %v, want 0", user.Failures)
+	}
+	// only the attempt that succeeded is taken back from the address, which
+	// other users may share
+	address, err := db.GetLoginThrottle(loginThrottleIp, "1.2.3.4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address.Failures != 2 {
+		t.Fatalf("address failures after a successful login %v, want 2", address.Failures)
+	}
+}
+
+func TestLoginThrottleConcurrentAttempts(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC()
+
+	// attempts racing each other must still be counted one at a time, so no
+	// more than the free ones get through
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	through := 0
+	for i := 0; i < userThrottlePolicy.freeAttempts*2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			retry, _, err := beginLoginAttempt(context.Background(), db, "alice", "1.2.3.4", now)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if retry == 0 {
+				mu.Lock()
+				through++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if through != userThrottlePolicy.freeAttempts {
+		t.Fatalf("%v concurrent attempts let through, want %v", through, userThrottlePolicy.freeAttempts)
+	}
+}
@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+const (
+	totpIssuer        = "Fund"
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 5
+)
+
+type TwoFactorController interface {
+	PostTwoFactor(w http.ResponseWriter, r *http.Request)
+	PostTwoFactorConfirm(w http.ResponseWriter, r *http.Request)
+	DeleteTwoFactor(w http.ResponseWriter, r *http.Request)
+}
+
+type twoFactorController struct {
+	db storage.DB
+}
+
+func NewTwoFactorController(db storage.DB) TwoFactorController {
+	return &twoFactorController{db}
+}
+
+// Starts enrolment by generating a new secret. Logins are unaffected until the
+// user confirms they have set up their app with PostTwoFactorConfirm
+func (t *twoFactorController) PostTwoFactor(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	existing, err := t.db.GetTwoFactor(username)
+	if err != nil && !storage.IsNotFound(err) {
+		log.Printf("could not get two-factor secret for user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting two-factor secret from database", http.StatusInternalServerError)
+		return
+	}
+	if err == nil && existing.Enabled {
+		utils.SendError(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := utils.NewTotpSecret()
+	if err != nil {
+		log.Printf("could not generate two-factor secret\n%v", err)
+		utils.SendError(w, "Error generating two-factor secret", http.StatusInternalServerError)
+		return
+	}
+
+	err = t.db.SetTwoFactorSecret(username, secret)
+	if err != nil {
+		log.Printf("could not store two-factor secret for user %v\n%v", username, err)
+		utils.SendError(w, "Error storing two-factor secret", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, models.TwoFactorEnrolment{
+		Secret:          secret,
+		ProvisioningUri: utils.TotpProvisioningUri(totpIssuer, username, secret),
+	}, http.StatusOK)
+}
+
+// Enables two-factor authentication once the user proves their app generates
+// valid codes, and returns their recovery codes. They are only shown once
+func (t *twoFactorController) PostTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var body models.TwoFactorCode
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		log.Printf("could not unmarshal PostTwoFactorConfirm request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	twoFactor, err := t.db.GetTwoFactor(username)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, "Two-factor enrolment has not been started", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get two-factor secret for user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting two-factor secret from database", http.StatusInternalServerError)
+		return
+	}
+	if twoFactor.Enabled {
+		utils.SendError(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	step, ok := utils.ValidateTotp(twoFactor.Secret, body.Code, time.Now())
+	if !ok {
+		utils.SendError(w, "Two-factor code incorrect", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Printf("could not generate recovery codes\n%v", err)
+		utils.SendError(w, "Error generating recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	err = t.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.EnableTwoFactor(username); err != nil {
+			return err
+		}
+		if err := tx.UpdateTwoFactorLastStep(username, step); err != nil {
+			return err
+		}
+		return tx.CreateRecoveryCodes(username, hashes)
+	})
+	if err != nil {
+		log.Printf("could not enable two-factor authentication for user %v\n%v", username, err)
+		utils.SendError(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, map[string][]string{"recoveryCodes": codes}, http.StatusOK)
+}
+
+// Disables two-factor authentication. As a stolen access token must not be
+// enough to do this, the request must also carry the user's password and a
+// second factor
+func (t *twoFactorController) DeleteTwoFactor(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	password := r.Header.Get("Password")
+	if password == "" {
+		utils.SendError(w, "Password header required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := t.db.GetUser(username)
+	if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		utils.SendError(w, "Password incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := verifySecondFactor(t.db, username, r)
+	if err != nil {
+		log.Printf("could not verify second factor for user %v\n%v", username, err)
+		utils.SendError(w, "Error verifying two-factor code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		utils.SendError(w, "Valid two-factor code required", http.StatusUnauthorized)
+		return
+	}
+
+	err = t.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		return tx.DeleteTwoFactor(username)
+	})
+	if err != nil {
+		log.Printf("could not disable two-factor authentication for user %v\n%v", username, err)
+		utils.SendError(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Checks the second factor a request presents, either a TOTP code in the Totp
+// header or an unused recovery code in the Recovery-Code header. Both are
+// single use. Users who have not enabled two-factor authentication always pass
+func verifySecondFactor(db storage.DB, username string, r *http.Request) (bool, error) {
+	twoFactor, err := db.GetTwoFactor(username)
+	if storage.IsNotFound(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !twoFactor.Enabled {
+		return true, nil
+	}
+
+	if code := r.Header.Get("Totp"); code != "" {
+		step, ok := utils.ValidateTotp(twoFactor.Secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		err := db.UpdateTwoFactorLastStep(username, step)
+		if storage.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	if code := r.Header.Get("Recovery-Code"); code != "" {
+		err := db.UseRecoveryCode(username, hashRecoveryCode(code))
+		if storage.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	return false, nil
+}
+
+// Returns recovery codes formatted for the user, and their hashes for storage
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(b)
+		codes[i] = strings.ToLower(code[:4] + "-" + code[4:])
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// Recovery codes are random, so a fast hash is enough. Formatting is ignored
+// so users can type them however they like
+func hashRecoveryCode(code string) string {
+	normalised := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalised))
+	return hex.EncodeToString(sum[:])
+}
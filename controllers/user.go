@@ -1,37 +1,60 @@
 package controllers
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/crowdpower/fund/keys"
+	"github.com/crowdpower/fund/mailer"
 	"github.com/crowdpower/fund/models"
 	"github.com/crowdpower/fund/storage"
 	"github.com/crowdpower/fund/utils"
 )
 
 const (
-	passMinLength = 8
+	passMinLength     = 8
+	deletedUserPrefix = "deleted-"
 )
 
+var errBalanceRemaining = errors.New("balance remaining")
+
 type UserController interface {
 	PostUser(w http.ResponseWriter, r *http.Request)
 	GetUser(w http.ResponseWriter, r *http.Request)
 	GetUserExists(w http.ResponseWriter, r *http.Request)
 	PutUser(w http.ResponseWriter, r *http.Request)
 	DeleteUser(w http.ResponseWriter, r *http.Request)
+	PostVerification(w http.ResponseWriter, r *http.Request)
+	PostVerificationConfirm(w http.ResponseWriter, r *http.Request)
+	PostPasswordReset(w http.ResponseWriter, r *http.Request)
+	PostPasswordResetConfirm(w http.ResponseWriter, r *http.Request)
 }
 
 type userController struct {
-	db storage.DB
+	db     storage.DB
+	keys   *keys.Set
+	mailer mailer.Mailer
+	// where the links in emails point, e.g. https://fund.example
+	frontendUrl string
 }
 
-func NewUserController(db storage.DB) UserController {
-	return &userController{db}
+func NewUserController(db storage.DB, keys *keys.Set, mailer mailer.Mailer, frontendUrl string) UserController {
+	return &userController{db, keys, mailer, frontendUrl}
 }
 
 func (u *userController) PostUser(w http.ResponseWriter, r *http.Request) {
@@ -48,6 +71,19 @@ func (u *userController) PostUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// reserved for the remains of deleted accounts
+	if strings.HasPrefix(user.Username, deletedUserPrefix) {
+		utils.SendError(w, fmt.Sprintf("Username cannot start with '%v'", deletedUserPrefix), http.StatusBadRequest)
+		return
+	}
+
+	if user.Email != "" {
+		if _, err := mail.ParseAddress(user.Email); err != nil {
+			utils.SendError(w, "Email is not a valid address", http.StatusBadRequest)
+			return
+		}
+	}
+
 	user.Password, err = hashAndSalt(user.Password)
 	if err != nil {
 		log.Printf("could not hash password\n%v", err)
@@ -55,7 +91,14 @@ func (u *userController) PostUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = u.db.CreateUser(&user)
+	audit := newAuditEntry(r, auditUserCreate, user.Username, nil, nil)
+	audit.Actor = user.Username
+	err = u.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.CreateUser(&user); err != nil {
+			return err
+		}
+		return tx.AppendAudit(audit)
+	})
 	if err != nil {
 		log.Printf("could not insert user %v into database\n%v", user, err)
 		utils.SendError(w, "Error inserting user into database", http.StatusInternalServerError)
@@ -63,6 +106,10 @@ func (u *userController) PostUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	utils.SendSuccess(w, nil, http.StatusNoContent)
+
+	if user.Email != "" {
+		u.sendVerification(user.Username, user.Email)
+	}
 }
 
 func (u *userController) GetUser(w http.ResponseWriter, r *http.Request) {
@@ -127,6 +174,26 @@ func (u *userController) PutUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.Email != "" {
+		if _, err := mail.ParseAddress(user.Email); err != nil {
+			utils.SendError(w, "Email is not a valid address", http.StatusBadRequest)
+			return
+		}
+	}
+
+	existing, err := u.db.GetUser(username)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("User %v not found", username), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		return
+	}
+
+	emailChanged := user.Email != "" && user.Email != existing.Email
+	passwordChanged := bcrypt.CompareHashAndPassword([]byte(existing.Password), []byte(user.Password)) != nil
+
 	user.Password, err = hashAndSalt(user.Password)
 	if err != nil {
 		log.Printf("could not hash password\n%v", err)
@@ -134,7 +201,30 @@ func (u *userController) PutUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = u.db.UpdateUser(username, &user)
+	err = u.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.UpdateUser(username, &user); err != nil {
+			return err
+		}
+
+		// the audit log can never be edited, so it can't hold personal data.
+		// Emails are recorded as references, which stop matching them once
+		// the account is deleted
+		var before interface{}
+		after := map[string]interface{}{"emailChanged": emailChanged, "passwordChanged": passwordChanged}
+		if emailChanged {
+			oldRef, err := auditRef(tx, username, existing.Email)
+			if err != nil {
+				return err
+			}
+			newRef, err := auditRef(tx, username, user.Email)
+			if err != nil {
+				return err
+			}
+			before = map[string]string{"email": oldRef}
+			after["email"] = newRef
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditUserUpdate, username, before, after))
+	})
 	if err != nil {
 		log.Printf("could not update user %v\n%v", user, err)
 		utils.SendError(w, "Error updating user", http.StatusInternalServerError)
@@ -142,8 +232,17 @@ func (u *userController) PutUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	utils.SendSuccess(w, nil, http.StatusNoContent)
+
+	if user.Email != "" && user.Email != existing.Email {
+		u.sendVerification(username, user.Email)
+	}
 }
 
+// Deletes the user's account. Like disabling two-factor authentication, this
+// needs the user's password and a second factor as well as the access token.
+// Accounts with money left in them can't be deleted, as it would be lost.
+// Deposits and payments are kept for accounting under an anonymous name,
+// everything else about the user is deleted
 func (u *userController) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	username := mux.Vars(r)["username"]
 	if username == "" {
@@ -151,10 +250,91 @@ func (u *userController) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := u.db.DeleteUser(username)
+	password := r.Header.Get("Password")
+	if password == "" {
+		utils.SendError(w, "Password header required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := u.db.GetUser(username)
 	if storage.IsNotFound(err) {
 		utils.SendError(w, fmt.Sprintf("User %v not found", username), http.StatusNotFound)
 		return
+	} else if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		return
+	}
+
+	// throttled like logging in, or this would be a way round the lockout
+	now := time.Now().UTC()
+	ip := utils.ClientIp(r)
+	retry, locked, err := beginLoginAttempt(r.Context(), u.db, username, ip, now)
+	if err != nil {
+		log.Printf("could not check login throttle for user %v\n%v", username, err)
+		utils.SendError(w, "Error checking login attempts", http.StatusInternalServerError)
+		return
+	}
+	if retry > 0 {
+		sendRetryAfter(w, retry)
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		loginFailed(w, r, u.db, u.mailer, username, user, locked, now, "Password incorrect")
+		return
+	}
+
+	ok, err := verifySecondFactor(u.db, username, r)
+	if err != nil {
+		log.Printf("could not verify second factor for user %v\n%v", username, err)
+		utils.SendError(w, "Error verifying two-factor code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		loginFailed(w, r, u.db, u.mailer, username, user, locked, now, "Valid two-factor code required")
+		return
+	}
+
+	err = loginSucceeded(r.Context(), u.db, username, ip)
+	if err != nil {
+		log.Printf("could not reset login throttle for user %v\n%v", username, err)
+	}
+
+	// a frozen account is being looked into, and must stay as it is
+	if user.Frozen {
+		utils.SendError(w, "Account is frozen", http.StatusForbidden)
+		return
+	}
+
+	anonymous := deletedUserPrefix + uuid.NewV4().String()
+	var balance int
+	err = u.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		// checked again here, so a deposit can't land after the check above
+		user, err := tx.GetUser(username)
+		if err != nil {
+			return err
+		}
+		if user.Balance != 0 {
+			balance = user.Balance
+			return errBalanceRemaining
+		}
+
+		if err := tx.RevokeSessions(username); err != nil {
+			return err
+		}
+		if err := tx.AnonymiseUser(username, anonymous); err != nil {
+			return err
+		}
+		return tx.AppendAudit(newAuditEntry(r, auditUserDelete, username, nil, nil))
+	})
+	if err == errBalanceRemaining {
+		utils.SendError(w, fmt.Sprintf("Account still has a balance of %v, which must be spent before it can be deleted",
+			balance), http.StatusConflict)
+		return
+	} else if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("User %v not found", username), http.StatusNotFound)
+		return
 	} else if err != nil {
 		log.Printf("could not delete user %v\n%v", username, err)
 		utils.SendError(w, "Error deleting user", http.StatusInternalServerError)
@@ -164,6 +344,226 @@ func (u *userController) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	utils.SendSuccess(w, nil, http.StatusNoContent)
 }
 
+// Resends the verification email for the user's current address
+func (u *userController) PostVerification(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	user, err := u.db.GetUser(username)
+	if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		return
+	}
+
+	if user.Email == "" {
+		utils.SendError(w, "User has no email address", http.StatusBadRequest)
+		return
+	}
+	if user.EmailVerified {
+		utils.SendError(w, "Email is already verified", http.StatusConflict)
+		return
+	}
+
+	err = u.sendVerification(username, user.Email)
+	if err != nil {
+		utils.SendError(w, "Error sending verification email", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+func (u *userController) PostVerificationConfirm(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var body models.UserToken
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		log.Printf("could not unmarshal PostVerificationConfirm request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := validateToken(u.keys, body.Token, username, VerifyEmailTokenType)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	audit := newAuditEntry(r, auditUserVerifyEmail, username, nil, nil)
+	audit.Actor = username
+	err = u.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.VerifyEmail(username, claims.Email); err != nil {
+			return err
+		}
+		return tx.AppendAudit(audit)
+	})
+	if storage.IsNotFound(err) {
+		utils.SendError(w, "Email has changed since this link was sent", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("could not verify email of user %v\n%v", username, err)
+		utils.SendError(w, "Error verifying email", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Emails a password reset link to the user's address, if it has been
+// verified. Always succeeds, so it cannot be used to find out which users
+// exist or what their addresses are
+func (u *userController) PostPasswordReset(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+
+	user, err := u.db.GetUser(username)
+	if storage.IsNotFound(err) {
+		return
+	} else if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		return
+	}
+
+	if user.Email == "" || !user.EmailVerified {
+		log.Printf("not sending password reset to user %v without a verified email", username)
+		return
+	}
+
+	token, err := u.keys.Sign(TokenClaims{
+		Type:           ResetPasswordTokenType,
+		Username:       username,
+		PasswordHash:   passwordFingerprint(user.Password),
+		StandardClaims: newStandardClaims(resetPasswordExpiryTime),
+	})
+	if err != nil {
+		log.Printf("could not generate password reset token\n%v", err)
+		return
+	}
+
+	err = u.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Fund password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Fund account %v. "+
+			"If it was you, follow this link within the hour:\n\n%v\n\n"+
+			"If it wasn't, you can ignore this email.", username, u.link("reset-password", username, token)),
+	})
+	if err != nil {
+		log.Printf("could not send password reset email to user %v\n%v", username, err)
+	}
+}
+
+// Sets a new password using the token from a reset email. The token stops
+// working once used, and every existing session is logged out
+func (u *userController) PostPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	var body models.UserToken
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		log.Printf("could not unmarshal PostPasswordResetConfirm request body\n%v", err)
+		utils.SendError(w, "Could not parse body as JSON", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := validateToken(u.keys, body.Token, username, ResetPasswordTokenType)
+	if err != nil {
+		utils.SendError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(body.Password) < passMinLength {
+		utils.SendError(w, fmt.Sprintf("Password must be at least %v characters", passMinLength), http.StatusBadRequest)
+		return
+	}
+
+	user, err := u.db.GetUser(username)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("User %v not found", username), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not get user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting user from database", http.StatusInternalServerError)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.PasswordHash), []byte(passwordFingerprint(user.Password))) != 1 {
+		utils.SendError(w, "Password reset link has already been used", http.StatusBadRequest)
+		return
+	}
+
+	password, err := hashAndSalt(body.Password)
+	if err != nil {
+		log.Printf("could not hash password\n%v", err)
+		utils.SendError(w, "Could not hash password", http.StatusInternalServerError)
+		return
+	}
+
+	audit := newAuditEntry(r, auditUserResetPassword, username, nil, nil)
+	audit.Actor = username
+	err = u.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		if err := tx.UpdateUser(username, &models.User{Password: password}); err != nil {
+			return err
+		}
+		if err := tx.RevokeSessions(username); err != nil {
+			return err
+		}
+		return tx.AppendAudit(audit)
+	})
+	if err != nil {
+		log.Printf("could not reset password of user %v\n%v", username, err)
+		utils.SendError(w, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+func (u *userController) sendVerification(username, email string) error {
+	token, err := u.keys.Sign(TokenClaims{
+		Type:           VerifyEmailTokenType,
+		Username:       username,
+		Email:          email,
+		StandardClaims: newStandardClaims(verifyEmailExpiryTime),
+	})
+	if err != nil {
+		log.Printf("could not generate email verification token\n%v", err)
+		return err
+	}
+
+	err = u.mailer.Send(mailer.Message{
+		To:      email,
+		Subject: "Verify your email for Fund",
+		Body: fmt.Sprintf("Follow this link to confirm %v is the email address of your Fund account %v:\n\n%v",
+			email, username, u.link("verify-email", username, token)),
+	})
+	if err != nil {
+		log.Printf("could not send verification email to user %v\n%v", username, err)
+	}
+	return err
+}
+
+func (u *userController) link(page, username, token string) string {
+	query := url.Values{}
+	query.Set("username", username)
+	query.Set("token", token)
+	return fmt.Sprintf("%v/%v?%v", u.frontendUrl, page, query.Encode())
+}
+
+func newStandardClaims(expiry time.Duration) jwt.StandardClaims {
+	now := time.Now()
+	return jwt.StandardClaims{
+		Id:        uuid.NewV4().String(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(expiry).Unix(),
+	}
+}
+
+func passwordFingerprint(passwordHash string) string {
+	sum := sha256.Sum256([]byte(passwordHash))
+	return hex.EncodeToString(sum[:])
+}
+
 func hashAndSalt(password string) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/gorilla/mux"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/utils"
+)
+
+const (
+	webAuthnRegistration = "registration"
+	webAuthnLogin        = "login"
+
+	webAuthnChallengeExpiryTime = time.Minute * 5
+)
+
+// Derives the made-up passkey ids offered for users who have no passkeys, so
+// a login can't tell whether a user exists or has passkeys
+var dummyWebAuthnKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// Adapts a user and their passkeys to the WebAuthn library
+type webAuthnUser struct {
+	username    string
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(u.username)
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	return u.username
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func (a *authController) getWebAuthnUser(username string) (*webAuthnUser, error) {
+	stored, err := a.db.GetWebAuthnCredentials(username)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &webAuthnUser{username: username}
+	for _, c := range stored {
+		id, err := base64.RawURLEncoding.DecodeString(c.Id)
+		if err != nil {
+			return nil, fmt.Errorf("stored passkey id %v is not base64url\n%v", c.Id, err)
+		}
+		user.credentials = append(user.credentials, webauthn.Credential{
+			ID:              id,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.Aaguid,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return user, nil
+}
+
+func (a *authController) PostWebAuthnRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	user, err := a.getWebAuthnUser(username)
+	if err != nil {
+		log.Printf("could not get passkeys for user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting passkeys from database", http.StatusInternalServerError)
+		return
+	}
+
+	options, sessionData, err := a.webAuthn.BeginRegistration(user)
+	if err != nil {
+		log.Printf("could not begin passkey registration for user %v\n%v", username, err)
+		utils.SendError(w, "Error beginning passkey registration", http.StatusInternalServerError)
+		return
+	}
+
+	if !a.storeWebAuthnChallenge(w, username, webAuthnRegistration, sessionData) {
+		return
+	}
+
+	utils.SendSuccess(w, options, http.StatusOK)
+}
+
+// Verifies the authenticator's response to the registration challenge and
+// stores the new passkey under the name given in the 'name' parameter
+func (a *authController) PostWebAuthnRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	user, sessionData, ok := a.takeWebAuthnChallenge(w, r, username, webAuthnRegistration)
+	if !ok {
+		return
+	}
+
+	credential, err := a.webAuthn.FinishRegistration(user, *sessionData, r)
+	if err != nil {
+		log.Printf("could not verify passkey registration for user %v\n%v", username, err)
+		utils.SendError(w, "Passkey could not be verified", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	stored := models.WebAuthnCredential{
+		Id:              base64.RawURLEncoding.EncodeToString(credential.ID),
+		Username:        username,
+		Name:            r.URL.Query().Get("name"),
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Aaguid:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		Created:         now,
+		LastUsed:        now,
+	}
+
+	err = a.db.CreateWebAuthnCredential(&stored)
+	if err != nil {
+		log.Printf("could not insert passkey for user %v into database\n%v", username, err)
+		utils.SendError(w, "Error inserting passkey into database", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, stored, http.StatusOK)
+}
+
+func (a *authController) GetWebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	credentials, err := a.db.GetWebAuthnCredentials(username)
+	if err != nil {
+		log.Printf("could not get passkeys for user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting passkeys from database", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, credentials, http.StatusOK)
+}
+
+func (a *authController) DeleteWebAuthnCredential(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	id := mux.Vars(r)["id"]
+
+	err := a.db.DeleteWebAuthnCredential(username, id)
+	if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("Passkey %v not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("could not delete passkey %v for user %v\n%v", id, username, err)
+		utils.SendError(w, "Error deleting passkey", http.StatusInternalServerError)
+		return
+	}
+
+	utils.SendSuccess(w, nil, http.StatusNoContent)
+}
+
+// Starts a passkey login, the alternative to the password check in
+// GetRefreshToken
+func (a *authController) PostWebAuthnLoginBegin(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	user, err := a.getWebAuthnUser(username)
+	if err != nil {
+		log.Printf("could not get passkeys for user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting passkeys from database", http.StatusInternalServerError)
+		return
+	}
+	// a missing user, or one without passkeys, is sent a challenge for a
+	// passkey that doesn't exist, the same one each time. Nothing is stored,
+	// so finishing the login fails like a wrong passkey
+	dummy := len(user.credentials) == 0
+	if dummy {
+		mac := hmac.New(sha256.New, dummyWebAuthnKey)
+		mac.Write([]byte(username))
+		user.credentials = []webauthn.Credential{{ID: mac.Sum(nil)}}
+	}
+
+	options, sessionData, err := a.webAuthn.BeginLogin(user)
+	if err != nil {
+		log.Printf("could not begin passkey login for user %v\n%v", username, err)
+		utils.SendError(w, "Error beginning passkey login", http.StatusInternalServerError)
+		return
+	}
+
+	if !dummy && !a.storeWebAuthnChallenge(w, username, webAuthnLogin, sessionData) {
+		return
+	}
+
+	utils.SendSuccess(w, options, http.StatusOK)
+}
+
+// Verifies the authenticator's assertion and, like GetRefreshToken, starts a
+// new session. An assertion whose signature counter has not increased means
+// the passkey may have been cloned, so it is refused
+func (a *authController) PostWebAuthnLoginFinish(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+
+	user, sessionData, ok := a.takeWebAuthnChallenge(w, r, username, webAuthnLogin)
+	if !ok {
+		return
+	}
+
+	credential, err := a.webAuthn.FinishLogin(user, *sessionData, r)
+	if err != nil {
+		log.Printf("could not verify passkey login for user %v\n%v", username, err)
+		utils.SendError(w, "Passkey could not be verified", http.StatusUnauthorized)
+		return
+	}
+
+	if credential.Authenticator.CloneWarning {
+		log.Printf("signature counter of a passkey for user %v did not increase, it may be cloned", username)
+		utils.SendError(w, "Passkey could not be verified", http.StatusUnauthorized)
+		return
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(credential.ID)
+	err = a.db.UpdateWebAuthnCredentialUse(username, id, credential.Authenticator.SignCount, time.Now().UTC())
+	if err != nil {
+		log.Printf("could not update passkey %v for user %v\n%v", id, username, err)
+		utils.SendError(w, "Error updating passkey", http.StatusInternalServerError)
+		return
+	}
+
+	a.startSession(w, r, username)
+}
+
+// Returns false, having sent an error, if the ceremony state could not be
+// stored
+func (a *authController) storeWebAuthnChallenge(w http.ResponseWriter, username, ceremony string, sessionData *webauthn.SessionData) bool {
+	data, err := json.Marshal(sessionData)
+	if err != nil {
+		log.Printf("could not marshal %v session data\n%v", ceremony, err)
+		utils.SendError(w, "Error storing challenge", http.StatusInternalServerError)
+		return false
+	}
+
+	err = a.db.SetWebAuthnChallenge(&models.WebAuthnChallenge{
+		Username: username,
+		Ceremony: ceremony,
+		Data:     data,
+		Expires:  time.Now().UTC().Add(webAuthnChallengeExpiryTime),
+	})
+	if err != nil {
+		log.Printf("could not store %v challenge for user %v\n%v", ceremony, username, err)
+		utils.SendError(w, "Error storing challenge", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// Returns false, having sent an error, if there is no unexpired ceremony of
+// this kind for the user
+func (a *authController) takeWebAuthnChallenge(w http.ResponseWriter, r *http.Request, username, ceremony string) (*webAuthnUser, *webauthn.SessionData, bool) {
+	var challenge *models.WebAuthnChallenge
+	err := a.db.WithTx(r.Context(), func(tx storage.Tx) error {
+		var err error
+		challenge, err = tx.TakeWebAuthnChallenge(username, ceremony, time.Now().UTC())
+		return err
+	})
+	if storage.IsNotFound(err) && ceremony == webAuthnLogin {
+		// there's never a challenge for users without passkeys
+		utils.SendError(w, "Passkey could not be verified", http.StatusUnauthorized)
+		return nil, nil, false
+	} else if storage.IsNotFound(err) {
+		utils.SendError(w, fmt.Sprintf("No %v in progress, or it has expired", ceremony), http.StatusBadRequest)
+		return nil, nil, false
+	} else if err != nil {
+		log.Printf("could not get %v challenge for user %v from the database\n%v", ceremony, username, err)
+		utils.SendError(w, "Error getting challenge from database", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	sessionData := &webauthn.SessionData{}
+	err = json.Unmarshal(challenge.Data, sessionData)
+	if err != nil {
+		log.Printf("could not unmarshal %v session data\n%v", ceremony, err)
+		utils.SendError(w, "Error reading challenge", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	user, err := a.getWebAuthnUser(username)
+	if err != nil {
+		log.Printf("could not get passkeys for user %v from the database\n%v", username, err)
+		utils.SendError(w, "Error getting passkeys from database", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	return user, sessionData, true
+}
@@ -0,0 +1,335 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/duo-labs/webauthn/webauthn"
+	"github.com/gorilla/mux"
+
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/keys"
+	"github.com/crowdpower/fund/mailer"
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/storage"
+)
+
+const (
+	testRpId     = "localhost"
+	testRpOrigin = "http://localhost:3000"
+)
+
+// A software authenticator holding one ES256 passkey, making the attestations
+// and assertions a browser would pass on
+type softAuthenticator struct {
+	id    []byte
+	key   *ecdsa.PrivateKey
+	count uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{id: id, key: key}
+}
+
+// Authenticator data with the user present and verified flags, and the
+// passkey's id and public key if attested
+func (s *softAuthenticator) authData(attested bool) []byte {
+	rpIdHash := sha256.Sum256([]byte(testRpId))
+	data := append([]byte{}, rpIdHash[:]...)
+	flags := byte(0x05)
+	if attested {
+		flags |= 0x40
+	}
+	data = append(data, flags)
+	data = append(data, byte(s.count>>24), byte(s.count>>16), byte(s.count>>8), byte(s.count))
+	if !attested {
+		return data
+	}
+
+	data = append(data, make([]byte, 16)...)
+	data = append(data, byte(len(s.id)>>8), byte(len(s.id)))
+	data = append(data, s.id...)
+	x := s.key.PublicKey.X.FillBytes(make([]byte, 32))
+	y := s.key.PublicKey.Y.FillBytes(make([]byte, 32))
+	// EC2 key on P-256 for ES256
+	return append(data, cbor(cborMap{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, y}})...)
+}
+
+func clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": testRpOrigin})
+	return data
+}
+
+// The body of a registration finish request answering challenge
+func (s *softAuthenticator) attest(challenge string) []byte {
+	attestation := cbor(cborMap{{"fmt", "none"}, {"attStmt", cborMap{}}, {"authData", s.authData(true)}})
+	return s.credential(map[string]string{
+		"attestationObject": b64(attestation),
+		"clientDataJSON":    b64(clientData("webauthn.create", challenge)),
+	})
+}
+
+// The body of a login finish request answering challenge, after counting up
+// the signature counter by step
+func (s *softAuthenticator) assert(t *testing.T, challenge string, username string, step uint32) []byte {
+	s.count += step
+	authData := s.authData(false)
+	data := clientData("webauthn.get", challenge)
+	dataHash := sha256.Sum256(data)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), dataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.credential(map[string]string{
+		"authenticatorData": b64(authData),
+		"clientDataJSON":    b64(data),
+		"signature":         b64(signature),
+		"userHandle":        b64([]byte(username)),
+	})
+}
+
+func (s *softAuthenticator) credential(response map[string]string) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":       b64(s.id),
+		"rawId":    b64(s.id),
+		"type":     "public-key",
+		"response": response,
+	})
+	return body
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Just enough CBOR for attestation objects and COSE keys: ints, byte and text
+// strings, and maps kept in order
+type cborMap [][2]interface{}
+
+func cbor(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+		return []byte{major<<5 | 26, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case cborMap:
+		out := head(5, uint64(len(v)))
+		for _, kv := range v {
+			out = append(out, cbor(kv[0])...)
+			out = append(out, cbor(kv[1])...)
+		}
+		return out
+	}
+	panic("cbor can't encode value")
+}
+
+// Starts an auth controller on a fresh database holding the user alice, with
+// the passkey routes the server has, minus the token checks
+func newWebAuthnTestRouter(t *testing.T) (*mux.Router, storage.DB) {
+	db := newTestDB(t)
+	if err := db.CreateUser(&models.User{Username: "alice", Password: "unused"}); err != nil {
+		t.Fatal(err)
+	}
+
+	keySet, err := keys.Load(nil, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	webAuthn, err := webauthn.New(&webauthn.Config{RPDisplayName: "Fund", RPID: testRpId, RPOrigin: testRpOrigin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewAuthController(db, keySet, webAuthn, mailer.NewMemoryMailer(), events.NewBus())
+
+	r := mux.NewRouter()
+	r.HandleFunc("/users/{username}/webauthn/login/begin", auth.PostWebAuthnLoginBegin).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/webauthn/login/finish", auth.PostWebAuthnLoginFinish).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/webauthn/register/begin", auth.PostWebAuthnRegisterBegin).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/webauthn/register/finish", auth.PostWebAuthnRegisterFinish).Methods(http.MethodPost)
+	return r, db
+}
+
+func post(r *mux.Router, path string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+	return w
+}
+
+// The challenge and allowed passkey ids from a begin response. The library
+// sends them in standard base64, which browsers' scripts decode, so they're
+// returned re-encoded the way they appear in client data and credentials
+func beginOptions(t *testing.T, w *httptest.ResponseRecorder) (string, []string) {
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin returned %v: %v", w.Code, w.Body.String())
+	}
+	var response struct {
+		Data struct {
+			PublicKey struct {
+				Challenge        string `json:"challenge"`
+				AllowCredentials []struct {
+					Id string `json:"id"`
+				} `json:"allowCredentials"`
+			} `json:"publicKey"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, c := range response.Data.PublicKey.AllowCredentials {
+		ids = append(ids, stdToB64(t, c.Id))
+	}
+	return stdToB64(t, response.Data.PublicKey.Challenge), ids
+}
+
+func stdToB64(t *testing.T, s string) string {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b64(b)
+}
+
+func register(t *testing.T, r *mux.Router, username string) *softAuthenticator {
+	authenticator := newSoftAuthenticator(t)
+	challenge, _ := beginOptions(t, post(r, "/users/"+username+"/webauthn/register/begin", nil))
+	w := post(r, "/users/"+username+"/webauthn/register/finish?name=Laptop", authenticator.attest(challenge))
+	if w.Code != http.StatusOK {
+		t.Fatalf("register finish returned %v: %v", w.Code, w.Body.String())
+	}
+	return authenticator
+}
+
+func login(t *testing.T, r *mux.Router, username string, authenticator *softAuthenticator, step uint32) *httptest.ResponseRecorder {
+	challenge, _ := beginOptions(t, post(r, "/users/"+username+"/webauthn/login/begin", nil))
+	return post(r, "/users/"+username+"/webauthn/login/finish", authenticator.assert(t, challenge, username, step))
+}
+
+func TestWebAuthnRegisterAndLogin(t *testing.T) {
+	r, db := newWebAuthnTestRouter(t)
+	authenticator := register(t, r, "alice")
+
+	credentials, err := db.GetWebAuthnCredentials("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials) != 1 || credentials[0].Id != b64(authenticator.id) || credentials[0].Name != "Laptop" {
+		t.Fatalf("stored passkeys %+v, want the registered one", credentials)
+	}
+
+	challenge, ids := beginOptions(t, post(r, "/users/alice/webauthn/login/begin", nil))
+	if len(ids) != 1 || ids[0] != b64(authenticator.id) {
+		t.Fatalf("login allowed passkeys %v, want %v", ids, b64(authenticator.id))
+	}
+	w := post(r, "/users/alice/webauthn/login/finish", authenticator.assert(t, challenge, "alice", 1))
+	if w.Code != http.StatusOK {
+		t.Fatalf("login finish returned %v: %v", w.Code, w.Body.String())
+	}
+	var response struct {
+		Data tokens `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Data.RefreshToken == "" || response.Data.AccessToken == "" {
+		t.Fatalf("login finish returned no tokens: %v", w.Body.String())
+	}
+
+	credentials, err = db.GetWebAuthnCredentials("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials[0].SignCount != 1 {
+		t.Fatalf("stored sign count %v, want 1", credentials[0].SignCount)
+	}
+}
+
+func TestWebAuthnLoginRefusesCloneWarning(t *testing.T) {
+	r, _ := newWebAuthnTestRouter(t)
+	authenticator := register(t, r, "alice")
+
+	if w := login(t, r, "alice", authenticator, 5); w.Code != http.StatusOK {
+		t.Fatalf("first login returned %v: %v", w.Code, w.Body.String())
+	}
+	// a clone still at the same count
+	if w := login(t, r, "alice", authenticator, 0); w.Code != http.StatusUnauthorized {
+		t.Fatalf("login with an unchanged sign count returned %v, want 401", w.Code)
+	}
+}
+
+func TestWebAuthnRefusesReusedChallenge(t *testing.T) {
+	r, _ := newWebAuthnTestRouter(t)
+	authenticator := newSoftAuthenticator(t)
+
+	challenge, _ := beginOptions(t, post(r, "/users/alice/webauthn/register/begin", nil))
+	if w := post(r, "/users/alice/webauthn/register/finish", authenticator.attest(challenge)); w.Code != http.StatusOK {
+		t.Fatalf("register finish returned %v: %v", w.Code, w.Body.String())
+	}
+	if w := post(r, "/users/alice/webauthn/register/finish", authenticator.attest(challenge)); w.Code != http.StatusBadRequest {
+		t.Fatalf("register finish with a used challenge returned %v, want 400", w.Code)
+	}
+
+	challenge, _ = beginOptions(t, post(r, "/users/alice/webauthn/login/begin", nil))
+	if w := post(r, "/users/alice/webauthn/login/finish", authenticator.assert(t, challenge, "alice", 1)); w.Code != http.StatusOK {
+		t.Fatalf("login finish returned %v: %v", w.Code, w.Body.String())
+	}
+	if w := post(r, "/users/alice/webauthn/login/finish", authenticator.assert(t, challenge, "alice", 1)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("login finish with a used challenge returned %v, want 401", w.Code)
+	}
+}
+
+func TestWebAuthnLoginBeginHidesUsers(t *testing.T) {
+	r, _ := newWebAuthnTestRouter(t)
+
+	// alice exists without passkeys, bob doesn't exist at all
+	for _, username := range []string{"alice", "bob"} {
+		challenge, ids := beginOptions(t, post(r, "/users/"+username+"/webauthn/login/begin", nil))
+		if challenge == "" || len(ids) != 1 {
+			t.Fatalf("login begin for %v offered %v, want one made-up passkey", username, ids)
+		}
+		_, again := beginOptions(t, post(r, "/users/"+username+"/webauthn/login/begin", nil))
+		if len(again) != 1 || again[0] != ids[0] {
+			t.Fatalf("login begin for %v offered %v then %v, want the same passkey", username, ids, again)
+		}
+
+		authenticator := newSoftAuthenticator(t)
+		w := post(r, "/users/"+username+"/webauthn/login/finish", authenticator.assert(t, challenge, username, 1))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("login finish for %v returned %v, want 401", username, w.Code)
+		}
+	}
+}
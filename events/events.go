@@ -0,0 +1,129 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Kinds of event sent to users as they happen
+const (
+	TypeBalance        = "balance"
+	TypeDeposit        = "deposit"
+	TypePayment        = "payment"
+	TypeLowBalance     = "low_balance"
+	TypePaymentFailed  = "payment_failed"
+	TypeLogin          = "login"
+	TypeSessionRevoked = "session_revoked"
+	TypeNotification   = "notification"
+)
+
+// events a subscriber can fall behind by before newer ones are dropped
+const subscriberBuffer = 32
+
+// Something that happened to a user's account. Data is sent as JSON
+type Event struct {
+	Type     string      `json:"type"`
+	Username string      `json:"-"`
+	Time     time.Time   `json:"time"`
+	Data     interface{} `json:"data"`
+}
+
+// The data of balance events
+type Balance struct {
+	Balance  int `json:"balance"`
+	Previous int `json:"previous"`
+}
+
+// The data of low balance events, sent when a balance drops below the
+// threshold the user set
+type LowBalance struct {
+	Balance   int `json:"balance"`
+	Threshold int `json:"threshold"`
+}
+
+// The data of payment failed events, sent when a payment is refused. Reason
+// is the error the payment was refused with
+type PaymentFailed struct {
+	Url    string `json:"url"`
+	Amount int    `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// The data of login events, sent when the user logs in and starts a session
+type Login struct {
+	Session   string `json:"session"`
+	Device    string `json:"device"`
+	UserAgent string `json:"userAgent"`
+	Ip        string `json:"ip"`
+}
+
+// The data of session revoked events, sent when one of the user's sessions is
+// revoked, whether by the user, by deleting the app it was granted to, or
+// because its refresh tokens leaked
+type SessionRevoked struct {
+	Session string `json:"session"`
+}
+
+// Delivers the events of each user to whoever is subscribed to them, within
+// this process. Publishing never blocks: a subscriber too slow to keep up
+// misses events rather than holding up the request that caused them
+type Bus struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan Event]struct{}
+	handlers    []func(Event)
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: map[string]map[chan Event]struct{}{}}
+}
+
+// Calls fn with every event published, of every user. fn is called on the
+// publisher's goroutine, so must return quickly
+func (b *Bus) Handle(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, fn)
+}
+
+// Returns a channel of the user's events, and a function to call once done
+// with it that closes the channel
+func (b *Bus) Subscribe(username string) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subscribers[username] == nil {
+		b.subscribers[username] = map[chan Event]struct{}{}
+	}
+	b.subscribers[username][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers[username], ch)
+			if len(b.subscribers[username]) == 0 {
+				delete(b.subscribers, username)
+			}
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Sends an event to the user's subscribers, then passes it to the handlers
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	for ch := range b.subscribers[e.Username] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	handlers := b.handlers
+	b.mu.Unlock()
+
+	for _, handle := range handlers {
+		handle(e)
+	}
+}
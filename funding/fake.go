@@ -0,0 +1,33 @@
+package funding
+
+import (
+	"sync"
+)
+
+// Approves every charge without taking any money, for development and tests
+type FakeProvider struct {
+	mu      sync.Mutex
+	charges map[string]int
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{charges: map[string]int{}}
+}
+
+func (p *FakeProvider) Charge(username string, amount int, id string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.charges[id] = amount
+	return "fake-" + id, nil
+}
+
+// Returns the amount of each charge made so far, by id
+func (p *FakeProvider) Charges() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	charges := map[string]int{}
+	for id, amount := range p.charges {
+		charges[id] = amount
+	}
+	return charges
+}
@@ -0,0 +1,36 @@
+package funding
+
+import (
+	"fmt"
+)
+
+// Takes payment from a user for credits, e.g. by charging the card they have
+// on file with a payment processor. id identifies the deposit the charge is
+// for, and is sent as an idempotency key so a retried charge isn't taken
+// twice. Returns the provider's reference for the charge
+type Provider interface {
+	Charge(username string, amount int, id string) (string, error)
+}
+
+type Config struct {
+	Driver string `mapstructure:"driver"`
+	Url    string `mapstructure:"url"`
+	Secret string `mapstructure:"secret"`
+}
+
+// Returns the provider selected by config.Driver: "http" or "fake". With no
+// driver, or "none", returns nil, and deposits can't be made on users' behalf
+func New(config Config) (Provider, error) {
+	switch config.Driver {
+	case "http":
+		if config.Url == "" {
+			return nil, fmt.Errorf("funding url required for the http driver")
+		}
+		return NewHttpProvider(config.Url, config.Secret), nil
+	case "fake":
+		return NewFakeProvider(), nil
+	case "none", "":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown funding driver '%v'", config.Driver)
+}
@@ -0,0 +1,72 @@
+package funding
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const httpTimeout = time.Second * 30
+
+// Asks a payment service to charge the user by POSTing
+// {"id", "username", "amount"} to its url, with the shared secret as a bearer
+// token. The service answers a successful charge with a 2xx and
+// {"reference": ...}, and must treat a repeated id as the same charge
+type httpProvider struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func NewHttpProvider(url, secret string) Provider {
+	return &httpProvider{url, secret, &http.Client{Timeout: httpTimeout}}
+}
+
+type httpCharge struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	Amount   int    `json:"amount"`
+}
+
+type httpChargeResult struct {
+	Reference string `json:"reference"`
+}
+
+func (p *httpProvider) Charge(username string, amount int, id string) (string, error) {
+	body, err := json.Marshal(httpCharge{id, username, amount})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", id)
+	if p.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+p.secret)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("error sending charge %v to funding provider\n%v", id, err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("funding provider declined charge %v with status %v", id, resp.StatusCode)
+	}
+
+	var result httpChargeResult
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		log.Printf("error parsing funding provider response to charge %v\n%v", id, err)
+		return "", err
+	}
+	return result.Reference, nil
+}
@@ -0,0 +1,194 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// A signing key as given in config.toml under [[server.keys]]. A key is used
+// to sign new tokens from ActiveFrom until the next key becomes active, and
+// is accepted for verification until Expires. Keys are published in the JWKS
+// before they become active, so verifiers can fetch them ahead of time, and
+// each key should only expire once every token it signed has expired
+type Config struct {
+	Id         string    `mapstructure:"kid"`
+	Alg        string    `mapstructure:"alg"`
+	File       string    `mapstructure:"file"`
+	ActiveFrom time.Time `mapstructure:"activeFrom"`
+	Expires    time.Time `mapstructure:"expires"`
+}
+
+type key struct {
+	id         string
+	method     jwt.SigningMethod
+	private    interface{}
+	public     interface{}
+	activeFrom time.Time
+	expires    time.Time
+}
+
+func (k *key) expired(now time.Time) bool {
+	return !k.expires.IsZero() && !now.Before(k.expires)
+}
+
+// The keys tokens are signed and verified with
+type Set struct {
+	// ordered by activeFrom, most recent first
+	keys []*key
+	// HS512 secret for tokens issued without a kid, before signing keys were
+	// configured. Also used for signing until an asymmetric key is active
+	legacySecret []byte
+}
+
+// Reads the configured keys' private key files. legacySecret may be empty
+// once every token signed with it has expired
+func Load(configs []Config, legacySecret string) (*Set, error) {
+	s := &Set{legacySecret: []byte(legacySecret)}
+	ids := map[string]bool{}
+
+	for _, c := range configs {
+		if c.Id == "" {
+			return nil, fmt.Errorf("signing key from %v has no kid", c.File)
+		}
+		if ids[c.Id] {
+			return nil, fmt.Errorf("signing key id %v used more than once", c.Id)
+		}
+		ids[c.Id] = true
+
+		k, err := loadKey(c)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = append(s.keys, k)
+	}
+
+	sort.SliceStable(s.keys, func(i, j int) bool {
+		return s.keys[i].activeFrom.After(s.keys[j].activeFrom)
+	})
+
+	if len(s.keys) == 0 && len(s.legacySecret) == 0 {
+		return nil, fmt.Errorf("no signing keys or jwtSecret configured")
+	}
+	return s, nil
+}
+
+func loadKey(c Config) (*key, error) {
+	contents, err := ioutil.ReadFile(c.File)
+	if err != nil {
+		log.Printf("error reading signing key %v from %v\n%v", c.Id, c.File, err)
+		return nil, err
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("signing key file %v is not PEM encoded", c.File)
+	}
+
+	var private interface{}
+	private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("signing key file %v does not hold a PKCS #8 or PKCS #1 private key", c.File)
+	}
+
+	k := &key{id: c.Id, private: private, activeFrom: c.ActiveFrom, expires: c.Expires}
+	switch p := private.(type) {
+	case *rsa.PrivateKey:
+		if c.Alg != AlgRS256 {
+			return nil, fmt.Errorf("signing key %v is an RSA key but alg is '%v'", c.Id, c.Alg)
+		}
+		k.method = jwt.SigningMethodRS256
+		k.public = &p.PublicKey
+	case ed25519.PrivateKey:
+		if c.Alg != AlgEdDSA {
+			return nil, fmt.Errorf("signing key %v is an Ed25519 key but alg is '%v'", c.Id, c.Alg)
+		}
+		k.method = SigningMethodEdDSA
+		k.public = p.Public().(ed25519.PublicKey)
+	default:
+		return nil, fmt.Errorf("signing key %v has unsupported type %T", c.Id, private)
+	}
+
+	return k, nil
+}
+
+// Returns the key new tokens are signed with: the most recently activated
+// key that has not expired
+func (s *Set) signingKey(now time.Time) *key {
+	for _, k := range s.keys {
+		if !k.activeFrom.After(now) && !k.expired(now) {
+			return k
+		}
+	}
+	return nil
+}
+
+func (s *Set) Sign(claims jwt.Claims) (string, error) {
+	k := s.signingKey(time.Now())
+	if k == nil {
+		if len(s.legacySecret) == 0 {
+			return "", fmt.Errorf("no signing key is active")
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS512, claims).SignedString(s.legacySecret)
+	}
+
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.id
+	return token.SignedString(k.private)
+}
+
+// Passed to jwt.Parse to look up the key a token was signed with. The token's
+// alg must be the one its key is for, so that a public key can never be used
+// as an HMAC secret
+func (s *Set) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if len(s.legacySecret) == 0 || token.Method.Alg() != jwt.SigningMethodHS512.Alg() {
+			return nil, fmt.Errorf("token has no key id")
+		}
+		return s.legacySecret, nil
+	}
+
+	now := time.Now()
+	for _, k := range s.keys {
+		if k.id != kid {
+			continue
+		}
+		if k.expired(now) {
+			return nil, fmt.Errorf("token key %v has expired", kid)
+		}
+		if token.Method.Alg() != k.method.Alg() {
+			return nil, fmt.Errorf("token alg %v does not match key %v", token.Method.Alg(), kid)
+		}
+		return k.public, nil
+	}
+	return nil, fmt.Errorf("unknown token key %v", kid)
+}
+
+// Returns the public keys tokens may currently be verified with
+func (s *Set) publicKeys() []*key {
+	now := time.Now()
+	public := []*key{}
+	for _, k := range s.keys {
+		if !k.expired(now) {
+			public = append(public, k)
+		}
+	}
+	return public
+}
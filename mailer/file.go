@@ -0,0 +1,36 @@
+package mailer
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// Appends every message to a file instead of sending it, for development
+type fileMailer struct {
+	mu   sync.Mutex
+	path string
+	from string
+}
+
+func NewFileMailer(path, from string) Mailer {
+	return &fileMailer{path: path, from: from}
+}
+
+func (m *fileMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("error opening mail file %v\n%v", m.path, err)
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(format(m.from, msg), '\r', '\n'))
+	if err != nil {
+		log.Printf("error writing mail to %v\n%v", m.path, err)
+	}
+	return err
+}
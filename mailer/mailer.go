@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"fmt"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends plain text email to users. SmtpMailer delivers for real, FileMailer
+// and MemoryMailer are stand-ins for development and tests
+type Mailer interface {
+	Send(msg Message) error
+}
+
+type Config struct {
+	Driver   string `mapstructure:"driver"`
+	From     string `mapstructure:"from"`
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Path     string `mapstructure:"path"`
+}
+
+// Returns the mailer selected by config.Driver: "smtp", "file" or "memory"
+func New(config Config) (Mailer, error) {
+	switch config.Driver {
+	case "smtp":
+		return NewSmtpMailer(config.Host, config.Port, config.Username, config.Password, config.From), nil
+	case "file":
+		return NewFileMailer(config.Path, config.From), nil
+	case "memory", "":
+		return NewMemoryMailer(), nil
+	}
+	return nil, fmt.Errorf("unknown mail driver '%v'", config.Driver)
+}
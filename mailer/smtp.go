@@ -0,0 +1,45 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"strings"
+)
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSmtpMailer(host string, port int, username, password, from string) Mailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &smtpMailer{fmt.Sprintf("%v:%v", host, port), auth, from}
+}
+
+func (m *smtpMailer) Send(msg Message) error {
+	err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, format(m.from, msg))
+	if err != nil {
+		log.Printf("error sending mail '%v' to %v\n%v", msg.Subject, msg.To, err)
+	}
+	return err
+}
+
+// Formats a message as RFC 5322 text with CRLF line endings. Line breaks are
+// removed from header values so they cannot inject headers
+func format(from string, msg Message) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+	headers := []string{
+		"From: " + header.Replace(from),
+		"To: " + header.Replace(msg.To),
+		"Subject: " + header.Replace(msg.Subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	body := strings.Replace(msg.Body, "\n", "\r\n", -1)
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + body + "\r\n")
+}
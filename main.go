@@ -1,19 +1,30 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 
+	"github.com/duo-labs/webauthn/webauthn"
 	"github.com/gorilla/mux"
 	"github.com/spf13/viper"
 
 	"github.com/crowdpower/fund/controllers"
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/funding"
+	"github.com/crowdpower/fund/keys"
+	"github.com/crowdpower/fund/mailer"
 	"github.com/crowdpower/fund/server"
 	"github.com/crowdpower/fund/storage"
+	"github.com/crowdpower/fund/webhook"
 )
 
 func main() {
+	makeAdmin := flag.String("make-admin", "", "make an existing user an admin and exit, to set up the first admin")
+	flag.Parse()
+
 	getConfig()
 
 	databaseType := viper.GetString("database.type")
@@ -24,18 +35,104 @@ func main() {
 	key := viper.GetString("server.key")
 	jwtSecret := viper.GetString("server.jwtSecret")
 	allowedOrigins := viper.GetStringSlice("server.allowedOrigins")
+	frontendUrl := viper.GetString("server.frontendUrl")
+
+	var keyConfigs []keys.Config
+	err := viper.UnmarshalKey("server.keys", &keyConfigs)
+	if err != nil {
+		log.Fatalf("error reading signing key config\n%v", err)
+	}
+
+	keySet, err := keys.Load(keyConfigs, jwtSecret)
+	if err != nil {
+		log.Fatalf("error loading signing keys\n%v", err)
+	}
 
-	db, err := storage.GetDB(databaseType, databasePath)
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: viper.GetString("webauthn.rpDisplayName"),
+		RPID:          viper.GetString("webauthn.rpId"),
+		RPOrigin:      viper.GetString("webauthn.rpOrigin"),
+	})
 	if err != nil {
-		log.Fatal("error connecting to database\n%v", err)
+		log.Fatalf("error configuring WebAuthn\n%v", err)
+	}
+
+	var mailConfig mailer.Config
+	err = viper.UnmarshalKey("mail", &mailConfig)
+	if err != nil {
+		log.Fatalf("error reading mail config\n%v", err)
+	}
+
+	mail, err := mailer.New(mailConfig)
+	if err != nil {
+		log.Fatalf("error configuring mailer\n%v", err)
+	}
+
+	var webhookConfig webhook.Config
+	err = viper.UnmarshalKey("webhook", &webhookConfig)
+	if err != nil {
+		log.Fatalf("error reading webhook config\n%v", err)
+	}
+
+	webhooks, err := webhook.New(webhookConfig)
+	if err != nil {
+		log.Fatalf("error configuring webhooks\n%v", err)
+	}
+
+	var fundingConfig funding.Config
+	err = viper.UnmarshalKey("funding", &fundingConfig)
+	if err != nil {
+		log.Fatalf("error reading funding config\n%v", err)
+	}
+
+	fundingProvider, err := funding.New(fundingConfig)
+	if err != nil {
+		log.Fatalf("error configuring funding provider\n%v", err)
+	}
+
+	var leaderboardConfig controllers.LeaderboardConfig
+	err = viper.UnmarshalKey("leaderboards", &leaderboardConfig)
+	if err != nil {
+		log.Fatalf("error reading leaderboard config\n%v", err)
+	}
+	if _, ok := leaderboardConfig.Windows[leaderboardConfig.DefaultWindow]; !ok || leaderboardConfig.Size <= 0 {
+		log.Fatalf("leaderboard config needs a size, and a default window that is one of its windows")
+	}
+
+	bus := events.NewBus()
+
+	db, err := storage.GetDB(databaseType, databasePath, bus)
+	if err != nil {
+		log.Fatalf("error connecting to database\n%v", err)
+	}
+
+	if *makeAdmin != "" {
+		err := controllers.BootstrapAdmin(context.Background(), db, *makeAdmin)
+		if err != nil {
+			log.Fatalf("error making user %v an admin\n%v", *makeAdmin, err)
+		}
+		log.Printf("User %v is an admin", *makeAdmin)
+		return
 	}
 
 	r := mux.NewRouter()
-	uc := controllers.NewUserController(db)
-	ac := controllers.NewAuthController(db, jwtSecret)
+	uc := controllers.NewUserController(db, keySet, mail, frontendUrl)
+	ac := controllers.NewAuthController(db, keySet, webAuthn, mail, bus)
 	dc := controllers.NewDepositController(db)
-	pc := controllers.NewPaymentController(db)
-	server.Route(r.PathPrefix("/v1").Subrouter(), uc, ac, dc, pc)
+	pc := controllers.NewPaymentController(db, bus)
+	tc := controllers.NewTwoFactorController(db)
+	suc := controllers.NewSupporterController(db, leaderboardConfig)
+	sc := controllers.NewSiteController(db, suc)
+	adc := controllers.NewAdminController(db)
+	auc := controllers.NewAuditController(db)
+	ec := controllers.NewExportController(db, keySet)
+	stc := controllers.NewStatementController(db)
+	evc := controllers.NewEventController(db, bus)
+	alc := controllers.NewAlertController(db, bus, mail, fundingProvider)
+	nc := controllers.NewNotificationController(db, bus, mail, webhooks)
+	server.Route(r.PathPrefix("/v1").Subrouter(), uc, ac, dc, pc, tc, sc, adc, ec, stc, evc, alc, nc, suc)
+	server.RouteAdmin(r.PathPrefix("/v1/admin").Subrouter(), ac, dc, pc, adc, auc)
+	server.RouteWellKnown(r, ac)
 
 	log.Printf("Listening on port %v", port)
 	log.Fatal(http.ListenAndServeTLS(":"+port, cert, key, corsMiddleware(r, allowedOrigins)))
@@ -68,7 +165,8 @@ func corsMiddleware(h http.Handler, allowedOrigins []string) http.Handler {
 			return
 		}
 		w.Header().Set("Access-Control-Allow-Origin", origin)
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Password")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Password, Device, Totp, Recovery-Code")
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After, Content-Disposition")
 		if r.Method == "OPTIONS" {
 			return
 		}
@@ -0,0 +1,16 @@
+package models
+
+import (
+	"time"
+)
+
+// A correction to a user's balance made by an admin, positive to credit the
+// user and negative to debit them. Admin is the username of the admin
+type Adjustment struct {
+	Id       string    `json:"id"`
+	Username string    `json:"username"`
+	Amount   int       `json:"amount"`
+	Reason   string    `json:"reason"`
+	Admin    string    `json:"admin"`
+	Time     time.Time `json:"time"`
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+)
+
+// What happens when a user's balance drops below Threshold: a low balance
+// event, an email if Email is set, and if TopUpAmount isn't 0, a deposit of
+// TopUpAmount taken through the funding provider. Top-ups stop once they
+// would take the total topped up in the calendar month, in UTC, above
+// TopUpCap. ToppedUp is that total so far this month
+type BalanceAlert struct {
+	Username    string `json:"-"`
+	Threshold   int    `json:"threshold"`
+	Email       bool   `json:"email"`
+	TopUpAmount int    `json:"topUpAmount"`
+	TopUpCap    int    `json:"topUpCap"`
+	ToppedUp    int    `json:"toppedUp"`
+}
+
+// A top-up is pending while the card is being charged, and settled once its
+// deposit has been made. A charged top-up was paid for but its deposit
+// couldn't be made, and needs putting right by hand
+const (
+	TopUpPending = "pending"
+	TopUpCharged = "charged"
+	TopUpSettled = "settled"
+	TopUpFailed  = "failed"
+)
+
+// A deposit made automatically when the user's balance ran low. Id is the id
+// of the deposit once settled, Reference the funding provider's reference for
+// the charge
+type TopUp struct {
+	Id        string    `json:"id"`
+	Username  string    `json:"username"`
+	Amount    int       `json:"amount"`
+	Reference string    `json:"reference"`
+	Status    string    `json:"status"`
+	Time      time.Time `json:"time"`
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/crowdpower/fund/utils"
+)
+
+// An entry in the audit log of sensitive actions. Actor is the user who acted,
+// empty if they weren't logged in, and Target the user whose account was
+// acted on. Before and After hold what changed, as JSON. Each entry's Hash
+// covers the entry and the hash of the one before it, so editing, removing or
+// reordering entries breaks the chain
+type AuditEntry struct {
+	Seq       int64           `json:"seq"`
+	Time      time.Time       `json:"time"`
+	Actor     string          `json:"actor"`
+	Session   string          `json:"session,omitempty"`
+	Action    string          `json:"action"`
+	Target    string          `json:"target"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Ip        string          `json:"ip"`
+	UserAgent string          `json:"userAgent"`
+	PrevHash  string          `json:"prevHash"`
+	Hash      string          `json:"hash"`
+}
+
+type AuditArgs struct {
+	Actor  string    `query:"actor"`
+	Target string    `query:"target"`
+	Action string    `query:"action"`
+	Oldest time.Time `query:"oldest"`
+	Newest time.Time `query:"newest"`
+	// the seq of the last entry of the previous page
+	After int `query:"after"`
+	Count int `query:"count"`
+}
+
+// The result of checking the audit log's hash chain. FirstInvalid is the seq
+// of the first entry that doesn't match its hash or its predecessor
+type AuditVerification struct {
+	Valid        bool  `json:"valid"`
+	Entries      int   `json:"entries"`
+	FirstInvalid int64 `json:"firstInvalid,omitempty"`
+}
+
+// Returns the hash the entry should have, given PrevHash
+func (e *AuditEntry) ComputeHash() string {
+	content, _ := json.Marshal([]interface{}{
+		utils.SqlTime(e.Time), e.Actor, e.Session, e.Action, e.Target,
+		string(e.Before), string(e.After), e.Ip, e.UserAgent,
+	})
+	sum := sha256.Sum256(append([]byte(e.PrevHash+"\n"), content...))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/crowdpower/fund/utils"
+)
+
+// A long lived access token a user mints for a browser extension, which can
+// only pay the listed domains (and their subdomains) up to SpendCap in total.
+// Each delegation has a session of its own, and Id is the session's id
+type Delegation struct {
+	Id       string    `json:"id"`
+	Username string    `json:"-"`
+	Name     string    `json:"name"`
+	Domains  []string  `json:"domains"`
+	Scope    string    `json:"scope"`
+	SpendCap int       `json:"spendCap"`
+	Spent    int       `json:"spent"`
+	Expires  time.Time `json:"expires"`
+	Created  time.Time `json:"created"`
+	// only sent when the delegation is created
+	Token string `json:"token,omitempty"`
+}
+
+func (d *Delegation) AllowsDomain(domain string) bool {
+	for _, allowed := range d.Domains {
+		if utils.InDomain(domain, allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,20 +2,41 @@ package models
 
 import (
 	"time"
+
+	"github.com/crowdpower/fund/utils"
 )
 
 type Deposit struct {
-	Id       string `json:"id"`
-	Username string `json:"username"`
-	Amount   int    `json:"amount"`
-	Time     string `json:"time"`
+	Id       string    `json:"id"`
+	Username string    `json:"username"`
+	Amount   int       `json:"amount"`
+	Time     time.Time `json:"time"`
 }
 
 type DepositArgs struct {
-	Oldest    time.Time `query:"oldest"`
-	Newest    time.Time `query:"newest"`
-	MinAmount int       `query:"minamount"`
-	MaxAmount int       `query:"maxamount"`
-	Offset    int       `query:"offset"`
-	Count     int       `query:"count"`
+	Ids       []string     `query:"id"`
+	Oldest    time.Time    `query:"oldest"`
+	Newest    time.Time    `query:"newest"`
+	MinAmount *int         `query:"minamount"`
+	MaxAmount *int         `query:"maxamount"`
+	Sort      string       `query:"sort"`
+	Order     string       `query:"order"`
+	Cursor    utils.Cursor `query:"cursor"`
+	Count     int          `query:"count"`
+
+	// Deprecated: use Cursor. Ignored when a cursor is given
+	Offset int `query:"offset"`
+}
+
+// Returns the cursor for the page after this deposit in a listing sorted as
+// requested by args
+func (d *Deposit) Cursor(args *DepositArgs) utils.Cursor {
+	c := utils.Cursor{Sort: args.Sort, Order: args.Order, Id: d.Id}
+	switch args.Sort {
+	case SortAmount:
+		c.Value = d.Amount
+	default:
+		c.Value = utils.SqlTime(d.Time)
+	}
+	return c
 }
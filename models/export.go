@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// An archive of everything held about a user, built in the background. Once
+// ready it can be downloaded from Url until Expires, through a link that
+// itself only works for a short while
+type Export struct {
+	Id        string     `json:"id"`
+	Username  string     `json:"-"`
+	Status    string     `json:"status"`
+	Created   time.Time  `json:"created"`
+	Completed *time.Time `json:"completed,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Size      int        `json:"size,omitempty"`
+	Url       string     `json:"url,omitempty"`
+}
@@ -0,0 +1,26 @@
+package models
+
+// Fields and directions that deposit and payment listings can be sorted by
+const (
+	SortTime   = "time"
+	SortAmount = "amount"
+	SortUrl    = "url"
+
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+// How the url filter on payment listings is matched
+const (
+	UrlMatchContains = "contains"
+	UrlMatchExact    = "exact"
+)
+
+// Keys payments can be grouped by when aggregating. Periods are in UTC
+const (
+	GroupDomain = "domain"
+	GroupUrl    = "url"
+	GroupDay    = "day"
+	GroupWeek   = "week"
+	GroupMonth  = "month"
+)
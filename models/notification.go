@@ -0,0 +1,58 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Kinds of notification
+const (
+	NotificationPaymentFailed = "payment_failed"
+	NotificationDeposit       = "deposit"
+	NotificationLogin         = "login"
+)
+
+// Where each kind of notification goes until the user says otherwise
+var NotificationDefaults = map[string]NotificationPreference{
+	NotificationPaymentFailed: {Kind: NotificationPaymentFailed, Inbox: true, Email: true},
+	NotificationDeposit:       {Kind: NotificationDeposit, Inbox: true},
+	NotificationLogin:         {Kind: NotificationLogin, Inbox: true, Email: true},
+}
+
+// Something a user is told about. Data holds the details of what happened,
+// as JSON. Read is when the user marked it read in their inbox
+type Notification struct {
+	Id       string          `json:"id"`
+	Username string          `json:"-"`
+	Kind     string          `json:"kind"`
+	Title    string          `json:"title"`
+	Body     string          `json:"body"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	Created  time.Time       `json:"created"`
+	Read     *time.Time      `json:"read"`
+}
+
+type NotificationArgs struct {
+	// "read" or "unread", or empty for both
+	Status string    `query:"status"`
+	Newest time.Time `query:"newest"`
+	Count  int       `query:"count"`
+}
+
+// Which channels a kind of notification is delivered through
+type NotificationPreference struct {
+	Username string `json:"-"`
+	Kind     string `json:"kind"`
+	Inbox    bool   `json:"inbox"`
+	Email    bool   `json:"email"`
+	Webhook  bool   `json:"webhook"`
+}
+
+// Where a user's webhook notifications are POSTed. Secret signs each one, and
+// is only sent to the user when the webhook is set
+type NotificationWebhook struct {
+	Username string    `json:"-"`
+	Url      string    `json:"url"`
+	Secret   string    `json:"secret,omitempty"`
+	Created  time.Time `json:"created"`
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"time"
+)
+
+// What a token may do. Tokens without a scope come from a user logging in
+// themselves, and have every scope
+const (
+	ScopeProfile        = "profile"
+	ScopeDepositsRead   = "deposits:read"
+	ScopeDepositsCreate = "deposits:create"
+	ScopePaymentsRead   = "payments:read"
+	ScopePaymentsCreate = "payments:create"
+	ScopeStatementsRead = "statements:read"
+	// managing the account itself: changing or deleting it, its sessions,
+	// passkeys, two-factor authentication and app access. Never granted to
+	// apps or delegated tokens
+	ScopeAccountAdmin = "account:admin"
+)
+
+// The scopes that can be granted to apps and delegated tokens, and what each
+// allows, shown to users when an app asks for it
+var ScopeDescriptions = map[string]string{
+	ScopeProfile:        "See your username, email address and balance",
+	ScopeDepositsRead:   "See your deposits",
+	ScopeDepositsCreate: "Add funds to your balance",
+	ScopePaymentsRead:   "See your payments",
+	ScopePaymentsCreate: "Make payments from your balance",
+	ScopeStatementsRead: "See your monthly statements",
+}
+
+// An app registered to act on users' behalf. Public clients, such as browser
+// extensions, can't keep a secret and are only authenticated by PKCE. Secret
+// is only sent when a confidential client is registered
+type OAuthClient struct {
+	Id           string    `json:"id"`
+	Username     string    `json:"-"`
+	Name         string    `json:"name"`
+	RedirectUris []string  `json:"redirectUris"`
+	Confidential bool      `json:"confidential"`
+	Secret       string    `json:"secret,omitempty"`
+	SecretHash   string    `json:"-"`
+	Created      time.Time `json:"created"`
+}
+
+// An authorization code waiting to be exchanged for tokens. Code is the hash
+// of the code given to the client
+type OAuthCode struct {
+	Code          string
+	ClientId      string
+	Username      string
+	RedirectUri   string
+	Scope         string
+	CodeChallenge string
+	Expires       time.Time
+}
+
+// An authorization request, from the query string of the consent screen and
+// the body of the user's answer
+type OAuthAuthorizeArgs struct {
+	ResponseType        string `query:"response_type" json:"responseType"`
+	ClientId            string `query:"client_id" json:"clientId"`
+	RedirectUri         string `query:"redirect_uri" json:"redirectUri"`
+	Scope               string `query:"scope" json:"scope"`
+	State               string `query:"state" json:"state"`
+	CodeChallenge       string `query:"code_challenge" json:"codeChallenge"`
+	CodeChallengeMethod string `query:"code_challenge_method" json:"codeChallengeMethod"`
+	Approve             bool   `query:"-" json:"approve"`
+}
+
+type OAuthScope struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// What the consent screen shows the user
+type OAuthConsent struct {
+	ClientId    string       `json:"clientId"`
+	ClientName  string       `json:"clientName"`
+	RedirectUri string       `json:"redirectUri"`
+	Scopes      []OAuthScope `json:"scopes"`
+	State       string       `json:"state,omitempty"`
+}
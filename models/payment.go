@@ -2,22 +2,54 @@ package models
 
 import (
 	"time"
+
+	"github.com/crowdpower/fund/utils"
 )
 
 type Payment struct {
-	Id       string `json:"id"`
-	Username string `json:"username"`
-	Amount   int    `json:"amount"`
-	Time     string `json:"time"`
-	Url      string `json:"url"`
+	Id       string    `json:"id"`
+	Username string    `json:"username"`
+	Amount   int       `json:"amount"`
+	Time     time.Time `json:"time"`
+	Url      string    `json:"url"`
 }
 
 type PaymentArgs struct {
-	Oldest    time.Time `query:"oldest"`
-	Newest    time.Time `query:"newest"`
-	MinAmount int       `query:"minamount"`
-	MaxAmount int       `query:"maxamount"`
-	Url       string    `query:"url"`
-	Offset    int       `query:"offset"`
-	Count     int       `query:"count"`
+	Ids       []string     `query:"id"`
+	Oldest    time.Time    `query:"oldest"`
+	Newest    time.Time    `query:"newest"`
+	MinAmount *int         `query:"minamount"`
+	MaxAmount *int         `query:"maxamount"`
+	Url       *string      `query:"url"`
+	UrlMatch  string       `query:"urlmatch"`
+	Sort      string       `query:"sort"`
+	Order     string       `query:"order"`
+	Cursor    utils.Cursor `query:"cursor"`
+	Count     int          `query:"count"`
+
+	// Deprecated: use Cursor. Ignored when a cursor is given
+	Offset int `query:"offset"`
+}
+
+// Returns the cursor for the page after this payment in a listing sorted as
+// requested by args
+func (p *Payment) Cursor(args *PaymentArgs) utils.Cursor {
+	c := utils.Cursor{Sort: args.Sort, Order: args.Order, Id: p.Id}
+	switch args.Sort {
+	case SortAmount:
+		c.Value = p.Amount
+	case SortUrl:
+		c.Value = p.Url
+	default:
+		c.Value = utils.SqlTime(p.Time)
+	}
+	return c
+}
+
+// The total and number of payments sharing a group key, e.g. a domain, or
+// the first day of a day, week or month period
+type PaymentAggregate struct {
+	Key   string `json:"key"`
+	Sum   int    `json:"sum"`
+	Count int    `json:"count"`
 }
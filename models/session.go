@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+// A login from one device. Every refresh token belongs to a session, as do
+// the access tokens issued from it, and revoking the session revokes them all.
+// Refresh tokens are single use: RefreshId is the id of the only one of the
+// session's refresh tokens that is still valid. Sessions granted to
+// third-party apps have the app's ClientId, and are limited to Scope
+type Session struct {
+	Id          string    `json:"id"`
+	Username    string    `json:"-"`
+	RefreshId   string    `json:"-"`
+	Device      string    `json:"device"`
+	UserAgent   string    `json:"userAgent"`
+	Ip          string    `json:"ip"`
+	ClientId    string    `json:"clientId,omitempty"`
+	Scope       string    `json:"scope,omitempty"`
+	Created     time.Time `json:"created"`
+	LastUsed    time.Time `json:"lastUsed"`
+	Revoked     bool      `json:"revoked"`
+	Compromised bool      `json:"compromised"`
+	Current     bool      `json:"current"`
+}
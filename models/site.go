@@ -0,0 +1,64 @@
+package models
+
+import (
+	"time"
+)
+
+// What a site's API keys may do
+const (
+	SiteScopeSiteRead         = "site:read"
+	SiteScopeEntitlementsRead = "entitlements:read"
+)
+
+var SiteScopeDescriptions = map[string]string{
+	SiteScopeSiteRead:         "See the site's details",
+	SiteScopeEntitlementsRead: "Check what users have paid the site",
+}
+
+// A website registered by its owner to call the API with keys. A site must
+// prove it controls Domain, with a DNS TXT record holding VerificationToken,
+// before its keys can see what users have paid it
+type Site struct {
+	Id                string    `json:"id"`
+	Username          string    `json:"-"`
+	Name              string    `json:"name"`
+	Domain            string    `json:"domain"`
+	VerificationToken string    `json:"verificationToken,omitempty"`
+	Verified          bool      `json:"verified"`
+	Created           time.Time `json:"created"`
+}
+
+// A key a site authenticates with. Keys look like fund_<prefix>_<secret>;
+// only the prefix is kept in the clear, to identify the key. Key is only sent
+// when the key is created
+type ApiKey struct {
+	Id       string     `json:"id"`
+	SiteId   string     `json:"siteId"`
+	Name     string     `json:"name"`
+	Prefix   string     `json:"prefix"`
+	Hash     string     `json:"-"`
+	Scope    string     `json:"scope"`
+	Created  time.Time  `json:"created"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	// set on keys that have been rotated, which keep working for a while so
+	// the site can switch over
+	Expires *time.Time `json:"expires,omitempty"`
+	Revoked bool       `json:"revoked"`
+	Key     string     `json:"key,omitempty"`
+}
+
+// Whether username has paid the site, optionally for one url or since a time
+type EntitlementArgs struct {
+	Username string    `query:"username"`
+	Url      *string   `query:"url"`
+	Since    time.Time `query:"since"`
+}
+
+type Entitlement struct {
+	Username string `json:"username"`
+	Domain   string `json:"domain"`
+	Url      string `json:"url,omitempty"`
+	Paid     int    `json:"paid"`
+	Payments int    `json:"payments"`
+	Entitled bool   `json:"entitled"`
+}
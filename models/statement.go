@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+const StatementMonthFormat = "2006-01"
+
+// A summary of a user's account over a calendar month in UTC, from Start up
+// to but not including End. Adjustments are the refunds and other
+// corrections admins made in the month. Statements of months that have
+// closed don't change, and are kept once generated
+type Statement struct {
+	Username         string             `json:"username"`
+	Month            string             `json:"month"`
+	Start            time.Time          `json:"start"`
+	End              time.Time          `json:"end"`
+	OpeningBalance   int                `json:"openingBalance"`
+	Deposits         int                `json:"deposits"`
+	DepositCount     int                `json:"depositCount"`
+	Payments         int                `json:"payments"`
+	PaymentCount     int                `json:"paymentCount"`
+	PaymentsBySite   []PaymentAggregate `json:"paymentsBySite"`
+	Adjustments      []Adjustment       `json:"adjustments"`
+	AdjustmentsTotal int                `json:"adjustmentsTotal"`
+	ClosingBalance   int                `json:"closingBalance"`
+	Closed           bool               `json:"closed"`
+	Generated        time.Time          `json:"generated"`
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+)
+
+// A user's opt-in public face, shown on the supporter lists and leaderboards
+// of the sites they choose, among those they've paid. It never shows the
+// username. The amounts a user has paid are only shown if ShowAmounts is set
+type PublicProfile struct {
+	Id          string    `json:"id"`
+	Username    string    `json:"-"`
+	DisplayName string    `json:"displayName"`
+	Bio         string    `json:"bio"`
+	ShowAmounts bool      `json:"showAmounts"`
+	Created     time.Time `json:"created"`
+}
+
+// A site whose lists a user has chosen to appear on. Id is the user's id on
+// that site's lists, and no other site's
+type SupporterSite struct {
+	Id       string    `json:"id"`
+	Username string    `json:"-"`
+	SiteId   string    `json:"siteId"`
+	Created  time.Time `json:"created"`
+}
+
+// A user with a public profile who has paid a site and chosen to appear on
+// its lists. Id is their SupporterSite's. Total is left out unless the user
+// chose to show amounts
+type Supporter struct {
+	Rank        int    `json:"rank,omitempty"`
+	Id          string `json:"id"`
+	DisplayName string `json:"displayName"`
+	Total       int    `json:"total,omitempty"`
+	ShowAmounts bool   `json:"-"`
+}
+
+// The supporters of a site over a window, from Since until now. Since is nil
+// for all time
+type SupporterList struct {
+	Site       string      `json:"site"`
+	Domain     string      `json:"domain"`
+	Window     string      `json:"window"`
+	Since      *time.Time  `json:"since"`
+	Supporters []Supporter `json:"supporters"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// Failed login attempts against a username or from an IP address. Kind is
+// "user" or "ip", and Subject the username or address
+type LoginThrottle struct {
+	Kind        string
+	Subject     string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
@@ -0,0 +1,20 @@
+package models
+
+// A user's TOTP secret. The secret only protects logins once Enabled, which
+// happens when the user confirms enrolment with a code from their app
+type TwoFactor struct {
+	Username string `json:"-"`
+	Secret   string `json:"-"`
+	Enabled  bool   `json:"enabled"`
+	// the last TOTP time step a code was accepted for, so codes are single use
+	LastStep int64 `json:"-"`
+}
+
+type TwoFactorEnrolment struct {
+	Secret          string `json:"secret"`
+	ProvisioningUri string `json:"provisioningUri"`
+}
+
+type TwoFactorCode struct {
+	Code string `json:"code"`
+}
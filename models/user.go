@@ -1,9 +1,34 @@
 package models
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Role and Frozen can only be changed by admins. A frozen account can't make
+// deposits or payments. Deleted users are the anonymised remains of deleted
+// accounts, kept for their ledger rows
 type User struct {
-	Username          string `json:"username"`
-	Password          string `json:"password,omitempty"`
-	Email             string `json:"email"`
-	Balance           int    `json:"balance"`
-	InvalidatedTokens bool   `json:"-"`
+	Username      string `json:"username"`
+	Password      string `json:"password,omitempty"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	Role          string `json:"role"`
+	Frozen        bool   `json:"frozen"`
+	Deleted       bool   `json:"deleted"`
+	Balance       int    `json:"balance"`
+}
+
+// Searches users by a part of their username or email, in username order
+type UserSearchArgs struct {
+	Query string `query:"q"`
+	After string `query:"after"`
+	Count int    `query:"count"`
+}
+
+// Sent to confirm an email address or reset a forgotten password, with the
+// token from the link emailed to the user
+type UserToken struct {
+	Token    string `json:"token"`
+	Password string `json:"password,omitempty"`
 }
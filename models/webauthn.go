@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+// A passkey registered by a user. Id is the base64url encoded credential id
+type WebAuthnCredential struct {
+	Id              string    `json:"id"`
+	Username        string    `json:"-"`
+	Name            string    `json:"name"`
+	PublicKey       []byte    `json:"-"`
+	AttestationType string    `json:"-"`
+	Aaguid          []byte    `json:"-"`
+	SignCount       uint32    `json:"-"`
+	Created         time.Time `json:"created"`
+	LastUsed        time.Time `json:"lastUsed"`
+}
+
+// The state kept between the begin and finish steps of a registration or
+// login ceremony. Data is the JSON encoded session data of the WebAuthn library
+type WebAuthnChallenge struct {
+	Username string
+	Ceremony string
+	Data     []byte
+	Expires  time.Time
+}
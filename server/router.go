@@ -6,6 +6,7 @@ import (
 	"github.com/gorilla/mux"
 
 	"github.com/crowdpower/fund/controllers"
+	"github.com/crowdpower/fund/models"
 )
 
 func Route(
@@ -13,7 +14,16 @@ func Route(
 	user controllers.UserController,
 	auth controllers.AuthController,
 	deposit controllers.DepositController,
-	payment controllers.PaymentController) {
+	payment controllers.PaymentController,
+	twoFactor controllers.TwoFactorController,
+	site controllers.SiteController,
+	admin controllers.AdminController,
+	export controllers.ExportController,
+	statement controllers.StatementController,
+	event controllers.EventController,
+	alert controllers.AlertController,
+	notification controllers.NotificationController,
+	supporter controllers.SupporterController) {
 
 	r.HandleFunc("/health",
 		GetHealth,
@@ -24,34 +34,217 @@ func Route(
 	r.HandleFunc("/users/exists",
 		user.GetUserExists).Methods(http.MethodGet)
 	r.HandleFunc("/users/{username}",
-		auth.Wrapper(controllers.AccessTokenType, user.GetUser)).Methods(http.MethodGet)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeProfile, user.GetUser)).Methods(http.MethodGet)
 	r.HandleFunc("/users/{username}",
-		auth.Wrapper(controllers.AccessTokenType, user.PutUser)).Methods(http.MethodPut)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, user.PutUser)).Methods(http.MethodPut)
 	r.HandleFunc("/users/{username}",
-		auth.Wrapper(controllers.AccessTokenType, user.DeleteUser)).Methods(http.MethodDelete)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, user.DeleteUser)).Methods(http.MethodDelete)
+	r.HandleFunc("/users/{username}/verification",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, user.PostVerification)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/verification/confirm",
+		user.PostVerificationConfirm).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/password/reset",
+		user.PostPasswordReset).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/password/reset/confirm",
+		user.PostPasswordResetConfirm).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/events",
+		controllers.QueryTokenWrapper(auth.Wrapper(controllers.AccessTokenType, models.ScopeProfile, event.GetEvents))).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/alerts/balance",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeProfile, alert.GetBalanceAlert)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/alerts/balance",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, alert.PutBalanceAlert)).Methods(http.MethodPut)
+	r.HandleFunc("/users/{username}/alerts/balance",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, alert.DeleteBalanceAlert)).Methods(http.MethodDelete)
+	r.HandleFunc("/users/{username}/topups",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeDepositsRead, alert.GetTopUps)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/notifications",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, notification.GetNotifications)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/notifications/read",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, notification.PostNotificationsRead)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/notifications/preferences",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, notification.GetNotificationPreferences)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/notifications/preferences",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, notification.PutNotificationPreferences)).Methods(http.MethodPut)
+	r.HandleFunc("/users/{username}/notifications/webhook",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, notification.GetNotificationWebhook)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/notifications/webhook",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, notification.PutNotificationWebhook)).Methods(http.MethodPut)
+	r.HandleFunc("/users/{username}/notifications/webhook",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, notification.DeleteNotificationWebhook)).Methods(http.MethodDelete)
+	r.HandleFunc("/users/{username}/notifications/{id}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, notification.DeleteNotification)).Methods(http.MethodDelete)
+	r.HandleFunc("/users/{username}/notifications/{id}/read",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, notification.PutNotificationRead)).Methods(http.MethodPut)
+	r.HandleFunc("/users/{username}/statements/{month}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeStatementsRead, statement.GetStatement)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/exports",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, export.PostExport)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/exports",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, export.GetExports)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/exports/{id}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, export.GetExport)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/exports/{id}/archive",
+		export.GetExportArchive).Methods(http.MethodGet)
 
 	r.HandleFunc("/users/{username}/authorize",
 		auth.GetRefreshToken).Methods(http.MethodGet)
 	r.HandleFunc("/users/{username}/token",
-		auth.Wrapper(controllers.RefreshTokenType, auth.GetAuthToken)).Methods(http.MethodGet)
+		auth.Wrapper(controllers.RefreshTokenType, "", auth.GetAuthToken)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/sessions",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.GetSessions)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/sessions",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.DeleteSessions)).Methods(http.MethodDelete)
+	r.HandleFunc("/users/{username}/sessions/{id}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.DeleteSession)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/users/{username}/webauthn/login/begin",
+		auth.PostWebAuthnLoginBegin).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/webauthn/login/finish",
+		auth.PostWebAuthnLoginFinish).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/webauthn/register/begin",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.PostWebAuthnRegisterBegin)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/webauthn/register/finish",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.PostWebAuthnRegisterFinish)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/webauthn/credentials",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.GetWebAuthnCredentials)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/webauthn/credentials/{id}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.DeleteWebAuthnCredential)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/oauth/authorize",
+		auth.GetOAuthAuthorize).Methods(http.MethodGet)
+	r.HandleFunc("/oauth/token",
+		auth.PostOAuthToken).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/oauth/authorize",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.PostOAuthAuthorize)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/oauth/clients",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.PostOAuthClient)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/oauth/clients",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.GetOAuthClients)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/oauth/clients/{id}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.DeleteOAuthClient)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/users/{username}/delegations",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.PostDelegation)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/delegations",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.GetDelegations)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/delegations/{id}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, auth.DeleteDelegation)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/users/{username}/sites",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, site.PostSite)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/sites",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, site.GetSites)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/sites/{site}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, site.DeleteSite)).Methods(http.MethodDelete)
+	r.HandleFunc("/users/{username}/sites/{site}/verification",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, site.PostSiteVerification)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/sites/{site}/keys",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, site.PostApiKey)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/sites/{site}/keys",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, site.GetApiKeys)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/sites/{site}/keys/{id}/rotate",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, site.PostApiKeyRotation)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/sites/{site}/keys/{id}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, site.DeleteApiKey)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/users/{username}/public-profile",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeProfile, supporter.GetPublicProfile)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/public-profile",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, supporter.PutPublicProfile)).Methods(http.MethodPut)
+	r.HandleFunc("/users/{username}/public-profile",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, supporter.DeletePublicProfile)).Methods(http.MethodDelete)
+	r.HandleFunc("/users/{username}/public-profile/sites",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeProfile, supporter.GetSupporterSites)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/public-profile/sites/{site}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, supporter.PutSupporterSite)).Methods(http.MethodPut)
+	r.HandleFunc("/users/{username}/public-profile/sites/{site}",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, supporter.DeleteSupporterSite)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/sites/{site}",
+		site.Wrapper(models.SiteScopeSiteRead, site.GetSite)).Methods(http.MethodGet)
+	r.HandleFunc("/sites/{site}/entitlements",
+		site.Wrapper(models.SiteScopeEntitlementsRead, site.GetEntitlement)).Methods(http.MethodGet)
+	r.HandleFunc("/sites/{site}/supporters",
+		supporter.GetSupporters).Methods(http.MethodGet)
+	r.HandleFunc("/sites/{site}/supporters/{id}",
+		supporter.GetSupporterProfile).Methods(http.MethodGet)
+	r.HandleFunc("/sites/{site}/leaderboard",
+		supporter.GetLeaderboard).Methods(http.MethodGet)
+
+	r.HandleFunc("/users/{username}/2fa",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, twoFactor.PostTwoFactor)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/2fa/confirm",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, twoFactor.PostTwoFactorConfirm)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/2fa",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeAccountAdmin, twoFactor.DeleteTwoFactor)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/users/{username}/adjustments",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeProfile, admin.GetAdjustments)).Methods(http.MethodGet)
 
 	r.HandleFunc("/users/{username}/deposit",
-		auth.Wrapper(controllers.AccessTokenType, deposit.PostDeposit)).Methods(http.MethodPost)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeDepositsCreate, deposit.PostDeposit)).Methods(http.MethodPost)
 	r.HandleFunc("/users/{username}/deposit",
-		auth.Wrapper(controllers.AccessTokenType, deposit.GetDeposit)).Methods(http.MethodGet)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeDepositsRead, deposit.GetDeposit)).Methods(http.MethodGet)
 	r.HandleFunc("/users/{username}/deposits",
-		auth.Wrapper(controllers.AccessTokenType, deposit.GetDeposits)).Methods(http.MethodGet)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeDepositsRead, deposit.GetDeposits)).Methods(http.MethodGet)
 	r.HandleFunc("/users/{username}/deposits/sum",
-		auth.Wrapper(controllers.AccessTokenType, deposit.GetDepositsSum)).Methods(http.MethodGet)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopeDepositsRead, deposit.GetDepositsSum)).Methods(http.MethodGet)
 
 	r.HandleFunc("/users/{username}/payment",
-		auth.Wrapper(controllers.AccessTokenType, payment.PostPayment)).Methods(http.MethodPost)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopePaymentsCreate, payment.PostPayment)).Methods(http.MethodPost)
 	r.HandleFunc("/users/{username}/payment",
-		auth.Wrapper(controllers.AccessTokenType, payment.GetPayment)).Methods(http.MethodGet)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopePaymentsRead, payment.GetPayment)).Methods(http.MethodGet)
 	r.HandleFunc("/users/{username}/payments",
-		auth.Wrapper(controllers.AccessTokenType, payment.GetPayments)).Methods(http.MethodGet)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopePaymentsRead, payment.GetPayments)).Methods(http.MethodGet)
 	r.HandleFunc("/users/{username}/payments/sum",
-		auth.Wrapper(controllers.AccessTokenType, payment.GetPaymentsSum)).Methods(http.MethodGet)
+		auth.Wrapper(controllers.AccessTokenType, models.ScopePaymentsRead, payment.GetPaymentsSum)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/payments/aggregate",
+		auth.Wrapper(controllers.AccessTokenType, models.ScopePaymentsRead, payment.GetPaymentsAggregate)).Methods(http.MethodGet)
+}
+
+// Routes the admin API, which acts on any user's account. Deposit and payment
+// listings reuse the user facing handlers
+func RouteAdmin(
+	r *mux.Router,
+	auth controllers.AuthController,
+	deposit controllers.DepositController,
+	payment controllers.PaymentController,
+	admin controllers.AdminController,
+	audit controllers.AuditController) {
+
+	r.HandleFunc("/users",
+		auth.AdminWrapper(admin.GetUsers)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}",
+		auth.AdminWrapper(admin.GetUser)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/freeze",
+		auth.AdminWrapper(admin.PostFreeze)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/unfreeze",
+		auth.AdminWrapper(admin.PostUnfreeze)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/role",
+		auth.AdminWrapper(admin.PutRole)).Methods(http.MethodPut)
+	r.HandleFunc("/users/{username}/adjustments",
+		auth.AdminWrapper(admin.PostAdjustment)).Methods(http.MethodPost)
+	r.HandleFunc("/users/{username}/adjustments",
+		auth.AdminWrapper(admin.GetAdjustments)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/deposits",
+		auth.AdminWrapper(deposit.GetDeposits)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/deposit",
+		auth.AdminWrapper(deposit.GetDeposit)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/payments",
+		auth.AdminWrapper(payment.GetPayments)).Methods(http.MethodGet)
+	r.HandleFunc("/users/{username}/payment",
+		auth.AdminWrapper(payment.GetPayment)).Methods(http.MethodGet)
+	r.HandleFunc("/audit",
+		auth.AdminWrapper(audit.GetAuditEntries)).Methods(http.MethodGet)
+	r.HandleFunc("/audit/verify",
+		auth.AdminWrapper(audit.GetAuditVerification)).Methods(http.MethodGet)
+}
+
+// Routes that must be served from the root of the host rather than under the
+// API version prefix
+func RouteWellKnown(r *mux.Router, auth controllers.AuthController) {
+	r.HandleFunc("/.well-known/jwks.json",
+		auth.GetJWKS).Methods(http.MethodGet)
 }
 
 func GetHealth(w http.ResponseWriter, r *http.Request) {
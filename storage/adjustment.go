@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"log"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type adjustment interface {
+	CreateAdjustment(adjustment *models.Adjustment) error
+	GetAdjustments(username string) ([]models.Adjustment, error)
+}
+
+func (d *sqlDb) CreateAdjustment(adjustment *models.Adjustment) error {
+	_, err := d.db.Exec(`
+        INSERT INTO Adjustments (id, username, amount, reason, admin, time) VALUES (?, ?, ?, ?, ?, ?)
+    `, adjustment.Id, adjustment.Username, adjustment.Amount, adjustment.Reason, adjustment.Admin,
+		utils.SqlTime(adjustment.Time))
+	if err != nil {
+		log.Printf("error inserting adjustment %v into the database\n %v", adjustment, err)
+		return err
+	}
+
+	d.publishBalance(adjustment.Username, adjustment.Amount, adjustment.Time)
+	return nil
+}
+
+// Returns every adjustment to a user's balance, newest first
+func (d *sqlDb) GetAdjustments(username string) ([]models.Adjustment, error) {
+	rows, err := d.db.Query(`
+        SELECT id, username, amount, reason, admin, time FROM Adjustments WHERE username = ? ORDER BY time DESC, id DESC
+    `, username)
+	if err != nil {
+		log.Printf("error reading adjustments from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	adjustments := []models.Adjustment{}
+	for rows.Next() {
+		a := models.Adjustment{}
+		err := rows.Scan(&a.Id, &a.Username, &a.Amount, &a.Reason, &a.Admin, utils.ScanTime(&a.Time))
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		adjustments = append(adjustments, a)
+	}
+
+	return adjustments, nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type alert interface {
+	GetBalanceAlert(username string) (*models.BalanceAlert, error)
+	SetBalanceAlert(alert *models.BalanceAlert) error
+	DeleteBalanceAlert(username string) error
+	CreateTopUp(topUp *models.TopUp) error
+	SetTopUpStatus(id, status, reference string) error
+	GetTopUps(username string) ([]models.TopUp, error)
+	GetTopUpsSum(username string, since time.Time) (int, error)
+}
+
+// Returns the user's balance alert, NotFound if they haven't set one. Doesn't
+// fill in ToppedUp
+func (d *sqlDb) GetBalanceAlert(username string) (*models.BalanceAlert, error) {
+	a := &models.BalanceAlert{}
+	err := d.db.QueryRow(`
+        SELECT username, threshold, email, topupamount, topupcap FROM BalanceAlerts WHERE username = ?
+    `, username).Scan(&a.Username, &a.Threshold, &a.Email, &a.TopUpAmount, &a.TopUpCap)
+	if err == sql.ErrNoRows {
+		return nil, &NotFound{"balance alert"}
+	} else if err != nil {
+		log.Printf("error reading balance alert from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	return a, nil
+}
+
+// Sets the user's balance alert, replacing any they had
+func (d *sqlDb) SetBalanceAlert(alert *models.BalanceAlert) error {
+	_, err := d.db.Exec(`
+        INSERT OR REPLACE INTO BalanceAlerts (username, threshold, email, topupamount, topupcap) VALUES (?, ?, ?, ?, ?)
+    `, alert.Username, alert.Threshold, alert.Email, alert.TopUpAmount, alert.TopUpCap)
+	if err != nil {
+		log.Printf("error setting balance alert of user %v\n %v", alert.Username, err)
+	}
+	return err
+}
+
+func (d *sqlDb) DeleteBalanceAlert(username string) error {
+	resp, err := d.db.Exec(`DELETE FROM BalanceAlerts WHERE username = ?`, username)
+	if err != nil {
+		log.Printf("error deleting balance alert of user %v\n %v", username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by delete\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{"balance alert"}
+	}
+
+	return nil
+}
+
+func (d *sqlDb) CreateTopUp(topUp *models.TopUp) error {
+	_, err := d.db.Exec(`
+        INSERT INTO TopUps (id, username, amount, reference, status, time) VALUES (?, ?, ?, ?, ?, ?)
+    `, topUp.Id, topUp.Username, topUp.Amount, topUp.Reference, topUp.Status, utils.SqlTime(topUp.Time))
+	if err != nil {
+		log.Printf("error inserting top-up %v into the database\n %v", topUp, err)
+	}
+	return err
+}
+
+// Moves a top-up on to status, keeping its reference unless reference is set
+func (d *sqlDb) SetTopUpStatus(id, status, reference string) error {
+	resp, err := d.db.Exec(`
+        UPDATE TopUps SET status = ?, reference = COALESCE(NULLIF(?, ''), reference) WHERE id = ?
+    `, status, reference, id)
+	if err != nil {
+		log.Printf("error setting status of top-up %v to %v\n %v", id, status, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by update\n %v", err)
+		return err
+	}
+	if rows == 0 {
+		return &NotFound{"top-up"}
+	}
+
+	return nil
+}
+
+// Returns every top-up of a user, newest first
+func (d *sqlDb) GetTopUps(username string) ([]models.TopUp, error) {
+	rows, err := d.db.Query(`
+        SELECT id, username, amount, reference, status, time FROM TopUps WHERE username = ? ORDER BY time DESC, id DESC
+    `, username)
+	if err != nil {
+		log.Printf("error reading top-ups from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	topUps := []models.TopUp{}
+	for rows.Next() {
+		t := models.TopUp{}
+		err := rows.Scan(&t.Id, &t.Username, &t.Amount, &t.Reference, &t.Status, utils.ScanTime(&t.Time))
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		topUps = append(topUps, t)
+	}
+
+	return topUps, nil
+}
+
+// Returns the total a user has been topped up by since a time, counting top-ups
+// that may yet be, but not ones whose charge failed
+func (d *sqlDb) GetTopUpsSum(username string, since time.Time) (int, error) {
+	var sum int
+	err := d.db.QueryRow(`
+        SELECT COALESCE(SUM(amount), 0) FROM TopUps WHERE username = ? AND time >= ? AND status != ?
+    `, username, utils.SqlTime(since), models.TopUpFailed).Scan(&sum)
+	if err != nil {
+		log.Printf("error reading top-ups sum from database for user %v\n%v", username, err)
+	}
+	return sum, err
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type audit interface {
+	AppendAudit(entry *models.AuditEntry) error
+	GetAuditEntries(args *models.AuditArgs) ([]models.AuditEntry, error)
+	GetAuditKey(username string) ([]byte, error)
+	CreateAuditKey(username string, key []byte) error
+}
+
+// Chains an entry onto the end of the audit log, setting its PrevHash, Hash
+// and Seq. Called on a transaction, the entry is only kept if the transaction
+// commits, so it should be appended alongside the change it records
+func (d *sqlDb) AppendAudit(entry *models.AuditEntry) error {
+	// reading the last hash and appending must not interleave with another
+	// append, so outside of a transaction, start one
+	if d.conn != nil {
+		return d.WithTx(context.Background(), func(tx Tx) error {
+			return tx.AppendAudit(entry)
+		})
+	}
+
+	err := d.db.QueryRow(`
+        SELECT hash FROM AuditLog ORDER BY seq DESC LIMIT 1
+    `).Scan(&entry.PrevHash)
+	if err == sql.ErrNoRows {
+		entry.PrevHash = ""
+	} else if err != nil {
+		log.Printf("error reading last audit log entry\n%v", err)
+		return err
+	}
+	entry.Hash = entry.ComputeHash()
+
+	resp, err := d.db.Exec(`
+        INSERT INTO AuditLog (time, actor, session, action, target, before, after, ip, useragent, prevhash, hash)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, utils.SqlTime(entry.Time), entry.Actor, entry.Session, entry.Action, entry.Target, string(entry.Before),
+		string(entry.After), entry.Ip, entry.UserAgent, entry.PrevHash, entry.Hash)
+	if err != nil {
+		log.Printf("error appending %v by %v to the audit log\n %v", entry.Action, entry.Actor, err)
+		return err
+	}
+
+	entry.Seq, err = resp.LastInsertId()
+	return err
+}
+
+// Returns audit log entries matching args, oldest first
+func (d *sqlDb) GetAuditEntries(auditArgs *models.AuditArgs) ([]models.AuditEntry, error) {
+	whereStatement, args := utils.SqlWhere([]utils.SqlCondition{
+		{"actor", "=", auditArgs.Actor},
+		{"target", "=", auditArgs.Target},
+		{"action", "=", auditArgs.Action},
+		{"time", ">=", auditArgs.Oldest},
+		{"time", "<=", auditArgs.Newest},
+		{"seq", ">", auditArgs.After},
+	})
+	if len(args) == 0 {
+		whereStatement = ""
+	}
+
+	var pagination string
+	if auditArgs.Count != 0 {
+		pagination = fmt.Sprintf("LIMIT %v", auditArgs.Count)
+	}
+
+	rows, err := d.db.Query(`
+        SELECT seq, time, actor, session, action, target, before, after, ip, useragent, prevhash, hash
+        FROM AuditLog `+whereStatement+` ORDER BY seq `+pagination, args...)
+	if err != nil {
+		log.Printf("error reading audit log from database\n%v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []models.AuditEntry{}
+	for rows.Next() {
+		e := models.AuditEntry{}
+		var before, after string
+		err := rows.Scan(&e.Seq, utils.ScanTime(&e.Time), &e.Actor, &e.Session, &e.Action, &e.Target, &before, &after,
+			&e.Ip, &e.UserAgent, &e.PrevHash, &e.Hash)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		if before != "" {
+			e.Before = []byte(before)
+		}
+		if after != "" {
+			e.After = []byte(after)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Returns the key of the user's audit log references, NotFound if they don't
+// have one yet
+func (d *sqlDb) GetAuditKey(username string) ([]byte, error) {
+	var key []byte
+	err := d.db.QueryRow(`
+        SELECT key FROM AuditKeys WHERE username = ?
+    `, username).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil, &NotFound{"audit key"}
+	} else if err != nil {
+		log.Printf("error reading audit key from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	return key, nil
+}
+
+func (d *sqlDb) CreateAuditKey(username string, key []byte) error {
+	_, err := d.db.Exec(`
+        INSERT INTO AuditKeys (username, key) VALUES (?, ?)
+    `, username, key)
+	if err != nil {
+		log.Printf("error inserting audit key of user %v into the database\n %v", username, err)
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+)
+
+// Appends count entries outside of a transaction, and one in a transaction
+// that rolls back
+func appendTestAudit(t *testing.T, d *sqlDb, count int) {
+	for i := 0; i < count; i++ {
+		err := d.AppendAudit(&models.AuditEntry{
+			Time:   time.Now().UTC(),
+			Actor:  "alice",
+			Action: "user.update",
+			Target: "alice",
+			After:  []byte(fmt.Sprintf(`{"change":%v}`, i)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errRollback := errors.New("rollback")
+	err := d.WithTx(context.Background(), func(tx Tx) error {
+		if err := tx.AppendAudit(&models.AuditEntry{Time: time.Now().UTC(), Action: "user.delete"}); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatal(err)
+	}
+}
+
+// Returns the seq of the first entry that doesn't match its hash or its
+// predecessor, 0 if the chain holds
+func verifyTestAudit(t *testing.T, d *sqlDb) int64 {
+	entries, err := d.GetAuditEntries(&models.AuditArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevHash := ""
+	for _, e := range entries {
+		if e.PrevHash != prevHash || e.ComputeHash() != e.Hash {
+			return e.Seq
+		}
+		prevHash = e.Hash
+	}
+	return 0
+}
+
+func TestAppendAudit(t *testing.T) {
+	d := newTestDB(t)
+	appendTestAudit(t, d, 5)
+
+	entries, err := d.GetAuditEntries(&models.AuditArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("audit log has %v entries, want 5", len(entries))
+	}
+	for _, e := range entries {
+		if e.Action != "user.update" {
+			t.Fatalf("audit log has a %v entry from a rolled back transaction", e.Action)
+		}
+	}
+	if invalid := verifyTestAudit(t, d); invalid != 0 {
+		t.Fatalf("audit log hash chain broken at entry %v", invalid)
+	}
+}
+
+func TestAuditLogAppendOnly(t *testing.T) {
+	d := newTestDB(t)
+	appendTestAudit(t, d, 3)
+
+	if _, err := d.db.Exec(`UPDATE AuditLog SET after = '' WHERE seq = 2`); err == nil {
+		t.Fatal("audit log entry updated")
+	}
+	if _, err := d.db.Exec(`DELETE FROM AuditLog WHERE seq = 3`); err == nil {
+		t.Fatal("audit log entry deleted")
+	}
+}
+
+func TestAuditLogTamperingDetected(t *testing.T) {
+	d := newTestDB(t)
+	appendTestAudit(t, d, 3)
+
+	// as someone with access to the database file could
+	if _, err := d.db.Exec(`DROP TRIGGER AuditLogNoUpdate`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.db.Exec(`UPDATE AuditLog SET after = '{"change":99}' WHERE seq = 2`); err != nil {
+		t.Fatal(err)
+	}
+
+	if invalid := verifyTestAudit(t, d); invalid != 2 {
+		t.Fatalf("tampered audit log verified invalid at entry %v, want 2", invalid)
+	}
+}
@@ -1,31 +1,70 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
 )
 
 const (
-	TimeFormat               = "2006-01-02 15:04:05"
 	InsufficientFundsMessage = "Insufficient Funds"
+	AccountFrozenMessage     = "Account Frozen"
 )
 
-type DB interface {
+// Repository methods available both on the database and inside a transaction
+type Tx interface {
 	user
 	deposit
 	payment
+	session
+	twoFactor
+	webAuthn
+	loginThrottle
+	oauth
+	delegation
+	site
+	adjustment
+	audit
+	export
+	statement
+	alert
+	notification
+	supporter
+}
+
+type DB interface {
+	Tx
+	WithTx(ctx context.Context, fn func(tx Tx) error) error
 }
 
-func GetDB(kind, path string) (DB, error) {
+// Changes to balances, deposits and payments, and revoked sessions, are
+// published to bus once they have been committed
+func GetDB(kind, path string, bus *events.Bus) (DB, error) {
+	// listings stream rows to the client with a read open. In WAL mode that
+	// doesn't hold up writers, and writers wait a while for each other's
+	// locks rather than failing straight away
+	if kind == "sqlite3" {
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		path += separator + "_journal_mode=WAL&_busy_timeout=5000"
+	}
+
 	database, err := sql.Open(kind, path)
 	if err != nil {
 		log.Printf("error opening database connection\n%v", err)
 		return nil, err
 	}
-	return &sqlDb{database}, nil
+	return &sqlDb{db: database, conn: database, events: bus}, nil
 }
 
 type NotFound struct {
@@ -58,6 +97,39 @@ func IsBadQuery(err error) bool {
 	return false
 }
 
+// Resolves a requested sort field and order against the columns a listing
+// may be sorted by. Listings default to newest first
+func sqlSort(columns map[string]string, sort, order string) (utils.SqlSort, error) {
+	if sort == "" {
+		sort = models.SortTime
+	}
+
+	column, ok := columns[sort]
+	if !ok {
+		return utils.SqlSort{}, &BadQuery{fmt.Sprintf("cannot sort by '%v'", sort)}
+	}
+
+	switch order {
+	case "", models.OrderDesc:
+		return utils.SqlSort{Column: column, Desc: true}, nil
+	case models.OrderAsc:
+		return utils.SqlSort{Column: column, Desc: false}, nil
+	}
+	return utils.SqlSort{}, &BadQuery{fmt.Sprintf("order must be '%v' or '%v'", models.OrderAsc, models.OrderDesc)}
+}
+
+// Extends a WHERE statement to skip the rows up to and including the cursor,
+// which must have been issued for the same sort
+func sqlAfterCursor(whereStatement string, args []interface{}, columns map[string]string, sort utils.SqlSort, cursor utils.Cursor) (string, []interface{}, error) {
+	cursorSort, err := sqlSort(columns, cursor.Sort, cursor.Order)
+	if err != nil || cursorSort != sort {
+		return "", nil, &BadQuery{"cursor was issued for a different sort order"}
+	}
+
+	cursorStatement, cursorArgs := utils.SqlAfterCursor(sort, cursor)
+	return whereStatement + " AND " + cursorStatement, append(args, cursorArgs...), nil
+}
+
 type InsufficientFunds struct{}
 
 func (err *InsufficientFunds) Error() string {
@@ -71,6 +143,45 @@ func IsInsufficientFunds(err error) bool {
 	return false
 }
 
+type AccountFrozen struct{}
+
+func (err *AccountFrozen) Error() string {
+	return "Account Frozen"
+}
+
+func IsAccountFrozen(err error) bool {
+	if _, ok := err.(*AccountFrozen); ok {
+		return true
+	}
+	return false
+}
+
+type SpendCapExceeded struct{}
+
+func (err *SpendCapExceeded) Error() string {
+	return "Spend cap exceeded"
+}
+
+func IsSpendCapExceeded(err error) bool {
+	if _, ok := err.(*SpendCapExceeded); ok {
+		return true
+	}
+	return false
+}
+
+// Satisfied by both *sql.DB and *sql.Tx, so repository methods can run
+// either directly against the database or inside a transaction
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 type sqlDb struct {
-	db *sql.DB
+	db     queryer
+	conn   *sql.DB
+	events *events.Bus
+	// events published on a transaction, held back until it commits. nil
+	// outside of one
+	pending *[]events.Event
 }
@@ -2,7 +2,10 @@ CREATE TABLE Users (
     username VARCHAR(64) NOT NULL,
     password VARCHAR(128) NOT NULL,
     email VARCHAR(256) NOT NULL,
-    invalidatedtokens BOOLEAN NOT NULL DEFAULT FALSE,
+    emailverified BOOLEAN NOT NULL DEFAULT FALSE,
+    role VARCHAR(16) NOT NULL DEFAULT 'user',
+    frozen BOOLEAN NOT NULL DEFAULT FALSE,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE, -- anonymised, only kept for its ledger rows
     PRIMARY KEY (username)
 );
 
@@ -10,28 +13,336 @@ CREATE TABLE Deposits (
     id CHAR(36) NOT NULL,
     username VARCHAR(64) NOT NULL,
     amount LONG NOT NULL,
-    time VARCHAR(32) NOT NULL,
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
     PRIMARY KEY (id),
     FOREIGN KEY (username) REFERENCES Users(username)
 );
 
+CREATE INDEX DepositsByTime ON Deposits (username, time, id);
+
 CREATE TABLE Payments (
     id CHAR(36) NOT NULL,
     username VARCHAR(64) NOT NULL,
     amount LONG NOT NULL,
-    time VARCHAR(32) NOT NULL,
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
     url VARCHAR(2048) NOT NULL,
     PRIMARY KEY (id),
     FOREIGN KEY (username) REFERENCES Users(username)
 );
 
+CREATE INDEX PaymentsByTime ON Payments (username, time, id);
+
+CREATE TABLE Adjustments (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    amount LONG NOT NULL, -- negative for debits
+    reason VARCHAR(1024) NOT NULL,
+    admin VARCHAR(64) NOT NULL,
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username)
+);
+
+CREATE INDEX AdjustmentsByTime ON Adjustments (username, time, id);
+
+CREATE TABLE Sessions (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    refreshid CHAR(36) NOT NULL,
+    device VARCHAR(128) NOT NULL,
+    useragent VARCHAR(512) NOT NULL,
+    ip VARCHAR(64) NOT NULL,
+    clientid CHAR(36) NOT NULL DEFAULT '', -- empty unless granted to a third-party app
+    scope VARCHAR(256) NOT NULL DEFAULT '', -- space separated, empty for full access
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    lastused INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    compromised BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX SessionsByUser ON Sessions (username, lastused);
+
+CREATE INDEX SessionsByClient ON Sessions (clientid);
+
+CREATE TABLE Delegations (
+    id CHAR(36) NOT NULL, -- the id of the delegation's session
+    domains TEXT NOT NULL, -- JSON array of the domains payments may go to
+    spendcap INTEGER NOT NULL,
+    spent INTEGER NOT NULL DEFAULT 0,
+    expires INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (id) REFERENCES Sessions(id) ON DELETE CASCADE
+);
+
+CREATE TABLE TwoFactor (
+    username VARCHAR(64) NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    laststep INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (username),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE TABLE RecoveryCodes (
+    username VARCHAR(64) NOT NULL,
+    hash CHAR(64) NOT NULL, -- hex SHA-256 of the normalised code
+    used BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (username, hash),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE TABLE WebAuthnCredentials (
+    id VARCHAR(1366) NOT NULL, -- base64url credential id
+    username VARCHAR(64) NOT NULL,
+    name VARCHAR(128) NOT NULL,
+    publickey BLOB NOT NULL,
+    attestationtype VARCHAR(32) NOT NULL,
+    aaguid BLOB NOT NULL,
+    signcount INTEGER NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    lastused INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX WebAuthnCredentialsByUser ON WebAuthnCredentials (username);
+
+CREATE TABLE WebAuthnChallenges (
+    username VARCHAR(64) NOT NULL,
+    ceremony VARCHAR(16) NOT NULL,
+    data BLOB NOT NULL,
+    expires INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (username, ceremony),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE TABLE OAuthClients (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL, -- the user who registered the client
+    name VARCHAR(128) NOT NULL,
+    redirecturis TEXT NOT NULL, -- JSON array
+    secret CHAR(64) NOT NULL, -- SHA-256 of the secret, empty for public clients
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX OAuthClientsByUser ON OAuthClients (username);
+
+CREATE TABLE OAuthCodes (
+    code CHAR(64) NOT NULL, -- SHA-256 of the code
+    clientid CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    redirecturi VARCHAR(2048) NOT NULL,
+    scope VARCHAR(256) NOT NULL,
+    codechallenge VARCHAR(128) NOT NULL,
+    expires INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (code),
+    FOREIGN KEY (clientid) REFERENCES OAuthClients(id) ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE TABLE Sites (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL, -- the site's owner
+    name VARCHAR(128) NOT NULL,
+    domain VARCHAR(253) NOT NULL,
+    verificationtoken CHAR(32) NOT NULL,
+    verified BOOLEAN NOT NULL DEFAULT FALSE,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX SitesByUser ON Sites (username);
+
+CREATE TABLE ApiKeys (
+    id CHAR(36) NOT NULL,
+    siteid CHAR(36) NOT NULL,
+    name VARCHAR(128) NOT NULL,
+    prefix CHAR(8) NOT NULL,
+    hash CHAR(64) NOT NULL, -- SHA-256 of the whole key
+    scope VARCHAR(256) NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    lastused INTEGER NOT NULL DEFAULT 0, -- nanoseconds since the Unix epoch, UTC, 0 if never used
+    expires INTEGER NOT NULL DEFAULT 0, -- nanoseconds since the Unix epoch, UTC, 0 if it doesn't expire
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (id),
+    UNIQUE (prefix),
+    FOREIGN KEY (siteid) REFERENCES Sites(id) ON DELETE CASCADE
+);
+
+CREATE INDEX ApiKeysBySite ON ApiKeys (siteid);
+
+CREATE TABLE DataExports (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    completed INTEGER NOT NULL DEFAULT 0, -- nanoseconds since the Unix epoch, UTC, 0 until finished
+    expires INTEGER NOT NULL DEFAULT 0, -- nanoseconds since the Unix epoch, UTC, 0 until ready
+    archive BLOB, -- zip, NULL until ready
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX DataExportsByUser ON DataExports (username, created);
+
+-- statements of closed months, which can no longer change
+CREATE TABLE Statements (
+    username VARCHAR(64) NOT NULL,
+    month CHAR(7) NOT NULL, -- yyyy-mm
+    data TEXT NOT NULL, -- JSON
+    generated INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (username, month),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE TABLE BalanceAlerts (
+    username VARCHAR(64) NOT NULL,
+    threshold INTEGER NOT NULL,
+    email BOOLEAN NOT NULL DEFAULT FALSE,
+    topupamount INTEGER NOT NULL DEFAULT 0, -- 0 if top-ups are off
+    topupcap INTEGER NOT NULL DEFAULT 0, -- per calendar month, UTC
+    PRIMARY KEY (username),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+-- deposits made through the funding provider when a balance ran low. A
+-- top-up is recorded as pending before the card is charged, so it counts
+-- against the monthly cap from then on
+CREATE TABLE TopUps (
+    id CHAR(36) NOT NULL, -- of the deposit, once settled
+    username VARCHAR(64) NOT NULL,
+    amount INTEGER NOT NULL,
+    reference VARCHAR(255) NOT NULL, -- the funding provider's, once charged
+    status VARCHAR(16) NOT NULL, -- pending, charged, settled or failed
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username)
+);
+
+CREATE INDEX TopUpsByUser ON TopUps (username, time);
+
+CREATE TABLE Notifications (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    data TEXT NOT NULL DEFAULT '', -- JSON
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    read INTEGER NOT NULL DEFAULT 0, -- nanoseconds since the Unix epoch, UTC, 0 if unread
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX NotificationsByUser ON Notifications (username, created, id);
+
+-- kinds without a row use the defaults
+CREATE TABLE NotificationPreferences (
+    username VARCHAR(64) NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    inbox BOOLEAN NOT NULL,
+    email BOOLEAN NOT NULL,
+    webhook BOOLEAN NOT NULL,
+    PRIMARY KEY (username, kind),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE TABLE NotificationWebhooks (
+    username VARCHAR(64) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (username),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+-- users who have opted in to appearing on supporter lists and leaderboards
+CREATE TABLE PublicProfiles (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    displayname VARCHAR(64) NOT NULL,
+    bio VARCHAR(280) NOT NULL DEFAULT '',
+    showamounts BOOLEAN NOT NULL DEFAULT FALSE,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    UNIQUE (username),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX PublicProfilesByDisplayName ON PublicProfiles (displayname COLLATE NOCASE);
+
+-- the sites whose supporter lists and leaderboards a user with a public
+-- profile has chosen to appear on. id is the user's id on that site's lists
+-- alone, so lists of different sites can't be joined on it
+CREATE TABLE SupporterSites (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    siteid CHAR(36) NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    UNIQUE (username, siteid),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE,
+    FOREIGN KEY (siteid) REFERENCES Sites(id) ON DELETE CASCADE
+);
+
+CREATE INDEX SupporterSitesBySite ON SupporterSites (siteid);
+
+-- a key per user for the references the audit log holds in place of their
+-- personal data. Deleting it when the account is deleted leaves the
+-- references matching nothing
+CREATE TABLE AuditKeys (
+    username VARCHAR(64) NOT NULL,
+    key BLOB NOT NULL,
+    PRIMARY KEY (username),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+-- not keyed to Users, attempts against usernames that don't exist are
+-- throttled the same way
+CREATE TABLE LoginThrottles (
+    kind VARCHAR(8) NOT NULL,
+    subject VARCHAR(64) NOT NULL,
+    failures INTEGER NOT NULL,
+    lastfailure INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    lockeduntil INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (kind, subject)
+);
+
+-- not keyed to Users, the log outlives the accounts it records
+CREATE TABLE AuditLog (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    actor VARCHAR(64) NOT NULL,
+    session CHAR(36) NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    target VARCHAR(64) NOT NULL,
+    before TEXT NOT NULL, -- JSON, empty if nothing
+    after TEXT NOT NULL, -- JSON, empty if nothing
+    ip VARCHAR(64) NOT NULL,
+    useragent VARCHAR(512) NOT NULL,
+    prevhash CHAR(64) NOT NULL,
+    hash CHAR(64) NOT NULL
+);
+
+CREATE INDEX AuditLogByTarget ON AuditLog (target, seq);
+CREATE INDEX AuditLogByActor ON AuditLog (actor, seq);
+
 CREATE VIEW Balances AS
-SELECT Users.username, IFNULL(depositsum, 0) - IFNULL(paymentsum, 0) AS balance
+SELECT Users.username, IFNULL(depositsum, 0) + IFNULL(adjustmentsum, 0) - IFNULL(paymentsum, 0) AS balance
 FROM Users
 LEFT JOIN 
     (SELECT username, SUM(amount) AS depositsum
     FROM Deposits GROUP BY username) AS Deposits
 ON Users.username = Deposits.username
+LEFT JOIN 
+    (SELECT username, SUM(amount) AS adjustmentsum
+    FROM Adjustments GROUP BY username) AS Adjustments
+ON Users.username = Adjustments.username
 LEFT JOIN 
     (SELECT username, SUM(amount) AS paymentsum
     FROM Payments GROUP BY username) AS Payments
@@ -41,5 +352,31 @@ CREATE TRIGGER BalanceCheck
 AFTER INSERT ON Payments
 WHEN 0 > (SELECT balance FROM Balances WHERE Balances.username = NEW.username)
 BEGIN
-    SELECT RAISE(ROLLBACK, "Insufficient Funds");
+    SELECT RAISE(ABORT, "Insufficient Funds");
+END;
+
+CREATE TRIGGER FrozenDepositCheck
+BEFORE INSERT ON Deposits
+WHEN (SELECT frozen FROM Users WHERE Users.username = NEW.username)
+BEGIN
+    SELECT RAISE(ABORT, "Account Frozen");
+END;
+
+CREATE TRIGGER FrozenPaymentCheck
+BEFORE INSERT ON Payments
+WHEN (SELECT frozen FROM Users WHERE Users.username = NEW.username)
+BEGIN
+    SELECT RAISE(ABORT, "Account Frozen");
+END;
+
+CREATE TRIGGER AuditLogNoUpdate
+BEFORE UPDATE ON AuditLog
+BEGIN
+    SELECT RAISE(ABORT, "Audit log is append-only");
+END;
+
+CREATE TRIGGER AuditLogNoDelete
+BEFORE DELETE ON AuditLog
+BEGIN
+    SELECT RAISE(ABORT, "Audit log is append-only");
 END;
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/models"
+)
+
+var testDbCount int64
+
+// Returns a database with the current schema, held in memory until the test
+// ends
+func newTestDB(t *testing.T) *sqlDb {
+	schema, err := ioutil.ReadFile("db.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// shared between the pool's connections, but not with other tests
+	path := fmt.Sprintf("file:test%v?mode=memory&cache=shared", atomic.AddInt64(&testDbCount, 1))
+	db, err := GetDB("sqlite3", path, events.NewBus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := db.(*sqlDb)
+	t.Cleanup(func() { d.conn.Close() })
+
+	if _, err := d.conn.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func createTestUser(t *testing.T, d *sqlDb, username string) {
+	if err := d.CreateUser(&models.User{Username: username, Password: "unused", Email: username + "@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+}
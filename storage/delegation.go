@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type delegation interface {
+	CreateDelegation(delegation *models.Delegation) error
+	GetDelegation(username, id string) (*models.Delegation, error)
+	GetDelegations(username string) ([]models.Delegation, error)
+	AddDelegationSpend(id string, amount int) error
+}
+
+// Stores the limits of a delegation. Its session must already exist
+func (d *sqlDb) CreateDelegation(delegation *models.Delegation) error {
+	domains, err := json.Marshal(delegation.Domains)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(`
+        INSERT INTO Delegations (id, domains, spendcap, spent, expires) VALUES (?, ?, ?, ?, ?)
+    `, delegation.Id, string(domains), delegation.SpendCap, delegation.Spent, utils.SqlTime(delegation.Expires))
+	if err != nil {
+		log.Printf("error inserting delegation %v into the database\n %v", delegation.Id, err)
+	}
+	return err
+}
+
+// Returns the delegation with the session id, whether or not it has been
+// revoked. Returns NotFound if the session is not a delegation
+func (d *sqlDb) GetDelegation(username, id string) (*models.Delegation, error) {
+	delegations, err := d.getDelegations(`
+        SELECT Delegations.id, username, device, domains, scope, spendcap, spent, expires, created
+        FROM Delegations JOIN Sessions ON Delegations.id = Sessions.id
+        WHERE Delegations.id = ? AND username = ?
+    `, id, username)
+	if err != nil {
+		log.Printf("error reading delegation %v from database for user %v\n%v", id, username, err)
+		return nil, err
+	}
+
+	if len(delegations) == 0 {
+		return nil, &NotFound{fmt.Sprintf("delegation %v", id)}
+	}
+	return &delegations[0], nil
+}
+
+// Returns the delegations of a user that have not been revoked, newest first
+func (d *sqlDb) GetDelegations(username string) ([]models.Delegation, error) {
+	delegations, err := d.getDelegations(`
+        SELECT Delegations.id, username, device, domains, scope, spendcap, spent, expires, created
+        FROM Delegations JOIN Sessions ON Delegations.id = Sessions.id
+        WHERE username = ? AND NOT revoked ORDER BY created DESC
+    `, username)
+	if err != nil {
+		log.Printf("error reading delegations from database for user %v\n%v", username, err)
+	}
+	return delegations, err
+}
+
+func (d *sqlDb) getDelegations(query string, args ...interface{}) ([]models.Delegation, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	delegations := []models.Delegation{}
+	for rows.Next() {
+		dg := models.Delegation{}
+		var domains string
+		err := rows.Scan(&dg.Id, &dg.Username, &dg.Name, &domains, &dg.Scope, &dg.SpendCap, &dg.Spent,
+			utils.ScanTime(&dg.Expires), utils.ScanTime(&dg.Created))
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(domains), &dg.Domains)
+		if err != nil {
+			log.Printf("error parsing domains of delegation %v\n%v", dg.Id, err)
+			return nil, err
+		}
+		delegations = append(delegations, dg)
+	}
+
+	return delegations, nil
+}
+
+// Counts a payment against a delegation's spend cap. Returns
+// SpendCapExceeded, and counts nothing, if it would go over the cap
+func (d *sqlDb) AddDelegationSpend(id string, amount int) error {
+	resp, err := d.db.Exec(`
+        UPDATE Delegations SET spent = spent + ? WHERE id = ? AND spent + ? <= spendcap
+    `, amount, id, amount)
+	if err != nil {
+		log.Printf("error adding spend to delegation %v\n %v", id, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by delegation spend\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &SpendCapExceeded{}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+)
+
+func createTestDelegation(t *testing.T, d *sqlDb, username, id string, spendCap int) {
+	createTestSession(t, d, username, id, id)
+	err := d.CreateDelegation(&models.Delegation{
+		Id:       id,
+		Username: username,
+		Domains:  []string{"example.com"},
+		SpendCap: spendCap,
+		Expires:  time.Now().UTC().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testDelegationSpent(t *testing.T, d *sqlDb, username, id string) int {
+	delegation, err := d.GetDelegation(username, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return delegation.Spent
+}
+
+func TestAddDelegationSpend(t *testing.T) {
+	d := newTestDB(t)
+	createTestUser(t, d, "alice")
+	createTestDelegation(t, d, "alice", "delegation", 100)
+
+	if err := d.AddDelegationSpend("delegation", 60); err != nil {
+		t.Fatalf("spend within the cap returned %v", err)
+	}
+
+	// going over the cap counts nothing, so a smaller payment can still fit
+	if err := d.AddDelegationSpend("delegation", 50); !IsSpendCapExceeded(err) {
+		t.Fatalf("spend over the cap returned %v, want SpendCapExceeded", err)
+	}
+	if spent := testDelegationSpent(t, d, "alice", "delegation"); spent != 60 {
+		t.Fatalf("spent after refused spend %v, want 60", spent)
+	}
+
+	if err := d.AddDelegationSpend("delegation", 40); err != nil {
+		t.Fatalf("spend up to the cap returned %v", err)
+	}
+	if err := d.AddDelegationSpend("delegation", 1); !IsSpendCapExceeded(err) {
+		t.Fatalf("spend past a reached cap returned %v, want SpendCapExceeded", err)
+	}
+	if spent := testDelegationSpent(t, d, "alice", "delegation"); spent != 100 {
+		t.Fatalf("spent %v, want 100", spent)
+	}
+}
+
+func TestAddDelegationSpendRollsBack(t *testing.T) {
+	d := newTestDB(t)
+	createTestUser(t, d, "alice")
+	createTestDelegation(t, d, "alice", "delegation", 100)
+
+	// the spend is counted in the payment's transaction, so a payment that
+	// fails afterwards, such as for lack of funds, doesn't use up the cap
+	err := d.WithTx(context.Background(), func(tx Tx) error {
+		if err := tx.AddDelegationSpend("delegation", 100); err != nil {
+			return err
+		}
+		return &InsufficientFunds{}
+	})
+	if !IsInsufficientFunds(err) {
+		t.Fatalf("payment returned %v, want InsufficientFunds", err)
+	}
+	if spent := testDelegationSpent(t, d, "alice", "delegation"); spent != 0 {
+		t.Fatalf("spent after failed payment %v, want 0", spent)
+	}
+}
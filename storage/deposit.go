@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/crowdpower/fund/events"
 	"github.com/crowdpower/fund/models"
 	"github.com/crowdpower/fund/utils"
 )
@@ -12,17 +13,26 @@ type deposit interface {
 	CreateDeposit(deposit *models.Deposit) error
 	GetDeposit(username, id string) (*models.Deposit, error)
 	GetDeposits(username string, depositArgs *models.DepositArgs) ([]models.Deposit, error)
+	EachDeposit(username string, depositArgs *models.DepositArgs, fn func(deposit *models.Deposit) error) error
 	GetDepositsSum(username string, depositArgs *models.DepositArgs) (int, error)
 }
 
 func (d *sqlDb) CreateDeposit(deposit *models.Deposit) error {
 	_, err := d.db.Exec(`
         INSERT INTO Deposits (id, username, amount, time) VALUES (?, ?, ?, ?)
-    `, deposit.Id, deposit.Username, deposit.Amount, deposit.Time)
+    `, deposit.Id, deposit.Username, deposit.Amount, utils.SqlTime(deposit.Time))
 	if err != nil {
-		log.Printf("error inserting deposit %v into the database\n %v", deposit, err)
+		if err.Error() == AccountFrozenMessage {
+			err = &AccountFrozen{}
+		} else {
+			log.Printf("error inserting deposit %v into the database\n %v", deposit, err)
+		}
+		return err
 	}
-	return err
+
+	d.publish(events.Event{Type: events.TypeDeposit, Username: deposit.Username, Time: deposit.Time, Data: deposit})
+	d.publishBalance(deposit.Username, deposit.Amount, deposit.Time)
+	return nil
 }
 
 func (d *sqlDb) GetDeposit(username, id string) (*models.Deposit, error) {
@@ -37,7 +47,7 @@ func (d *sqlDb) GetDeposit(username, id string) (*models.Deposit, error) {
 
 	if rows.Next() {
 		d := &models.Deposit{}
-		err := rows.Scan(&d.Id, &d.Username, &d.Amount, &d.Time)
+		err := rows.Scan(&d.Id, &d.Username, &d.Amount, utils.ScanTime(&d.Time))
 		if err != nil {
 			log.Printf("error parsing database rows\n%v", err)
 			return nil, err
@@ -48,59 +58,91 @@ func (d *sqlDb) GetDeposit(username, id string) (*models.Deposit, error) {
 	return nil, &NotFound{fmt.Sprintf("deposit %v", id)}
 }
 
-func (d *sqlDb) GetDeposits(username string, depositArgs *models.DepositArgs) ([]models.Deposit, error) {
-	whereStatement, args := utils.SqlWhere([]utils.SqlCondition{
+var depositSortColumns = map[string]string{
+	models.SortTime:   "time",
+	models.SortAmount: "amount",
+}
+
+func depositConditions(username string, depositArgs *models.DepositArgs) []utils.SqlCondition {
+	return []utils.SqlCondition{
+		utils.SqlCondition{"id", "IN", depositArgs.Ids},
 		utils.SqlCondition{"time", ">=", depositArgs.Oldest},
 		utils.SqlCondition{"time", "<=", depositArgs.Newest},
 		utils.SqlCondition{"amount", ">=", depositArgs.MinAmount},
 		utils.SqlCondition{"amount", "<=", depositArgs.MaxAmount},
 		utils.SqlCondition{"username", "=", username},
+	}
+}
+
+func (d *sqlDb) GetDeposits(username string, depositArgs *models.DepositArgs) ([]models.Deposit, error) {
+	deposits := []models.Deposit{}
+	err := d.EachDeposit(username, depositArgs, func(deposit *models.Deposit) error {
+		deposits = append(deposits, *deposit)
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return deposits, nil
+}
+
+// Calls fn with each deposit matching depositArgs as it is read, so listings
+// of any length can be streamed. Stops at, and returns, the first error fn
+// returns
+func (d *sqlDb) EachDeposit(username string, depositArgs *models.DepositArgs, fn func(deposit *models.Deposit) error) error {
+	sort, err := sqlSort(depositSortColumns, depositArgs.Sort, depositArgs.Order)
+	if err != nil {
+		return err
+	}
+
+	whereStatement, args := utils.SqlWhere(depositConditions(username, depositArgs))
+
+	if !depositArgs.Cursor.IsZero() {
+		whereStatement, args, err = sqlAfterCursor(whereStatement, args, depositSortColumns, sort, depositArgs.Cursor)
+		if err != nil {
+			return err
+		}
+	}
 
 	var pagination string
 	if depositArgs.Count != 0 {
 		pagination += fmt.Sprintf("LIMIT %v ", depositArgs.Count)
 	}
-	if depositArgs.Offset != 0 {
+	if depositArgs.Offset != 0 && depositArgs.Cursor.IsZero() {
 		pagination += fmt.Sprintf("OFFSET %v ", depositArgs.Offset)
 	}
 
 	rows, err := d.db.Query(`
-        SELECT id, username, amount, time FROM Deposits `+whereStatement+` ORDER BY time DESC
+        SELECT id, username, amount, time FROM Deposits `+whereStatement+` `+utils.SqlOrderBy(sort)+`
     `+pagination, args...)
 	if err != nil {
 		log.Printf("error reading deposits from database for user %v\n%v", username, err)
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	deposits := []models.Deposit{}
 	for rows.Next() {
 		d := models.Deposit{}
-		err := rows.Scan(&d.Id, &d.Username, &d.Amount, &d.Time)
+		err := rows.Scan(&d.Id, &d.Username, &d.Amount, utils.ScanTime(&d.Time))
 		if err != nil {
 			log.Printf("error parsing database rows\n%v", err)
-			return nil, err
+			return err
+		}
+		if err := fn(&d); err != nil {
+			return err
 		}
-		deposits = append(deposits, d)
 	}
 
-	return deposits, nil
+	return rows.Err()
 }
 
 func (d *sqlDb) GetDepositsSum(username string, depositArgs *models.DepositArgs) (int, error) {
 	var sum int
 
-	whereStatement, args := utils.SqlWhere([]utils.SqlCondition{
-		utils.SqlCondition{"time", ">=", depositArgs.Oldest},
-		utils.SqlCondition{"time", "<=", depositArgs.Newest},
-		utils.SqlCondition{"amount", ">=", depositArgs.MinAmount},
-		utils.SqlCondition{"amount", "<=", depositArgs.MaxAmount},
-		utils.SqlCondition{"username", "=", username},
-	})
+	whereStatement, args := utils.SqlWhere(depositConditions(username, depositArgs))
 
 	rows, err := d.db.Query(`
-        SELECT SUM(amount) FROM Deposits `+whereStatement+`
+        SELECT COALESCE(SUM(amount), 0) FROM Deposits `+whereStatement+`
     `, args...)
 	if err != nil {
 		log.Printf("error summing deposits from database for user %v\n%v", username, err)
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"log"
+	"time"
+
+	"github.com/crowdpower/fund/events"
+)
+
+// Publishes an event, or on a transaction, queues it to be published once the
+// transaction commits
+func (d *sqlDb) publish(e events.Event) {
+	if d.events == nil {
+		return
+	}
+	if d.pending != nil {
+		*d.pending = append(*d.pending, e)
+		return
+	}
+	d.events.Publish(e)
+}
+
+// Publishes a user's balance after it changed by change
+func (d *sqlDb) publishBalance(username string, change int, t time.Time) {
+	if d.events == nil {
+		return
+	}
+
+	var balance int
+	err := d.db.QueryRow(`
+        SELECT balance FROM Balances WHERE username = ?
+    `, username).Scan(&balance)
+	if err != nil {
+		log.Printf("error reading balance of user %v to publish\n%v", username, err)
+		return
+	}
+
+	d.publish(events.Event{
+		Type:     events.TypeBalance,
+		Username: username,
+		Time:     t,
+		Data:     events.Balance{Balance: balance, Previous: balance - change},
+	})
+}
+
+// Tells the user's event streams, and anything else listening, that one of
+// their sessions can no longer be used
+func (d *sqlDb) publishSessionRevoked(username, id string) {
+	d.publish(events.Event{
+		Type:     events.TypeSessionRevoked,
+		Username: username,
+		Time:     time.Now().UTC(),
+		Data:     events.SessionRevoked{Session: id},
+	})
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type export interface {
+	CreateExport(export *models.Export) error
+	GetExport(username, id string) (*models.Export, error)
+	GetExports(username string) ([]models.Export, error)
+	GetExportArchive(username, id string) ([]byte, error)
+	FinishExport(export *models.Export, archive []byte) error
+	DeleteExpiredExports(now time.Time) error
+}
+
+func (d *sqlDb) CreateExport(export *models.Export) error {
+	_, err := d.db.Exec(`
+        INSERT INTO DataExports (id, username, status, created) VALUES (?, ?, ?, ?)
+    `, export.Id, export.Username, export.Status, utils.SqlTime(export.Created))
+	if err != nil {
+		log.Printf("error inserting export %v into the database\n %v", export.Id, err)
+	}
+	return err
+}
+
+func (d *sqlDb) GetExport(username, id string) (*models.Export, error) {
+	exports, err := d.getExports(`
+        SELECT id, username, status, created, completed, expires, LENGTH(archive) FROM DataExports
+        WHERE id = ? AND username = ?
+    `, id, username)
+	if err != nil {
+		log.Printf("error reading export %v from database for user %v\n%v", id, username, err)
+		return nil, err
+	}
+
+	if len(exports) == 0 {
+		return nil, &NotFound{fmt.Sprintf("export %v", id)}
+	}
+	return &exports[0], nil
+}
+
+// Returns a user's exports, newest first
+func (d *sqlDb) GetExports(username string) ([]models.Export, error) {
+	exports, err := d.getExports(`
+        SELECT id, username, status, created, completed, expires, LENGTH(archive) FROM DataExports
+        WHERE username = ? ORDER BY created DESC
+    `, username)
+	if err != nil {
+		log.Printf("error reading exports from database for user %v\n%v", username, err)
+	}
+	return exports, err
+}
+
+func (d *sqlDb) getExports(query string, args ...interface{}) ([]models.Export, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []models.Export{}
+	for rows.Next() {
+		e := models.Export{}
+		var completed, expires int64
+		var size *int
+		err := rows.Scan(&e.Id, &e.Username, &e.Status, utils.ScanTime(&e.Created), &completed, &expires, &size)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		// 0 stands for not yet
+		if completed != 0 {
+			t := time.Unix(0, completed).UTC()
+			e.Completed = &t
+		}
+		if expires != 0 {
+			t := time.Unix(0, expires).UTC()
+			e.Expires = &t
+		}
+		if size != nil {
+			e.Size = *size
+		}
+		exports = append(exports, e)
+	}
+
+	return exports, nil
+}
+
+// Returns the archive of a ready export, NotFound if there isn't one
+func (d *sqlDb) GetExportArchive(username, id string) ([]byte, error) {
+	var archive []byte
+	err := d.db.QueryRow(`
+        SELECT archive FROM DataExports WHERE id = ? AND username = ? AND status = ?
+    `, id, username, models.ExportReady).Scan(&archive)
+	if err == sql.ErrNoRows {
+		return nil, &NotFound{fmt.Sprintf("export %v", id)}
+	} else if err != nil {
+		log.Printf("error reading archive of export %v from database\n%v", id, err)
+		return nil, err
+	}
+	return archive, nil
+}
+
+// Records how building an export went, storing its archive if it's ready
+func (d *sqlDb) FinishExport(export *models.Export, archive []byte) error {
+	var completed, expires int64
+	if export.Completed != nil {
+		completed = utils.SqlTime(*export.Completed)
+	}
+	if export.Expires != nil {
+		expires = utils.SqlTime(*export.Expires)
+	}
+
+	resp, err := d.db.Exec(`
+        UPDATE DataExports SET status = ?, completed = ?, expires = ?, archive = ? WHERE id = ?
+    `, export.Status, completed, expires, archive, export.Id)
+	if err != nil {
+		log.Printf("error finishing export %v\n %v", export.Id, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by update\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("export %v", export.Id)}
+	}
+
+	return nil
+}
+
+func (d *sqlDb) DeleteExpiredExports(now time.Time) error {
+	_, err := d.db.Exec(`
+        DELETE FROM DataExports WHERE expires != 0 AND expires < ?
+    `, utils.SqlTime(now))
+	if err != nil {
+		log.Printf("error deleting expired exports\n %v", err)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+-- RAISE(ROLLBACK) discards the enclosing transaction, which breaks callers
+-- using storage.DB.WithTx. RAISE(ABORT) only undoes the failing statement.
+DROP TRIGGER BalanceCheck;
+
+CREATE TRIGGER BalanceCheck
+AFTER INSERT ON Payments
+WHEN 0 > (SELECT balance FROM Balances WHERE Balances.username = NEW.username)
+BEGIN
+    SELECT RAISE(ABORT, "Insufficient Funds");
+END;
@@ -0,0 +1,68 @@
+-- Deposit and payment times were stored as VARCHAR in the server's local time
+-- zone. Convert them to INTEGER nanoseconds since the Unix epoch, in UTC.
+-- Run this with the same local time zone as the server that wrote the rows,
+-- since SQLite's 'utc' modifier converts from the process's local time.
+PRAGMA foreign_keys = OFF;
+
+BEGIN TRANSACTION;
+
+DROP TRIGGER BalanceCheck;
+DROP VIEW Balances;
+
+CREATE TABLE Deposits_utc (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    amount LONG NOT NULL,
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username)
+);
+
+INSERT INTO Deposits_utc (id, username, amount, time)
+SELECT id, username, amount, CAST(strftime('%s', time, 'utc') AS INTEGER) * 1000000000
+FROM Deposits;
+
+DROP TABLE Deposits;
+ALTER TABLE Deposits_utc RENAME TO Deposits;
+CREATE INDEX DepositsByTime ON Deposits (username, time, id);
+
+CREATE TABLE Payments_utc (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    amount LONG NOT NULL,
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    url VARCHAR(2048) NOT NULL,
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username)
+);
+
+INSERT INTO Payments_utc (id, username, amount, time, url)
+SELECT id, username, amount, CAST(strftime('%s', time, 'utc') AS INTEGER) * 1000000000, url
+FROM Payments;
+
+DROP TABLE Payments;
+ALTER TABLE Payments_utc RENAME TO Payments;
+CREATE INDEX PaymentsByTime ON Payments (username, time, id);
+
+CREATE VIEW Balances AS
+SELECT Users.username, IFNULL(depositsum, 0) - IFNULL(paymentsum, 0) AS balance
+FROM Users
+LEFT JOIN 
+    (SELECT username, SUM(amount) AS depositsum
+    FROM Deposits GROUP BY username) AS Deposits
+ON Users.username = Deposits.username
+LEFT JOIN 
+    (SELECT username, SUM(amount) AS paymentsum
+    FROM Payments GROUP BY username) AS Payments
+ON Users.username = Payments.username;
+
+CREATE TRIGGER BalanceCheck
+AFTER INSERT ON Payments
+WHEN 0 > (SELECT balance FROM Balances WHERE Balances.username = NEW.username)
+BEGIN
+    SELECT RAISE(ABORT, "Insufficient Funds");
+END;
+
+COMMIT;
+
+PRAGMA foreign_keys = ON;
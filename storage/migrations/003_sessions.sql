@@ -0,0 +1,17 @@
+-- Replace the all-or-nothing invalidatedtokens flag with per-login sessions
+CREATE TABLE Sessions (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    device VARCHAR(128) NOT NULL,
+    useragent VARCHAR(512) NOT NULL,
+    ip VARCHAR(64) NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    lastused INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX SessionsByUser ON Sessions (username, lastused);
+
+ALTER TABLE Users DROP COLUMN invalidatedtokens;
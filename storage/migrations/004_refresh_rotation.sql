@@ -0,0 +1,7 @@
+-- Refresh tokens become single use. Sessions created before this have no
+-- record of their current refresh token, so they are revoked and their users
+-- must log in again.
+ALTER TABLE Sessions ADD COLUMN refreshid CHAR(36) NOT NULL DEFAULT '';
+ALTER TABLE Sessions ADD COLUMN compromised BOOLEAN NOT NULL DEFAULT FALSE;
+
+UPDATE Sessions SET revoked = TRUE;
@@ -0,0 +1,16 @@
+CREATE TABLE TwoFactor (
+    username VARCHAR(64) NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    laststep INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (username),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE TABLE RecoveryCodes (
+    username VARCHAR(64) NOT NULL,
+    hash CHAR(64) NOT NULL, -- hex SHA-256 of the normalised code
+    used BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (username, hash),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
@@ -0,0 +1,24 @@
+CREATE TABLE WebAuthnCredentials (
+    id VARCHAR(1366) NOT NULL, -- base64url credential id
+    username VARCHAR(64) NOT NULL,
+    name VARCHAR(128) NOT NULL,
+    publickey BLOB NOT NULL,
+    attestationtype VARCHAR(32) NOT NULL,
+    aaguid BLOB NOT NULL,
+    signcount INTEGER NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    lastused INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX WebAuthnCredentialsByUser ON WebAuthnCredentials (username);
+
+CREATE TABLE WebAuthnChallenges (
+    username VARCHAR(64) NOT NULL,
+    ceremony VARCHAR(16) NOT NULL,
+    data BLOB NOT NULL,
+    expires INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (username, ceremony),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
@@ -0,0 +1 @@
+ALTER TABLE Users ADD COLUMN emailverified BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,8 @@
+CREATE TABLE LoginThrottles (
+    kind VARCHAR(8) NOT NULL,
+    subject VARCHAR(64) NOT NULL,
+    failures INTEGER NOT NULL,
+    lastfailure INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    lockeduntil INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (kind, subject)
+);
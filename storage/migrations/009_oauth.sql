@@ -0,0 +1,30 @@
+ALTER TABLE Sessions ADD COLUMN clientid CHAR(36) NOT NULL DEFAULT '';
+ALTER TABLE Sessions ADD COLUMN scope VARCHAR(256) NOT NULL DEFAULT '';
+
+CREATE INDEX SessionsByClient ON Sessions (clientid);
+
+CREATE TABLE OAuthClients (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL, -- the user who registered the client
+    name VARCHAR(128) NOT NULL,
+    redirecturis TEXT NOT NULL, -- JSON array
+    secret CHAR(64) NOT NULL, -- SHA-256 of the secret, empty for public clients
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX OAuthClientsByUser ON OAuthClients (username);
+
+CREATE TABLE OAuthCodes (
+    code CHAR(64) NOT NULL, -- SHA-256 of the code
+    clientid CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    redirecturi VARCHAR(2048) NOT NULL,
+    scope VARCHAR(256) NOT NULL,
+    codechallenge VARCHAR(128) NOT NULL,
+    expires INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (code),
+    FOREIGN KEY (clientid) REFERENCES OAuthClients(id) ON DELETE CASCADE,
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
@@ -0,0 +1,9 @@
+CREATE TABLE Delegations (
+    id CHAR(36) NOT NULL, -- the id of the delegation's session
+    domains TEXT NOT NULL, -- JSON array of the domains payments may go to
+    spendcap INTEGER NOT NULL,
+    spent INTEGER NOT NULL DEFAULT 0,
+    expires INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (id) REFERENCES Sessions(id) ON DELETE CASCADE
+);
@@ -0,0 +1,31 @@
+CREATE TABLE Sites (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL, -- the site's owner
+    name VARCHAR(128) NOT NULL,
+    domain VARCHAR(253) NOT NULL,
+    verificationtoken CHAR(32) NOT NULL,
+    verified BOOLEAN NOT NULL DEFAULT FALSE,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX SitesByUser ON Sites (username);
+
+CREATE TABLE ApiKeys (
+    id CHAR(36) NOT NULL,
+    siteid CHAR(36) NOT NULL,
+    name VARCHAR(128) NOT NULL,
+    prefix CHAR(8) NOT NULL,
+    hash CHAR(64) NOT NULL, -- SHA-256 of the whole key
+    scope VARCHAR(256) NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    lastused INTEGER NOT NULL DEFAULT 0, -- nanoseconds since the Unix epoch, UTC, 0 if never used
+    expires INTEGER NOT NULL DEFAULT 0, -- nanoseconds since the Unix epoch, UTC, 0 if it doesn't expire
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (id),
+    UNIQUE (prefix),
+    FOREIGN KEY (siteid) REFERENCES Sites(id) ON DELETE CASCADE
+);
+
+CREATE INDEX ApiKeysBySite ON ApiKeys (siteid);
@@ -0,0 +1,47 @@
+ALTER TABLE Users ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'user';
+ALTER TABLE Users ADD COLUMN frozen BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE Adjustments (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    amount LONG NOT NULL, -- negative for debits
+    reason VARCHAR(1024) NOT NULL,
+    admin VARCHAR(64) NOT NULL,
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username)
+);
+
+CREATE INDEX AdjustmentsByTime ON Adjustments (username, time, id);
+
+DROP VIEW Balances;
+
+CREATE VIEW Balances AS
+SELECT Users.username, IFNULL(depositsum, 0) + IFNULL(adjustmentsum, 0) - IFNULL(paymentsum, 0) AS balance
+FROM Users
+LEFT JOIN 
+    (SELECT username, SUM(amount) AS depositsum
+    FROM Deposits GROUP BY username) AS Deposits
+ON Users.username = Deposits.username
+LEFT JOIN 
+    (SELECT username, SUM(amount) AS adjustmentsum
+    FROM Adjustments GROUP BY username) AS Adjustments
+ON Users.username = Adjustments.username
+LEFT JOIN 
+    (SELECT username, SUM(amount) AS paymentsum
+    FROM Payments GROUP BY username) AS Payments
+ON Users.username = Payments.username;
+
+CREATE TRIGGER FrozenDepositCheck
+BEFORE INSERT ON Deposits
+WHEN (SELECT frozen FROM Users WHERE Users.username = NEW.username)
+BEGIN
+    SELECT RAISE(ABORT, "Account Frozen");
+END;
+
+CREATE TRIGGER FrozenPaymentCheck
+BEFORE INSERT ON Payments
+WHEN (SELECT frozen FROM Users WHERE Users.username = NEW.username)
+BEGIN
+    SELECT RAISE(ABORT, "Account Frozen");
+END;
@@ -0,0 +1,29 @@
+CREATE TABLE AuditLog (
+    seq INTEGER PRIMARY KEY AUTOINCREMENT,
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    actor VARCHAR(64) NOT NULL,
+    session CHAR(36) NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    target VARCHAR(64) NOT NULL,
+    before TEXT NOT NULL, -- JSON, empty if nothing
+    after TEXT NOT NULL, -- JSON, empty if nothing
+    ip VARCHAR(64) NOT NULL,
+    useragent VARCHAR(512) NOT NULL,
+    prevhash CHAR(64) NOT NULL,
+    hash CHAR(64) NOT NULL
+);
+
+CREATE INDEX AuditLogByTarget ON AuditLog (target, seq);
+CREATE INDEX AuditLogByActor ON AuditLog (actor, seq);
+
+CREATE TRIGGER AuditLogNoUpdate
+BEFORE UPDATE ON AuditLog
+BEGIN
+    SELECT RAISE(ABORT, "Audit log is append-only");
+END;
+
+CREATE TRIGGER AuditLogNoDelete
+BEFORE DELETE ON AuditLog
+BEGIN
+    SELECT RAISE(ABORT, "Audit log is append-only");
+END;
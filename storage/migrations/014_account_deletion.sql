@@ -0,0 +1 @@
+ALTER TABLE Users ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT FALSE;
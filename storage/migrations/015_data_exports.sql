@@ -0,0 +1,13 @@
+CREATE TABLE DataExports (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    completed INTEGER NOT NULL DEFAULT 0, -- nanoseconds since the Unix epoch, UTC, 0 until finished
+    expires INTEGER NOT NULL DEFAULT 0, -- nanoseconds since the Unix epoch, UTC, 0 until ready
+    archive BLOB, -- zip, NULL until ready
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX DataExportsByUser ON DataExports (username, created);
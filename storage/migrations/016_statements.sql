@@ -0,0 +1,9 @@
+-- statements of closed months, which can no longer change
+CREATE TABLE Statements (
+    username VARCHAR(64) NOT NULL,
+    month CHAR(7) NOT NULL, -- yyyy-mm
+    data TEXT NOT NULL, -- JSON
+    generated INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (username, month),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
@@ -0,0 +1,23 @@
+CREATE TABLE BalanceAlerts (
+    username VARCHAR(64) NOT NULL,
+    threshold INTEGER NOT NULL,
+    email BOOLEAN NOT NULL DEFAULT FALSE,
+    topupamount INTEGER NOT NULL DEFAULT 0, -- 0 if top-ups are off
+    topupcap INTEGER NOT NULL DEFAULT 0, -- per calendar month, UTC
+    PRIMARY KEY (username),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+-- deposits made through the funding provider when a balance ran low
+CREATE TABLE TopUps (
+    id CHAR(36) NOT NULL, -- of the deposit
+    username VARCHAR(64) NOT NULL,
+    amount INTEGER NOT NULL,
+    reference VARCHAR(255) NOT NULL, -- the funding provider's
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (id) REFERENCES Deposits(id),
+    FOREIGN KEY (username) REFERENCES Users(username)
+);
+
+CREATE INDEX TopUpsByUser ON TopUps (username, time);
@@ -0,0 +1,34 @@
+CREATE TABLE Notifications (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    data TEXT NOT NULL DEFAULT '', -- JSON
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    read INTEGER NOT NULL DEFAULT 0, -- nanoseconds since the Unix epoch, UTC, 0 if unread
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE INDEX NotificationsByUser ON Notifications (username, created, id);
+
+-- kinds without a row use the defaults
+CREATE TABLE NotificationPreferences (
+    username VARCHAR(64) NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    inbox BOOLEAN NOT NULL,
+    email BOOLEAN NOT NULL,
+    webhook BOOLEAN NOT NULL,
+    PRIMARY KEY (username, kind),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE TABLE NotificationWebhooks (
+    username VARCHAR(64) NOT NULL,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(64) NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (username),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
@@ -0,0 +1,14 @@
+-- users who have opted in to appearing on supporter lists and leaderboards
+CREATE TABLE PublicProfiles (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    displayname VARCHAR(64) NOT NULL,
+    bio VARCHAR(280) NOT NULL DEFAULT '',
+    showamounts BOOLEAN NOT NULL DEFAULT FALSE,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    UNIQUE (username),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX PublicProfilesByDisplayName ON PublicProfiles (displayname COLLATE NOCASE);
@@ -0,0 +1,9 @@
+-- a key per user for the references the audit log holds in place of their
+-- personal data. Deleting it when the account is deleted leaves the
+-- references matching nothing
+CREATE TABLE AuditKeys (
+    username VARCHAR(64) NOT NULL,
+    key BLOB NOT NULL,
+    PRIMARY KEY (username),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE
+);
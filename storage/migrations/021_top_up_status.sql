@@ -0,0 +1,28 @@
+-- Top-ups are now recorded before the card is charged, so there is no deposit
+-- to reference until they settle. Every existing top-up had its deposit made.
+PRAGMA foreign_keys = OFF;
+
+BEGIN TRANSACTION;
+
+CREATE TABLE TopUps_status (
+    id CHAR(36) NOT NULL, -- of the deposit, once settled
+    username VARCHAR(64) NOT NULL,
+    amount INTEGER NOT NULL,
+    reference VARCHAR(255) NOT NULL, -- the funding provider's, once charged
+    status VARCHAR(16) NOT NULL, -- pending, charged, settled or failed
+    time INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    FOREIGN KEY (username) REFERENCES Users(username)
+);
+
+INSERT INTO TopUps_status (id, username, amount, reference, status, time)
+SELECT id, username, amount, reference, 'settled', time
+FROM TopUps;
+
+DROP TABLE TopUps;
+ALTER TABLE TopUps_status RENAME TO TopUps;
+CREATE INDEX TopUpsByUser ON TopUps (username, time);
+
+COMMIT;
+
+PRAGMA foreign_keys = ON;
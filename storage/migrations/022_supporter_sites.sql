@@ -0,0 +1,15 @@
+-- the sites whose supporter lists and leaderboards a user with a public
+-- profile has chosen to appear on. id is the user's id on that site's lists
+-- alone, so lists of different sites can't be joined on it
+CREATE TABLE SupporterSites (
+    id CHAR(36) NOT NULL,
+    username VARCHAR(64) NOT NULL,
+    siteid CHAR(36) NOT NULL,
+    created INTEGER NOT NULL, -- nanoseconds since the Unix epoch, UTC
+    PRIMARY KEY (id),
+    UNIQUE (username, siteid),
+    FOREIGN KEY (username) REFERENCES Users(username) ON DELETE CASCADE,
+    FOREIGN KEY (siteid) REFERENCES Sites(id) ON DELETE CASCADE
+);
+
+CREATE INDEX SupporterSitesBySite ON SupporterSites (siteid);
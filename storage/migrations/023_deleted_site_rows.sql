@@ -0,0 +1,4 @@
+-- deleting a site used to leave its keys and supporter list entries behind,
+-- as foreign keys aren't always enforced
+DELETE FROM ApiKeys WHERE siteid NOT IN (SELECT id FROM Sites);
+DELETE FROM SupporterSites WHERE siteid NOT IN (SELECT id FROM Sites);
@@ -0,0 +1,226 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type notification interface {
+	CreateNotification(notification *models.Notification) error
+	GetNotifications(username string, notificationArgs *models.NotificationArgs) ([]models.Notification, error)
+	ReadNotification(username, id string, t time.Time) error
+	ReadNotifications(username string, t time.Time) error
+	DeleteNotification(username, id string) error
+	GetNotificationPreferences(username string) ([]models.NotificationPreference, error)
+	SetNotificationPreference(preference *models.NotificationPreference) error
+	GetNotificationWebhook(username string) (*models.NotificationWebhook, error)
+	SetNotificationWebhook(webhook *models.NotificationWebhook) error
+	DeleteNotificationWebhook(username string) error
+}
+
+func (d *sqlDb) CreateNotification(notification *models.Notification) error {
+	_, err := d.db.Exec(`
+        INSERT INTO Notifications (id, username, kind, title, body, data, created) VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, notification.Id, notification.Username, notification.Kind, notification.Title, notification.Body,
+		string(notification.Data), utils.SqlTime(notification.Created))
+	if err != nil {
+		log.Printf("error inserting notification %v into the database\n %v", notification.Id, err)
+	}
+	return err
+}
+
+// Returns a user's notifications matching args, newest first
+func (d *sqlDb) GetNotifications(username string, notificationArgs *models.NotificationArgs) ([]models.Notification, error) {
+	whereStatement, args := utils.SqlWhere([]utils.SqlCondition{
+		{"username", "=", username},
+		{"created", "<=", notificationArgs.Newest},
+	})
+	switch notificationArgs.Status {
+	case "read":
+		whereStatement += " AND read != 0"
+	case "unread":
+		whereStatement += " AND read = 0"
+	case "":
+	default:
+		return nil, &BadQuery{"Status must be 'read' or 'unread'"}
+	}
+
+	var pagination string
+	if notificationArgs.Count != 0 {
+		pagination = fmt.Sprintf("LIMIT %v", notificationArgs.Count)
+	}
+
+	rows, err := d.db.Query(`
+        SELECT id, username, kind, title, body, data, created, read FROM Notifications
+        `+whereStatement+` ORDER BY created DESC, id DESC `+pagination, args...)
+	if err != nil {
+		log.Printf("error reading notifications from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []models.Notification{}
+	for rows.Next() {
+		n := models.Notification{}
+		var data string
+		var read int64
+		err := rows.Scan(&n.Id, &n.Username, &n.Kind, &n.Title, &n.Body, &data, utils.ScanTime(&n.Created), &read)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		if data != "" {
+			n.Data = []byte(data)
+		}
+		if read != 0 {
+			t := time.Unix(0, read).UTC()
+			n.Read = &t
+		}
+		notifications = append(notifications, n)
+	}
+
+	return notifications, nil
+}
+
+// Marks a notification read, if it isn't already
+func (d *sqlDb) ReadNotification(username, id string, t time.Time) error {
+	resp, err := d.db.Exec(`
+        UPDATE Notifications SET read = CASE WHEN read = 0 THEN ? ELSE read END WHERE id = ? AND username = ?
+    `, utils.SqlTime(t), id, username)
+	if err != nil {
+		log.Printf("error marking notification %v of user %v read\n %v", id, username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by update\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("notification %v", id)}
+	}
+
+	return nil
+}
+
+// Marks every unread notification of a user read
+func (d *sqlDb) ReadNotifications(username string, t time.Time) error {
+	_, err := d.db.Exec(`
+        UPDATE Notifications SET read = ? WHERE username = ? AND read = 0
+    `, utils.SqlTime(t), username)
+	if err != nil {
+		log.Printf("error marking notifications of user %v read\n %v", username, err)
+	}
+	return err
+}
+
+func (d *sqlDb) DeleteNotification(username, id string) error {
+	resp, err := d.db.Exec(`DELETE FROM Notifications WHERE id = ? AND username = ?`, id, username)
+	if err != nil {
+		log.Printf("error deleting notification %v of user %v\n %v", id, username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by delete\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("notification %v", id)}
+	}
+
+	return nil
+}
+
+// Returns the preferences the user has set. Kinds they haven't set a
+// preference for aren't included
+func (d *sqlDb) GetNotificationPreferences(username string) ([]models.NotificationPreference, error) {
+	rows, err := d.db.Query(`
+        SELECT username, kind, inbox, email, webhook FROM NotificationPreferences WHERE username = ? ORDER BY kind
+    `, username)
+	if err != nil {
+		log.Printf("error reading notification preferences from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	preferences := []models.NotificationPreference{}
+	for rows.Next() {
+		p := models.NotificationPreference{}
+		err := rows.Scan(&p.Username, &p.Kind, &p.Inbox, &p.Email, &p.Webhook)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		preferences = append(preferences, p)
+	}
+
+	return preferences, nil
+}
+
+func (d *sqlDb) SetNotificationPreference(preference *models.NotificationPreference) error {
+	_, err := d.db.Exec(`
+        INSERT OR REPLACE INTO NotificationPreferences (username, kind, inbox, email, webhook) VALUES (?, ?, ?, ?, ?)
+    `, preference.Username, preference.Kind, preference.Inbox, preference.Email, preference.Webhook)
+	if err != nil {
+		log.Printf("error setting %v notification preference of user %v\n %v", preference.Kind,
+			preference.Username, err)
+	}
+	return err
+}
+
+// Returns the user's webhook, including its secret, NotFound if they haven't
+// set one
+func (d *sqlDb) GetNotificationWebhook(username string) (*models.NotificationWebhook, error) {
+	w := &models.NotificationWebhook{}
+	err := d.db.QueryRow(`
+        SELECT username, url, secret, created FROM NotificationWebhooks WHERE username = ?
+    `, username).Scan(&w.Username, &w.Url, &w.Secret, utils.ScanTime(&w.Created))
+	if err == sql.ErrNoRows {
+		return nil, &NotFound{"notification webhook"}
+	} else if err != nil {
+		log.Printf("error reading notification webhook from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	return w, nil
+}
+
+// Sets the user's webhook, replacing any they had
+func (d *sqlDb) SetNotificationWebhook(webhook *models.NotificationWebhook) error {
+	_, err := d.db.Exec(`
+        INSERT OR REPLACE INTO NotificationWebhooks (username, url, secret, created) VALUES (?, ?, ?, ?)
+    `, webhook.Username, webhook.Url, webhook.Secret, utils.SqlTime(webhook.Created))
+	if err != nil {
+		log.Printf("error setting notification webhook of user %v\n %v", webhook.Username, err)
+	}
+	return err
+}
+
+func (d *sqlDb) DeleteNotificationWebhook(username string) error {
+	resp, err := d.db.Exec(`DELETE FROM NotificationWebhooks WHERE username = ?`, username)
+	if err != nil {
+		log.Printf("error deleting notification webhook of user %v\n %v", username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by delete\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{"notification webhook"}
+	}
+
+	return nil
+}
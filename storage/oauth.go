@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type oauth interface {
+	CreateOAuthClient(client *models.OAuthClient) error
+	GetOAuthClient(id string) (*models.OAuthClient, error)
+	GetOAuthClients(username string) ([]models.OAuthClient, error)
+	DeleteOAuthClient(username, id string) error
+	CreateOAuthCode(code *models.OAuthCode) error
+	TakeOAuthCode(code string, now time.Time) (*models.OAuthCode, error)
+}
+
+func (d *sqlDb) CreateOAuthClient(client *models.OAuthClient) error {
+	redirectUris, err := json.Marshal(client.RedirectUris)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec(`
+        INSERT INTO OAuthClients (id, username, name, redirecturis, secret, created) VALUES (?, ?, ?, ?, ?, ?)
+    `, client.Id, client.Username, client.Name, string(redirectUris), client.SecretHash, utils.SqlTime(client.Created))
+	if err != nil {
+		log.Printf("error inserting oauth client %v into the database\n %v", client.Id, err)
+	}
+	return err
+}
+
+func (d *sqlDb) GetOAuthClient(id string) (*models.OAuthClient, error) {
+	clients, err := d.getOAuthClients(`
+        SELECT id, username, name, redirecturis, secret, created FROM OAuthClients WHERE id = ?
+    `, id)
+	if err != nil {
+		log.Printf("error reading oauth client %v from database\n%v", id, err)
+		return nil, err
+	}
+
+	if len(clients) == 0 {
+		return nil, &NotFound{fmt.Sprintf("oauth client %v", id)}
+	}
+	return &clients[0], nil
+}
+
+func (d *sqlDb) GetOAuthClients(username string) ([]models.OAuthClient, error) {
+	clients, err := d.getOAuthClients(`
+        SELECT id, username, name, redirecturis, secret, created FROM OAuthClients WHERE username = ? ORDER BY created
+    `, username)
+	if err != nil {
+		log.Printf("error reading oauth clients from database for user %v\n%v", username, err)
+	}
+	return clients, err
+}
+
+func (d *sqlDb) getOAuthClients(query string, args ...interface{}) ([]models.OAuthClient, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []models.OAuthClient{}
+	for rows.Next() {
+		c := models.OAuthClient{}
+		var redirectUris string
+		err := rows.Scan(&c.Id, &c.Username, &c.Name, &redirectUris, &c.SecretHash, utils.ScanTime(&c.Created))
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(redirectUris), &c.RedirectUris)
+		if err != nil {
+			log.Printf("error parsing redirect uris of oauth client %v\n%v", c.Id, err)
+			return nil, err
+		}
+		c.Confidential = c.SecretHash != ""
+		clients = append(clients, c)
+	}
+
+	return clients, nil
+}
+
+func (d *sqlDb) DeleteOAuthClient(username, id string) error {
+	resp, err := d.db.Exec(`
+        DELETE FROM OAuthClients WHERE id = ? AND username = ?
+    `, id, username)
+	if err != nil {
+		log.Printf("error deleting oauth client %v for user %v\n %v", id, username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by delete\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("oauth client %v", id)}
+	}
+
+	return nil
+}
+
+func (d *sqlDb) CreateOAuthCode(code *models.OAuthCode) error {
+	_, err := d.db.Exec(`
+        INSERT INTO OAuthCodes (code, clientid, username, redirecturi, scope, codechallenge, expires) VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, code.Code, code.ClientId, code.Username, code.RedirectUri, code.Scope, code.CodeChallenge, utils.SqlTime(code.Expires))
+	if err != nil {
+		log.Printf("error inserting oauth code for client %v and user %v into the database\n %v", code.ClientId, code.Username, err)
+	}
+	return err
+}
+
+// Returns and deletes an authorization code, so each can only be exchanged
+// once. Returns NotFound if there is none or it has expired
+func (d *sqlDb) TakeOAuthCode(code string, now time.Time) (*models.OAuthCode, error) {
+	rows, err := d.db.Query(`
+        SELECT code, clientid, username, redirecturi, scope, codechallenge, expires FROM OAuthCodes WHERE code = ?
+    `, code)
+	if err != nil {
+		log.Printf("error reading oauth code from database\n%v", err)
+		return nil, err
+	}
+
+	var oauthCode *models.OAuthCode
+	if rows.Next() {
+		c := &models.OAuthCode{}
+		err := rows.Scan(&c.Code, &c.ClientId, &c.Username, &c.RedirectUri, &c.Scope, &c.CodeChallenge, utils.ScanTime(&c.Expires))
+		if err != nil {
+			rows.Close()
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		oauthCode = c
+	}
+	rows.Close()
+
+	if oauthCode == nil {
+		return nil, &NotFound{"oauth code"}
+	}
+
+	_, err = d.db.Exec(`
+        DELETE FROM OAuthCodes WHERE code = ?
+    `, code)
+	if err != nil {
+		log.Printf("error deleting oauth code\n %v", err)
+		return nil, err
+	}
+
+	if !now.Before(oauthCode.Expires) {
+		return nil, &NotFound{"oauth code"}
+	}
+
+	return oauthCode, nil
+}
@@ -3,7 +3,9 @@ package storage
 import (
 	"fmt"
 	"log"
+	"sort"
 
+	"github.com/crowdpower/fund/events"
 	"github.com/crowdpower/fund/models"
 	"github.com/crowdpower/fund/utils"
 )
@@ -12,26 +14,34 @@ type payment interface {
 	CreatePayment(payment *models.Payment) error
 	GetPayment(username, id string) (*models.Payment, error)
 	GetPayments(username string, paymentArgs *models.PaymentArgs) ([]models.Payment, error)
+	EachPayment(username string, paymentArgs *models.PaymentArgs, fn func(payment *models.Payment) error) error
 	GetPaymentsSum(username string, paymentArgs *models.PaymentArgs) (int, error)
+	GetPaymentsAggregate(username string, group string, paymentArgs *models.PaymentArgs) ([]models.PaymentAggregate, error)
 }
 
 func (d *sqlDb) CreatePayment(payment *models.Payment) error {
 	_, err := d.db.Exec(`
         INSERT INTO Payments (id, username, amount, time, url) VALUES (?, ?, ?, ?, ?)
-    `, payment.Id, payment.Username, payment.Amount, payment.Time, payment.Url)
+    `, payment.Id, payment.Username, payment.Amount, utils.SqlTime(payment.Time), payment.Url)
 	if err != nil {
 		if err.Error() == InsufficientFundsMessage {
 			err = &InsufficientFunds{}
+		} else if err.Error() == AccountFrozenMessage {
+			err = &AccountFrozen{}
 		} else {
 			log.Printf("error inserting payment %v into the database\n %v", payment, err)
 		}
+		return err
 	}
-	return err
+
+	d.publish(events.Event{Type: events.TypePayment, Username: payment.Username, Time: payment.Time, Data: payment})
+	d.publishBalance(payment.Username, -payment.Amount, payment.Time)
+	return nil
 }
 
 func (d *sqlDb) GetPayment(username, id string) (*models.Payment, error) {
 	rows, err := d.db.Query(`
-        SELECT id, username, amount, time FROM Payments WHERE id = ? AND username = ?
+        SELECT id, username, amount, time, url FROM Payments WHERE id = ? AND username = ?
     `, id, username)
 	if err != nil {
 		log.Printf("error reading payment %v from database for user %v\n%v", id, username, err)
@@ -41,7 +51,7 @@ func (d *sqlDb) GetPayment(username, id string) (*models.Payment, error) {
 
 	if rows.Next() {
 		p := &models.Payment{}
-		err := rows.Scan(&p.Id, &p.Username, &p.Amount, &p.Time)
+		err := rows.Scan(&p.Id, &p.Username, &p.Amount, utils.ScanTime(&p.Time), &p.Url)
 		if err != nil {
 			log.Printf("error parsing database rows\n%v", err)
 			return nil, err
@@ -52,61 +62,113 @@ func (d *sqlDb) GetPayment(username, id string) (*models.Payment, error) {
 	return nil, &NotFound{fmt.Sprintf("payment %v", id)}
 }
 
-func (d *sqlDb) GetPayments(username string, paymentArgs *models.PaymentArgs) ([]models.Payment, error) {
-	whereStatement, args := utils.SqlWhere([]utils.SqlCondition{
+var paymentSortColumns = map[string]string{
+	models.SortTime:   "time",
+	models.SortAmount: "amount",
+	models.SortUrl:    "url",
+}
+
+func paymentConditions(username string, paymentArgs *models.PaymentArgs) ([]utils.SqlCondition, error) {
+	conditions := []utils.SqlCondition{
+		utils.SqlCondition{"id", "IN", paymentArgs.Ids},
 		utils.SqlCondition{"time", ">=", paymentArgs.Oldest},
 		utils.SqlCondition{"time", "<=", paymentArgs.Newest},
 		utils.SqlCondition{"amount", ">=", paymentArgs.MinAmount},
 		utils.SqlCondition{"amount", "<=", paymentArgs.MaxAmount},
-		utils.SqlCondition{"url", "LIKE", "%" + paymentArgs.Url + "%"},
 		utils.SqlCondition{"username", "=", username},
+	}
+
+	if paymentArgs.Url != nil {
+		switch paymentArgs.UrlMatch {
+		case "", models.UrlMatchContains:
+			conditions = append(conditions, utils.SqlCondition{"url", "LIKE", "%" + *paymentArgs.Url + "%"})
+		case models.UrlMatchExact:
+			conditions = append(conditions, utils.SqlCondition{"url", "=", paymentArgs.Url})
+		default:
+			return nil, &BadQuery{fmt.Sprintf("urlmatch must be '%v' or '%v'", models.UrlMatchContains, models.UrlMatchExact)}
+		}
+	}
+
+	return conditions, nil
+}
+
+func (d *sqlDb) GetPayments(username string, paymentArgs *models.PaymentArgs) ([]models.Payment, error) {
+	payments := []models.Payment{}
+	err := d.EachPayment(username, paymentArgs, func(payment *models.Payment) error {
+		payments = append(payments, *payment)
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+// Calls fn with each payment matching paymentArgs as it is read, so listings
+// of any length can be streamed. Stops at, and returns, the first error fn
+// returns
+func (d *sqlDb) EachPayment(username string, paymentArgs *models.PaymentArgs, fn func(payment *models.Payment) error) error {
+	sort, err := sqlSort(paymentSortColumns, paymentArgs.Sort, paymentArgs.Order)
+	if err != nil {
+		return err
+	}
+
+	conditions, err := paymentConditions(username, paymentArgs)
+	if err != nil {
+		return err
+	}
+	whereStatement, args := utils.SqlWhere(conditions)
+
+	if !paymentArgs.Cursor.IsZero() {
+		whereStatement, args, err = sqlAfterCursor(whereStatement, args, paymentSortColumns, sort, paymentArgs.Cursor)
+		if err != nil {
+			return err
+		}
+	}
 
 	var pagination string
 	if paymentArgs.Count != 0 {
 		pagination += fmt.Sprintf("LIMIT %v ", paymentArgs.Count)
 	}
-	if paymentArgs.Offset != 0 {
-		pagination += fmt.Sprintf("OFFSET %v", paymentArgs.Offset)
+	if paymentArgs.Offset != 0 && paymentArgs.Cursor.IsZero() {
+		pagination += fmt.Sprintf("OFFSET %v ", paymentArgs.Offset)
 	}
 
 	rows, err := d.db.Query(`
-        SELECT id, username, amount, time, url FROM Payments `+whereStatement+` ORDER BY time DESC
+        SELECT id, username, amount, time, url FROM Payments `+whereStatement+` `+utils.SqlOrderBy(sort)+`
     `+pagination, args...)
 	if err != nil {
 		log.Printf("error reading payments from database for user %v\n%v", username, err)
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	payments := []models.Payment{}
 	for rows.Next() {
 		p := models.Payment{}
-		err := rows.Scan(&p.Id, &p.Username, &p.Amount, &p.Time, &p.Url)
+		err := rows.Scan(&p.Id, &p.Username, &p.Amount, utils.ScanTime(&p.Time), &p.Url)
 		if err != nil {
 			log.Printf("error parsing database rows\n%v", err)
-			return nil, err
+			return err
+		}
+		if err := fn(&p); err != nil {
+			return err
 		}
-		payments = append(payments, p)
 	}
 
-	return payments, nil
+	return rows.Err()
 }
 
 func (d *sqlDb) GetPaymentsSum(username string, paymentArgs *models.PaymentArgs) (int, error) {
 	var sum int
 
-	whereStatement, args := utils.SqlWhere([]utils.SqlCondition{
-		utils.SqlCondition{"time", ">=", paymentArgs.Oldest},
-		utils.SqlCondition{"time", "<=", paymentArgs.Newest},
-		utils.SqlCondition{"amount", ">=", paymentArgs.MinAmount},
-		utils.SqlCondition{"amount", "<=", paymentArgs.MaxAmount},
-		utils.SqlCondition{"url", "LIKE", "%" + paymentArgs.Url + "%"},
-		utils.SqlCondition{"username", "=", username},
-	})
+	conditions, err := paymentConditions(username, paymentArgs)
+	if err != nil {
+		return sum, err
+	}
+	whereStatement, args := utils.SqlWhere(conditions)
 
 	rows, err := d.db.Query(`
-        SELECT SUM(amount) FROM Payments `+whereStatement+`
+        SELECT COALESCE(SUM(amount), 0) FROM Payments `+whereStatement+`
     `, args...)
 	if err != nil {
 		log.Printf("error summing payments from database for user %v\n%v", username, err)
@@ -124,3 +186,83 @@ func (d *sqlDb) GetPaymentsSum(username string, paymentArgs *models.PaymentArgs)
 
 	return sum, nil
 }
+
+// Expressions grouping payments by the UTC period they were made in. Weeks
+// start on Monday and are keyed by that day's date
+var paymentPeriodGroups = map[string]string{
+	models.GroupDay:   "strftime('%Y-%m-%d', time / 1000000000, 'unixepoch')",
+	models.GroupWeek:  "date(time / 1000000000, 'unixepoch', 'weekday 0', '-6 days')",
+	models.GroupMonth: "strftime('%Y-%m-01', time / 1000000000, 'unixepoch')",
+}
+
+// Sums and counts payments by group. Periods are returned oldest first, urls
+// and domains are returned with the largest sum first
+func (d *sqlDb) GetPaymentsAggregate(username string, group string, paymentArgs *models.PaymentArgs) ([]models.PaymentAggregate, error) {
+	var groupExpression, order string
+	switch group {
+	case models.GroupDomain, models.GroupUrl:
+		// urls are folded into domains below, as SQLite cannot parse them
+		groupExpression = "url"
+		order = "SUM(amount) DESC"
+	default:
+		var ok bool
+		if groupExpression, ok = paymentPeriodGroups[group]; !ok {
+			return nil, &BadQuery{fmt.Sprintf("cannot group payments by '%v'", group)}
+		}
+		order = "1 ASC"
+	}
+
+	conditions, err := paymentConditions(username, paymentArgs)
+	if err != nil {
+		return nil, err
+	}
+	whereStatement, args := utils.SqlWhere(conditions)
+
+	rows, err := d.db.Query(`
+        SELECT `+groupExpression+`, SUM(amount), COUNT(*) FROM Payments `+whereStatement+`
+        GROUP BY 1 ORDER BY `+order+`
+    `, args...)
+	if err != nil {
+		log.Printf("error aggregating payments from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	aggregates := []models.PaymentAggregate{}
+	for rows.Next() {
+		a := models.PaymentAggregate{}
+		err := rows.Scan(&a.Key, &a.Sum, &a.Count)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		aggregates = append(aggregates, a)
+	}
+
+	if group == models.GroupDomain {
+		aggregates = aggregateByDomain(aggregates)
+	}
+
+	return aggregates, nil
+}
+
+func aggregateByDomain(byUrl []models.PaymentAggregate) []models.PaymentAggregate {
+	indexes := map[string]int{}
+	byDomain := []models.PaymentAggregate{}
+	for _, a := range byUrl {
+		domain := utils.Domain(a.Key)
+		i, ok := indexes[domain]
+		if !ok {
+			i = len(byDomain)
+			indexes[domain] = i
+			byDomain = append(byDomain, models.PaymentAggregate{Key: domain})
+		}
+		byDomain[i].Sum += a.Sum
+		byDomain[i].Count += a.Count
+	}
+
+	sort.SliceStable(byDomain, func(i, j int) bool {
+		return byDomain[i].Sum > byDomain[j].Sum
+	})
+	return byDomain
+}
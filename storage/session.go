@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type session interface {
+	CreateSession(session *models.Session) error
+	GetSession(username, id string) (*models.Session, error)
+	GetSessions(username string) ([]models.Session, error)
+	RotateSessionRefreshToken(id, previousRefreshId, refreshId string, lastUsed time.Time) error
+	RevokeSession(username, id string) error
+	RevokeSessions(username string) error
+	CompromiseSession(username, id string) error
+	RevokeOAuthClientSessions(clientId string) error
+}
+
+func (d *sqlDb) CreateSession(session *models.Session) error {
+	_, err := d.db.Exec(`
+        INSERT INTO Sessions (id, username, refreshid, device, useragent, ip, clientid, scope, created, lastused)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, session.Id, session.Username, session.RefreshId, session.Device, session.UserAgent, session.Ip,
+		session.ClientId, session.Scope, utils.SqlTime(session.Created), utils.SqlTime(session.LastUsed))
+	if err != nil {
+		log.Printf("error inserting session %v into the database\n %v", session, err)
+	}
+	return err
+}
+
+func (d *sqlDb) GetSession(username, id string) (*models.Session, error) {
+	rows, err := d.db.Query(`
+        SELECT id, username, refreshid, device, useragent, ip, clientid, scope, created, lastused, revoked, compromised FROM Sessions WHERE id = ? AND username = ?
+    `, id, username)
+	if err != nil {
+		log.Printf("error reading session %v from database for user %v\n%v", id, username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		s := &models.Session{}
+		err := rows.Scan(&s.Id, &s.Username, &s.RefreshId, &s.Device, &s.UserAgent, &s.Ip, &s.ClientId, &s.Scope,
+			utils.ScanTime(&s.Created), utils.ScanTime(&s.LastUsed), &s.Revoked, &s.Compromised)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		return s, nil
+	}
+
+	return nil, &NotFound{fmt.Sprintf("session %v", id)}
+}
+
+// Returns the sessions of a user that have not been revoked, along with any
+// revoked because they were compromised, most recently used first
+func (d *sqlDb) GetSessions(username string) ([]models.Session, error) {
+	rows, err := d.db.Query(`
+        SELECT id, username, refreshid, device, useragent, ip, clientid, scope, created, lastused, revoked, compromised FROM Sessions
+        WHERE username = ? AND (NOT revoked OR compromised) ORDER BY lastused DESC
+    `, username)
+	if err != nil {
+		log.Printf("error reading sessions from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		s := models.Session{}
+		err := rows.Scan(&s.Id, &s.Username, &s.RefreshId, &s.Device, &s.UserAgent, &s.Ip, &s.ClientId, &s.Scope,
+			utils.ScanTime(&s.Created), utils.ScanTime(&s.LastUsed), &s.Revoked, &s.Compromised)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, nil
+}
+
+// Replaces the session's refresh token id, provided previousRefreshId is still
+// the current one. Returns NotFound if it is not, meaning the refresh token
+// being used has already been rotated out
+func (d *sqlDb) RotateSessionRefreshToken(id, previousRefreshId, refreshId string, lastUsed time.Time) error {
+	resp, err := d.db.Exec(`
+        UPDATE Sessions SET refreshid = ?, lastused = ? WHERE id = ? AND refreshid = ? AND NOT revoked
+    `, refreshId, utils.SqlTime(lastUsed), id, previousRefreshId)
+	if err != nil {
+		log.Printf("error rotating refresh token of session %v\n %v", id, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by refresh token rotation\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("session %v with refresh token %v", id, previousRefreshId)}
+	}
+
+	return nil
+}
+
+func (d *sqlDb) RevokeSession(username, id string) error {
+	resp, err := d.db.Exec(`
+        UPDATE Sessions SET revoked = TRUE WHERE id = ? AND username = ? AND NOT revoked
+    `, id, username)
+	if err != nil {
+		log.Printf("error revoking session %v for user %v\n %v", id, username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by session revocation\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("session %v", id)}
+	}
+
+	d.publishSessionRevoked(username, id)
+	return nil
+}
+
+func (d *sqlDb) RevokeSessions(username string) error {
+	return d.revokeSessions(`
+        SELECT id, username FROM Sessions WHERE username = ? AND NOT revoked
+    `, `
+        UPDATE Sessions SET revoked = TRUE WHERE username = ?
+    `, username)
+}
+
+// Revokes a session whose refresh tokens have leaked, flagging it so the user
+// can see which device was affected
+func (d *sqlDb) CompromiseSession(username, id string) error {
+	_, err := d.db.Exec(`
+        UPDATE Sessions SET revoked = TRUE, compromised = TRUE WHERE id = ? AND username = ?
+    `, id, username)
+	if err != nil {
+		log.Printf("error flagging session %v for user %v as compromised\n %v", id, username, err)
+		return err
+	}
+
+	d.publishSessionRevoked(username, id)
+	return nil
+}
+
+// Revokes every session granted to a third-party app
+func (d *sqlDb) RevokeOAuthClientSessions(clientId string) error {
+	return d.revokeSessions(`
+        SELECT id, username FROM Sessions WHERE clientid = ? AND NOT revoked
+    `, `
+        UPDATE Sessions SET revoked = TRUE WHERE clientid = ?
+    `, clientId)
+}
+
+// Revokes the sessions update matches, publishing the revocation of those
+// query finds still active. Both take the one argument
+func (d *sqlDb) revokeSessions(query, update string, arg interface{}) error {
+	rows, err := d.db.Query(query, arg)
+	if err != nil {
+		log.Printf("error reading sessions of %v to revoke\n %v", arg, err)
+		return err
+	}
+	defer rows.Close()
+
+	revoked := []models.Session{}
+	for rows.Next() {
+		s := models.Session{}
+		if err := rows.Scan(&s.Id, &s.Username); err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return err
+		}
+		revoked = append(revoked, s)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("error reading sessions of %v to revoke\n %v", arg, err)
+		return err
+	}
+	// done with the rows before updating the table they're read from
+	rows.Close()
+
+	_, err = d.db.Exec(update, arg)
+	if err != nil {
+		log.Printf("error revoking sessions of %v\n %v", arg, err)
+		return err
+	}
+
+	for _, s := range revoked {
+		d.publishSessionRevoked(s.Username, s.Id)
+	}
+	return nil
+}
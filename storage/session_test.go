@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/crowdpower/fund/events"
+	"github.com/crowdpower/fund/models"
+)
+
+func createTestSession(t *testing.T, d *sqlDb, username, id, refreshId string) {
+	now := time.Now().UTC()
+	err := d.CreateSession(&models.Session{Id: id, Username: username, RefreshId: refreshId, Created: now, LastUsed: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotateSessionRefreshToken(t *testing.T) {
+	d := newTestDB(t)
+	createTestUser(t, d, "alice")
+	createTestSession(t, d, "alice", "session", "refresh1")
+
+	if err := d.RotateSessionRefreshToken("session", "refresh1", "refresh2", time.Now().UTC()); err != nil {
+		t.Fatalf("rotating the current refresh token returned %v", err)
+	}
+	session, err := d.GetSession("alice", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.RefreshId != "refresh2" {
+		t.Fatalf("refresh id after rotation %v, want refresh2", session.RefreshId)
+	}
+
+	// a used refresh token is how a leak shows, so must not rotate again
+	err = d.RotateSessionRefreshToken("session", "refresh1", "refresh3", time.Now().UTC())
+	if !IsNotFound(err) {
+		t.Fatalf("rotating a used refresh token returned %v, want NotFound", err)
+	}
+	if session, _ := d.GetSession("alice", "session"); session.RefreshId != "refresh2" {
+		t.Fatalf("refresh id after reuse %v, want refresh2", session.RefreshId)
+	}
+}
+
+func TestRotateRevokedSessionRefreshToken(t *testing.T) {
+	d := newTestDB(t)
+	createTestUser(t, d, "alice")
+	createTestSession(t, d, "alice", "revoked", "refresh1")
+	createTestSession(t, d, "alice", "compromised", "refresh1")
+
+	if err := d.RevokeSession("alice", "revoked"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CompromiseSession("alice", "compromised"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"revoked", "compromised"} {
+		err := d.RotateSessionRefreshToken(id, "refresh1", "refresh2", time.Now().UTC())
+		if !IsNotFound(err) {
+			t.Fatalf("rotating the refresh token of a %v session returned %v, want NotFound", id, err)
+		}
+	}
+}
+
+func TestRevokeOAuthClientSessionsPublishes(t *testing.T) {
+	d := newTestDB(t)
+	createTestUser(t, d, "alice")
+	now := time.Now().UTC()
+	for id, clientId := range map[string]string{"app1": "client", "app2": "client", "other": "other client"} {
+		err := d.CreateSession(&models.Session{Id: id, Username: "alice", RefreshId: id, ClientId: clientId, Created: now, LastUsed: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ch, unsubscribe := d.events.Subscribe("alice")
+	defer unsubscribe()
+
+	// nothing is published by a transaction that rolls back
+	errRollback := errors.New("rollback")
+	err := d.WithTx(context.Background(), func(tx Tx) error {
+		if err := tx.RevokeOAuthClientSessions("client"); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatal(err)
+	}
+	if len(ch) != 0 {
+		t.Fatalf("rolled back revocation published %v events, want 0", len(ch))
+	}
+
+	err = d.WithTx(context.Background(), func(tx Tx) error {
+		return tx.RevokeOAuthClientSessions("client")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := map[string]bool{}
+	for len(ch) > 0 {
+		e := <-ch
+		data, ok := e.Data.(events.SessionRevoked)
+		if e.Type != events.TypeSessionRevoked || !ok {
+			t.Fatalf("revocation published %+v, want session revoked events", e)
+		}
+		revoked[data.Session] = true
+	}
+	if len(revoked) != 2 || !revoked["app1"] || !revoked["app2"] {
+		t.Fatalf("revocation published events for sessions %v, want app1 and app2", revoked)
+	}
+	if session, _ := d.GetSession("alice", "other"); session.Revoked {
+		t.Fatal("session of another client revoked")
+	}
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type site interface {
+	CreateSite(site *models.Site) error
+	GetSite(id string) (*models.Site, error)
+	GetSites(username string) ([]models.Site, error)
+	DeleteSite(username, id string) error
+	VerifySite(id string) error
+	CreateApiKey(key *models.ApiKey) error
+	GetApiKey(siteId, id string) (*models.ApiKey, error)
+	GetApiKeyByPrefix(prefix string) (*models.ApiKey, error)
+	GetApiKeys(siteId string) ([]models.ApiKey, error)
+	UpdateApiKeyUse(id string, lastUsed time.Time) error
+	ExpireApiKey(siteId, id string, expires time.Time) error
+	RevokeApiKey(siteId, id string) error
+}
+
+func (d *sqlDb) CreateSite(site *models.Site) error {
+	_, err := d.db.Exec(`
+        INSERT INTO Sites (id, username, name, domain, verificationtoken, verified, created) VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, site.Id, site.Username, site.Name, site.Domain, site.VerificationToken, site.Verified, utils.SqlTime(site.Created))
+	if err != nil {
+		log.Printf("error inserting site %v into the database\n %v", site.Id, err)
+	}
+	return err
+}
+
+func (d *sqlDb) GetSite(id string) (*models.Site, error) {
+	sites, err := d.getSites(`
+        SELECT id, username, name, domain, verificationtoken, verified, created FROM Sites WHERE id = ?
+    `, id)
+	if err != nil {
+		log.Printf("error reading site %v from database\n%v", id, err)
+		return nil, err
+	}
+
+	if len(sites) == 0 {
+		return nil, &NotFound{fmt.Sprintf("site %v", id)}
+	}
+	return &sites[0], nil
+}
+
+func (d *sqlDb) GetSites(username string) ([]models.Site, error) {
+	sites, err := d.getSites(`
+        SELECT id, username, name, domain, verificationtoken, verified, created FROM Sites WHERE username = ? ORDER BY created
+    `, username)
+	if err != nil {
+		log.Printf("error reading sites from database for user %v\n%v", username, err)
+	}
+	return sites, err
+}
+
+func (d *sqlDb) getSites(query string, args ...interface{}) ([]models.Site, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sites := []models.Site{}
+	for rows.Next() {
+		s := models.Site{}
+		err := rows.Scan(&s.Id, &s.Username, &s.Name, &s.Domain, &s.VerificationToken, &s.Verified, utils.ScanTime(&s.Created))
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		sites = append(sites, s)
+	}
+
+	return sites, nil
+}
+
+// Deletes a site along with its keys and its place on supporters' lists
+func (d *sqlDb) DeleteSite(username, id string) error {
+	// foreign keys aren't always enforced, so rows that would cascade are
+	// deleted here too
+	for _, statement := range []string{
+		`DELETE FROM ApiKeys WHERE siteid IN (SELECT id FROM Sites WHERE id = ? AND username = ?)`,
+		`DELETE FROM SupporterSites WHERE siteid IN (SELECT id FROM Sites WHERE id = ? AND username = ?)`,
+	} {
+		if _, err := d.db.Exec(statement, id, username); err != nil {
+			log.Printf("error deleting keys and supporters of site %v for user %v\n %v", id, username, err)
+			return err
+		}
+	}
+
+	resp, err := d.db.Exec(`
+        DELETE FROM Sites WHERE id = ? AND username = ?
+    `, id, username)
+	if err != nil {
+		log.Printf("error deleting site %v for user %v\n %v", id, username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by delete\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("site %v", id)}
+	}
+
+	return nil
+}
+
+func (d *sqlDb) VerifySite(id string) error {
+	_, err := d.db.Exec(`
+        UPDATE Sites SET verified = TRUE WHERE id = ?
+    `, id)
+	if err != nil {
+		log.Printf("error verifying site %v\n %v", id, err)
+	}
+	return err
+}
+
+func (d *sqlDb) CreateApiKey(key *models.ApiKey) error {
+	_, err := d.db.Exec(`
+        INSERT INTO ApiKeys (id, siteid, name, prefix, hash, scope, created) VALUES (?, ?, ?, ?, ?, ?, ?)
+    `, key.Id, key.SiteId, key.Name, key.Prefix, key.Hash, key.Scope, utils.SqlTime(key.Created))
+	if err != nil {
+		log.Printf("error inserting api key %v into the database\n %v", key.Id, err)
+	}
+	return err
+}
+
+func (d *sqlDb) GetApiKey(siteId, id string) (*models.ApiKey, error) {
+	keys, err := d.getApiKeys(`
+        SELECT id, siteid, name, prefix, hash, scope, created, lastused, expires, revoked FROM ApiKeys WHERE id = ? AND siteid = ?
+    `, id, siteId)
+	if err != nil {
+		log.Printf("error reading api key %v from database for site %v\n%v", id, siteId, err)
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, &NotFound{fmt.Sprintf("api key %v", id)}
+	}
+	return &keys[0], nil
+}
+
+func (d *sqlDb) GetApiKeyByPrefix(prefix string) (*models.ApiKey, error) {
+	keys, err := d.getApiKeys(`
+        SELECT id, siteid, name, prefix, hash, scope, created, lastused, expires, revoked FROM ApiKeys WHERE prefix = ?
+    `, prefix)
+	if err != nil {
+		log.Printf("error reading api key %v from database\n%v", prefix, err)
+		return nil, err
+	}
+
+	if len(keys) == 0 {
+		return nil, &NotFound{fmt.Sprintf("api key %v", prefix)}
+	}
+	return &keys[0], nil
+}
+
+// Returns the keys of a site that have not been revoked, oldest first
+func (d *sqlDb) GetApiKeys(siteId string) ([]models.ApiKey, error) {
+	keys, err := d.getApiKeys(`
+        SELECT id, siteid, name, prefix, hash, scope, created, lastused, expires, revoked FROM ApiKeys
+        WHERE siteid = ? AND NOT revoked ORDER BY created
+    `, siteId)
+	if err != nil {
+		log.Printf("error reading api keys from database for site %v\n%v", siteId, err)
+	}
+	return keys, err
+}
+
+func (d *sqlDb) getApiKeys(query string, args ...interface{}) ([]models.ApiKey, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []models.ApiKey{}
+	for rows.Next() {
+		k := models.ApiKey{}
+		var lastUsed, expires int64
+		err := rows.Scan(&k.Id, &k.SiteId, &k.Name, &k.Prefix, &k.Hash, &k.Scope, utils.ScanTime(&k.Created),
+			&lastUsed, &expires, &k.Revoked)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		// 0 stands for never
+		if lastUsed != 0 {
+			t := time.Unix(0, lastUsed).UTC()
+			k.LastUsed = &t
+		}
+		if expires != 0 {
+			t := time.Unix(0, expires).UTC()
+			k.Expires = &t
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+func (d *sqlDb) UpdateApiKeyUse(id string, lastUsed time.Time) error {
+	_, err := d.db.Exec(`
+        UPDATE ApiKeys SET lastused = ? WHERE id = ?
+    `, utils.SqlTime(lastUsed), id)
+	if err != nil {
+		log.Printf("error updating use of api key %v\n %v", id, err)
+	}
+	return err
+}
+
+// Makes a key stop working at expires, unless it already expires sooner
+func (d *sqlDb) ExpireApiKey(siteId, id string, expires time.Time) error {
+	resp, err := d.db.Exec(`
+        UPDATE ApiKeys SET expires = ? WHERE id = ? AND siteid = ? AND NOT revoked AND (expires = 0 OR expires > ?)
+    `, utils.SqlTime(expires), id, siteId, utils.SqlTime(expires))
+	if err != nil {
+		log.Printf("error expiring api key %v for site %v\n %v", id, siteId, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by api key expiry\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("api key %v", id)}
+	}
+
+	return nil
+}
+
+func (d *sqlDb) RevokeApiKey(siteId, id string) error {
+	resp, err := d.db.Exec(`
+        UPDATE ApiKeys SET revoked = TRUE WHERE id = ? AND siteid = ? AND NOT revoked
+    `, id, siteId)
+	if err != nil {
+		log.Printf("error revoking api key %v for site %v\n %v", id, siteId, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by api key revocation\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("api key %v", id)}
+	}
+
+	return nil
+}
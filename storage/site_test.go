@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestDeleteSite(t *testing.T) {
+	d := newTestDB(t)
+	createTestAccount(t, d, "alice")
+	createTestUser(t, d, "bob")
+
+	if err := d.DeleteSite("bob", "alice-site"); !IsNotFound(err) {
+		t.Fatalf("deleting another user's site returned %v, want NotFound", err)
+	}
+	if _, err := d.GetApiKeyByPrefix("alice"); err != nil {
+		t.Fatalf("getting the key of a site another user failed to delete returned %v", err)
+	}
+
+	if err := d.DeleteSite("alice", "alice-site"); err != nil {
+		t.Fatal(err)
+	}
+	// foreign keys aren't enforced, so nothing cascades on its own
+	if left := countTestRows(t, d, "siteid", "alice-site"); len(left) != 0 {
+		t.Fatalf("rows of the deleted site left behind %v", left)
+	}
+	if _, err := d.GetApiKeyByPrefix("alice"); !IsNotFound(err) {
+		t.Fatalf("getting the key of a deleted site returned %v, want NotFound", err)
+	}
+}
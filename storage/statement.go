@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type statement interface {
+	GetStatement(username, month string) (*models.Statement, error)
+	CreateStatement(statement *models.Statement) error
+}
+
+// Returns a stored statement, NotFound if it hasn't been generated yet
+func (d *sqlDb) GetStatement(username, month string) (*models.Statement, error) {
+	var data string
+	err := d.db.QueryRow(`
+        SELECT data FROM Statements WHERE username = ? AND month = ?
+    `, username, month).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, &NotFound{fmt.Sprintf("statement %v", month)}
+	} else if err != nil {
+		log.Printf("error reading statement %v from database for user %v\n%v", month, username, err)
+		return nil, err
+	}
+
+	s := &models.Statement{}
+	err = json.Unmarshal([]byte(data), s)
+	if err != nil {
+		log.Printf("error parsing statement %v of user %v\n%v", month, username, err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Stores a statement. A statement already stored for the month is kept, as
+// both were generated from the same closed month
+func (d *sqlDb) CreateStatement(statement *models.Statement) error {
+	data, err := json.Marshal(statement)
+	if err != nil {
+		log.Printf("error marshalling statement %v of user %v\n%v", statement.Month, statement.Username, err)
+		return err
+	}
+
+	_, err = d.db.Exec(`
+        INSERT OR IGNORE INTO Statements (username, month, data, generated) VALUES (?, ?, ?, ?)
+    `, statement.Username, statement.Month, string(data), utils.SqlTime(statement.Generated))
+	if err != nil {
+		log.Printf("error inserting statement %v of user %v into the database\n %v", statement.Month,
+			statement.Username, err)
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type supporter interface {
+	GetPublicProfile(username string) (*models.PublicProfile, error)
+	GetSupporterProfile(siteId, id string) (*models.PublicProfile, error)
+	DisplayNameTaken(displayName, username string) (bool, error)
+	SetPublicProfile(profile *models.PublicProfile) error
+	DeletePublicProfile(username string) error
+	GetSupporterSite(username, siteId string) (*models.SupporterSite, error)
+	GetSupporterSites(username string) ([]models.SupporterSite, error)
+	CreateSupporterSite(site *models.SupporterSite) error
+	DeleteSupporterSite(username, siteId string) error
+	GetSupporters(siteId, domain string, since time.Time) ([]models.Supporter, error)
+}
+
+func (d *sqlDb) GetPublicProfile(username string) (*models.PublicProfile, error) {
+	return d.getPublicProfile(`
+        SELECT id, username, displayname, bio, showamounts, created FROM PublicProfiles WHERE username = ?
+    `, username)
+}
+
+// Returns the public profile of the user whose id on the site's lists is id,
+// with Created set to when they chose to appear on them
+func (d *sqlDb) GetSupporterProfile(siteId, id string) (*models.PublicProfile, error) {
+	return d.getPublicProfile(`
+        SELECT pp.id, pp.username, pp.displayname, pp.bio, pp.showamounts, ss.created
+        FROM SupporterSites ss JOIN PublicProfiles pp ON pp.username = ss.username
+        WHERE ss.siteid = ? AND ss.id = ?
+    `, siteId, id)
+}
+
+func (d *sqlDb) getPublicProfile(query string, args ...interface{}) (*models.PublicProfile, error) {
+	p := &models.PublicProfile{}
+	err := d.db.QueryRow(query, args...).Scan(&p.Id, &p.Username, &p.DisplayName, &p.Bio, &p.ShowAmounts,
+		utils.ScanTime(&p.Created))
+	if err == sql.ErrNoRows {
+		return nil, &NotFound{"public profile"}
+	} else if err != nil {
+		log.Printf("error reading public profile from database\n%v", err)
+		return nil, err
+	}
+	return p, nil
+}
+
+// Whether a user other than username has a public profile with the display
+// name, ignoring case
+func (d *sqlDb) DisplayNameTaken(displayName, username string) (bool, error) {
+	var count int
+	err := d.db.QueryRow(`
+        SELECT COUNT(*) FROM PublicProfiles WHERE displayname = ? COLLATE NOCASE AND username != ?
+    `, displayName, username).Scan(&count)
+	if err != nil {
+		log.Printf("error checking display name %v is free\n%v", displayName, err)
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Sets the user's public profile, replacing any they had
+func (d *sqlDb) SetPublicProfile(profile *models.PublicProfile) error {
+	_, err := d.db.Exec(`
+        INSERT OR REPLACE INTO PublicProfiles (id, username, displayname, bio, showamounts, created)
+        VALUES (?, ?, ?, ?, ?, ?)
+    `, profile.Id, profile.Username, profile.DisplayName, profile.Bio, profile.ShowAmounts,
+		utils.SqlTime(profile.Created))
+	if err != nil {
+		log.Printf("error setting public profile of user %v\n %v", profile.Username, err)
+	}
+	return err
+}
+
+// Deletes the user's public profile, taking them off the lists of every site
+// they chose. Must be called on a transaction
+func (d *sqlDb) DeletePublicProfile(username string) error {
+	_, err := d.db.Exec(`DELETE FROM SupporterSites WHERE username = ?`, username)
+	if err != nil {
+		log.Printf("error deleting supporter sites of user %v\n %v", username, err)
+		return err
+	}
+
+	resp, err := d.db.Exec(`DELETE FROM PublicProfiles WHERE username = ?`, username)
+	if err != nil {
+		log.Printf("error deleting public profile of user %v\n %v", username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by delete\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{"public profile"}
+	}
+
+	return nil
+}
+
+// Returns the site the user has chosen to appear on the lists of, NotFound if
+// they haven't
+func (d *sqlDb) GetSupporterSite(username, siteId string) (*models.SupporterSite, error) {
+	s := &models.SupporterSite{}
+	err := d.db.QueryRow(`
+        SELECT id, username, siteid, created FROM SupporterSites WHERE username = ? AND siteid = ?
+    `, username, siteId).Scan(&s.Id, &s.Username, &s.SiteId, utils.ScanTime(&s.Created))
+	if err == sql.ErrNoRows {
+		return nil, &NotFound{"supporter site"}
+	} else if err != nil {
+		log.Printf("error reading supporter site %v of user %v from database\n%v", siteId, username, err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns the sites the user has chosen to appear on the lists of, oldest
+// first
+func (d *sqlDb) GetSupporterSites(username string) ([]models.SupporterSite, error) {
+	rows, err := d.db.Query(`
+        SELECT id, username, siteid, created FROM SupporterSites WHERE username = ? ORDER BY created, id
+    `, username)
+	if err != nil {
+		log.Printf("error reading supporter sites from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	sites := []models.SupporterSite{}
+	for rows.Next() {
+		s := models.SupporterSite{}
+		err := rows.Scan(&s.Id, &s.Username, &s.SiteId, utils.ScanTime(&s.Created))
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		sites = append(sites, s)
+	}
+
+	return sites, nil
+}
+
+func (d *sqlDb) CreateSupporterSite(site *models.SupporterSite) error {
+	_, err := d.db.Exec(`
+        INSERT INTO SupporterSites (id, username, siteid, created) VALUES (?, ?, ?, ?)
+    `, site.Id, site.Username, site.SiteId, utils.SqlTime(site.Created))
+	if err != nil {
+		log.Printf("error inserting supporter site %v of user %v into the database\n %v", site.SiteId, site.Username, err)
+	}
+	return err
+}
+
+func (d *sqlDb) DeleteSupporterSite(username, siteId string) error {
+	resp, err := d.db.Exec(`DELETE FROM SupporterSites WHERE username = ? AND siteid = ?`, username, siteId)
+	if err != nil {
+		log.Printf("error deleting supporter site %v of user %v\n %v", siteId, username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by delete\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{"supporter site"}
+	}
+
+	return nil
+}
+
+// Returns the users who chose to appear on the site's lists and have paid
+// urls on domain or its subdomains since a time, with the largest total
+// first. Only the payments of those users are looked at
+func (d *sqlDb) GetSupporters(siteId, domain string, since time.Time) ([]models.Supporter, error) {
+	whereStatement, args := utils.SqlWhere([]utils.SqlCondition{
+		{"ss.siteid", "=", siteId},
+		{"p.url", "LIKE", "%" + domain + "%"},
+		{"p.time", ">=", since},
+	})
+
+	rows, err := d.db.Query(`
+        SELECT ss.id, pp.displayname, pp.showamounts, p.url, SUM(p.amount)
+        FROM SupporterSites ss
+        JOIN PublicProfiles pp ON pp.username = ss.username
+        JOIN Payments p ON p.username = ss.username
+        `+whereStatement+` GROUP BY ss.id, p.url
+    `, args...)
+	if err != nil {
+		log.Printf("error reading supporters of %v from database\n%v", domain, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	indexes := map[string]int{}
+	supporters := []models.Supporter{}
+	for rows.Next() {
+		var s models.Supporter
+		var url string
+		var sum int
+		err := rows.Scan(&s.Id, &s.DisplayName, &s.ShowAmounts, &url, &sum)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+
+		// a url containing the domain may still point elsewhere
+		if !utils.InDomain(utils.Domain(url), domain) {
+			continue
+		}
+		i, ok := indexes[s.Id]
+		if !ok {
+			i = len(supporters)
+			indexes[s.Id] = i
+			supporters = append(supporters, s)
+		}
+		supporters[i].Total += sum
+	}
+
+	sort.SliceStable(supporters, func(i, j int) bool {
+		if supporters[i].Total != supporters[j].Total {
+			return supporters[i].Total > supporters[j].Total
+		}
+		return supporters[i].DisplayName < supporters[j].DisplayName
+	})
+	return supporters, nil
+}
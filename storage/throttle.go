@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"log"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type loginThrottle interface {
+	GetLoginThrottle(kind, subject string) (*models.LoginThrottle, error)
+	SetLoginThrottle(throttle *models.LoginThrottle) error
+	DeleteLoginThrottle(kind, subject string) error
+}
+
+// Returns the failed login attempts recorded against subject, or a throttle
+// with no failures if there are none
+func (d *sqlDb) GetLoginThrottle(kind, subject string) (*models.LoginThrottle, error) {
+	rows, err := d.db.Query(`
+        SELECT kind, subject, failures, lastfailure, lockeduntil FROM LoginThrottles WHERE kind = ? AND subject = ?
+    `, kind, subject)
+	if err != nil {
+		log.Printf("error reading %v login throttle from database for %v\n%v", kind, subject, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	t := &models.LoginThrottle{Kind: kind, Subject: subject}
+	if rows.Next() {
+		err := rows.Scan(&t.Kind, &t.Subject, &t.Failures, utils.ScanTime(&t.LastFailure), utils.ScanTime(&t.LockedUntil))
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (d *sqlDb) SetLoginThrottle(throttle *models.LoginThrottle) error {
+	_, err := d.db.Exec(`
+        INSERT OR REPLACE INTO LoginThrottles (kind, subject, failures, lastfailure, lockeduntil) VALUES (?, ?, ?, ?, ?)
+    `, throttle.Kind, throttle.Subject, throttle.Failures,
+		utils.SqlTime(throttle.LastFailure), utils.SqlTime(throttle.LockedUntil))
+	if err != nil {
+		log.Printf("error storing %v login throttle for %v\n %v", throttle.Kind, throttle.Subject, err)
+	}
+	return err
+}
+
+func (d *sqlDb) DeleteLoginThrottle(kind, subject string) error {
+	_, err := d.db.Exec(`
+        DELETE FROM LoginThrottles WHERE kind = ? AND subject = ?
+    `, kind, subject)
+	if err != nil {
+		log.Printf("error deleting %v login throttle for %v\n %v", kind, subject, err)
+	}
+	return err
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/crowdpower/fund/models"
+)
+
+type twoFactor interface {
+	SetTwoFactorSecret(username, secret string) error
+	GetTwoFactor(username string) (*models.TwoFactor, error)
+	EnableTwoFactor(username string) error
+	UpdateTwoFactorLastStep(username string, step int64) error
+	DeleteTwoFactor(username string) error
+	CreateRecoveryCodes(username string, hashes []string) error
+	UseRecoveryCode(username, hash string) error
+}
+
+// Stores a new secret for a user who has not enabled two-factor
+// authentication, replacing any earlier unconfirmed secret
+func (d *sqlDb) SetTwoFactorSecret(username, secret string) error {
+	_, err := d.db.Exec(`
+        INSERT OR REPLACE INTO TwoFactor (username, secret, enabled, laststep) VALUES (?, ?, FALSE, 0)
+    `, username, secret)
+	if err != nil {
+		log.Printf("error storing two-factor secret for user %v\n %v", username, err)
+	}
+	return err
+}
+
+func (d *sqlDb) GetTwoFactor(username string) (*models.TwoFactor, error) {
+	rows, err := d.db.Query(`
+        SELECT username, secret, enabled, laststep FROM TwoFactor WHERE username = ?
+    `, username)
+	if err != nil {
+		log.Printf("error reading two-factor secret from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		t := &models.TwoFactor{}
+		err := rows.Scan(&t.Username, &t.Secret, &t.Enabled, &t.LastStep)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		return t, nil
+	}
+
+	return nil, &NotFound{fmt.Sprintf("two-factor secret for user %v", username)}
+}
+
+func (d *sqlDb) EnableTwoFactor(username string) error {
+	resp, err := d.db.Exec(`
+        UPDATE TwoFactor SET enabled = TRUE WHERE username = ?
+    `, username)
+	if err != nil {
+		log.Printf("error enabling two-factor authentication for user %v\n %v", username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by two-factor update\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("two-factor secret for user %v", username)}
+	}
+
+	return nil
+}
+
+// Records that a code was accepted for step. Returns NotFound if a code for
+// this or a later step was already accepted, meaning the code is being replayed
+func (d *sqlDb) UpdateTwoFactorLastStep(username string, step int64) error {
+	resp, err := d.db.Exec(`
+        UPDATE TwoFactor SET laststep = ? WHERE username = ? AND laststep < ?
+    `, step, username, step)
+	if err != nil {
+		log.Printf("error updating two-factor step for user %v\n %v", username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by two-factor update\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("unused two-factor step %v for user %v", step, username)}
+	}
+
+	return nil
+}
+
+func (d *sqlDb) DeleteTwoFactor(username string) error {
+	_, err := d.db.Exec(`DELETE FROM RecoveryCodes WHERE username = ?`, username)
+	if err != nil {
+		log.Printf("error deleting recovery codes for user %v\n %v", username, err)
+		return err
+	}
+
+	_, err = d.db.Exec(`DELETE FROM TwoFactor WHERE username = ?`, username)
+	if err != nil {
+		log.Printf("error deleting two-factor secret for user %v\n %v", username, err)
+	}
+	return err
+}
+
+// Replaces a user's recovery codes, given as hashes
+func (d *sqlDb) CreateRecoveryCodes(username string, hashes []string) error {
+	_, err := d.db.Exec(`DELETE FROM RecoveryCodes WHERE username = ?`, username)
+	if err != nil {
+		log.Printf("error deleting recovery codes for user %v\n %v", username, err)
+		return err
+	}
+
+	for _, hash := range hashes {
+		_, err := d.db.Exec(`
+            INSERT INTO RecoveryCodes (username, hash) VALUES (?, ?)
+        `, username, hash)
+		if err != nil {
+			log.Printf("error inserting recovery code for user %v\n %v", username, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Marks a recovery code as used. Returns NotFound if the user has no unused
+// code with this hash
+func (d *sqlDb) UseRecoveryCode(username, hash string) error {
+	resp, err := d.db.Exec(`
+        UPDATE RecoveryCodes SET used = TRUE WHERE username = ? AND hash = ? AND NOT used
+    `, username, hash)
+	if err != nil {
+		log.Printf("error using recovery code for user %v\n %v", username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by recovery code update\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("recovery code for user %v", username)}
+	}
+
+	return nil
+}
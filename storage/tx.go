@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/crowdpower/fund/events"
+)
+
+const (
+	txMaxAttempts = 5
+	txRetryDelay  = time.Millisecond * 20
+)
+
+// Runs fn inside a single transaction, committing if fn returns nil and
+// rolling back otherwise. If the database reports that it is busy or that the
+// transaction could not be serialized, the whole transaction is retried, so fn
+// may be called more than once and should not have side effects outside of tx
+func (d *sqlDb) WithTx(ctx context.Context, fn func(tx Tx) error) error {
+	var err error
+	for attempt := 1; attempt <= txMaxAttempts; attempt++ {
+		err = d.runTx(ctx, fn)
+		if !isRetryable(err) {
+			return err
+		}
+
+		log.Printf("transaction attempt %v of %v failed, retrying\n%v", attempt, txMaxAttempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(txRetryDelay * time.Duration(attempt)):
+		}
+	}
+	return err
+}
+
+func (d *sqlDb) runTx(ctx context.Context, fn func(tx Tx) error) error {
+	tx, err := d.conn.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("error beginning transaction\n%v", err)
+		return err
+	}
+
+	txDb := &sqlDb{db: tx, events: d.events, pending: &[]events.Event{}}
+	err = fn(txDb)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Printf("error rolling back transaction\n%v", rollbackErr)
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("error committing transaction\n%v", err)
+		return err
+	}
+
+	for _, e := range *txDb.pending {
+		d.events.Publish(e)
+	}
+	return nil
+}
+
+func isRetryable(err error) bool {
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
@@ -12,8 +12,11 @@ type user interface {
 	CreateUser(user *models.User) error
 	GetUser(username string) (*models.User, error)
 	UpdateUser(username string, user *models.User) error
-	DeleteUser(username string) error
-	UpdateTokenValidity(username string, valid bool) error
+	AnonymiseUser(username, anonymous string) error
+	VerifyEmail(username, email string) error
+	SearchUsers(args *models.UserSearchArgs) ([]models.User, error)
+	SetUserFrozen(username string, frozen bool) error
+	SetUserRole(username, role string) error
 }
 
 func (d *sqlDb) CreateUser(user *models.User) error {
@@ -28,7 +31,8 @@ func (d *sqlDb) CreateUser(user *models.User) error {
 
 func (d *sqlDb) GetUser(username string) (*models.User, error) {
 	rows, err := d.db.Query(`
-        SELECT Users.username, Users.password, Users.email, COALESCE(Balances.balance, 0), Users.invalidatedtokens
+        SELECT Users.username, Users.password, Users.email, Users.emailverified, Users.role, Users.frozen,
+		Users.deleted, COALESCE(Balances.balance, 0)
 		FROM Users
 		LEFT JOIN Balances ON Users.username = Balances.username
 		WHERE Users.username = ?
@@ -41,7 +45,8 @@ func (d *sqlDb) GetUser(username string) (*models.User, error) {
 
 	if rows.Next() {
 		u := &models.User{}
-		err := rows.Scan(&u.Username, &u.Password, &u.Email, &u.Balance, &u.InvalidatedTokens)
+		err := rows.Scan(&u.Username, &u.Password, &u.Email, &u.EmailVerified, &u.Role, &u.Frozen, &u.Deleted,
+			&u.Balance)
 		if err != nil {
 			log.Printf("error parsing database rows\n%v", err)
 			return nil, err
@@ -62,8 +67,8 @@ func (d *sqlDb) UpdateUser(username string, user *models.User) error {
 	}
 
 	if user.Email != "" {
-		values = append(values, "email = ?")
-		args = append(args, user.Email)
+		values = append(values, "email = ?", "emailverified = email = ? AND emailverified")
+		args = append(args, user.Email, user.Email)
 	}
 
 	if len(args) == 0 {
@@ -75,6 +80,7 @@ func (d *sqlDb) UpdateUser(username string, user *models.User) error {
     `, append(args, username)...)
 	if err != nil {
 		log.Printf("error updating user %v into the database\n %v", username, err)
+		return err
 	}
 
 	rows, err := resp.RowsAffected()
@@ -87,11 +93,69 @@ func (d *sqlDb) UpdateUser(username string, user *models.User) error {
 		return &NotFound{fmt.Sprintf("user %v", username)}
 	}
 
-	return err
+	return nil
 }
 
-func (d *sqlDb) DeleteUser(username string) error {
+// Deletes a user's account, keeping its deposits, payments and adjustments
+// for accounting. The ledger rows move to a new user, named anonymous, with
+// no password or email, and everything else the user had is deleted. Must be
+// called on a transaction
+func (d *sqlDb) AnonymiseUser(username, anonymous string) error {
+	_, err := d.db.Exec(`
+        INSERT INTO Users (username, password, email, deleted) VALUES (?, '', '', TRUE)
+    `, anonymous)
+	if err != nil {
+		log.Printf("error inserting anonymised user %v into the database\n %v", anonymous, err)
+		return err
+	}
+
+	for _, table := range []string{"Deposits", "Payments", "Adjustments", "TopUps"} {
+		_, err := d.db.Exec(`UPDATE `+table+` SET username = ? WHERE username = ?`, anonymous, username)
+		if err != nil {
+			log.Printf("error moving %v of user %v to %v\n %v", table, username, anonymous, err)
+			return err
+		}
+	}
+
+	// foreign keys aren't always enforced, so rows that would cascade are
+	// deleted here too, children first
+	for _, statement := range []string{
+		`UPDATE Sessions SET revoked = TRUE WHERE clientid IN (SELECT id FROM OAuthClients WHERE username = ?)`,
+		`DELETE FROM OAuthCodes WHERE clientid IN (SELECT id FROM OAuthClients WHERE username = ?)`,
+		`DELETE FROM OAuthCodes WHERE username = ?`,
+		`DELETE FROM OAuthClients WHERE username = ?`,
+		`DELETE FROM ApiKeys WHERE siteid IN (SELECT id FROM Sites WHERE username = ?)`,
+		`DELETE FROM SupporterSites WHERE siteid IN (SELECT id FROM Sites WHERE username = ?)`,
+		`DELETE FROM Sites WHERE username = ?`,
+		`DELETE FROM Delegations WHERE id IN (SELECT id FROM Sessions WHERE username = ?)`,
+		`DELETE FROM Sessions WHERE username = ?`,
+		`DELETE FROM RecoveryCodes WHERE username = ?`,
+		`DELETE FROM TwoFactor WHERE username = ?`,
+		`DELETE FROM WebAuthnChallenges WHERE username = ?`,
+		`DELETE FROM WebAuthnCredentials WHERE username = ?`,
+		`DELETE FROM LoginThrottles WHERE kind = 'user' AND subject = ?`,
+		`DELETE FROM DataExports WHERE username = ?`,
+		`DELETE FROM Statements WHERE username = ?`,
+		`DELETE FROM BalanceAlerts WHERE username = ?`,
+		`DELETE FROM Notifications WHERE username = ?`,
+		`DELETE FROM NotificationPreferences WHERE username = ?`,
+		`DELETE FROM NotificationWebhooks WHERE username = ?`,
+		`DELETE FROM SupporterSites WHERE username = ?`,
+		`DELETE FROM PublicProfiles WHERE username = ?`,
+		`DELETE FROM AuditKeys WHERE username = ?`,
+	} {
+		_, err := d.db.Exec(statement, username)
+		if err != nil {
+			log.Printf("error deleting data of user %v\n %v", username, err)
+			return err
+		}
+	}
+
 	resp, err := d.db.Exec(`DELETE FROM Users WHERE username = ?`, username)
+	if err != nil {
+		log.Printf("error deleting user %v\n %v", username, err)
+		return err
+	}
 
 	rows, err := resp.RowsAffected()
 	if err != nil {
@@ -106,18 +170,83 @@ func (d *sqlDb) DeleteUser(username string) error {
 	return nil
 }
 
-func (d *sqlDb) UpdateTokenValidity(username string, valid bool) error {
+// Marks a user's email as verified, provided it is still the given address.
+// Returns NotFound if the user has since changed it
+func (d *sqlDb) VerifyEmail(username, email string) error {
 	resp, err := d.db.Exec(`
-        UPDATE Users SET invalidatedtokens = ? WHERE username = ?
-    `, !valid, username)
+        UPDATE Users SET emailverified = TRUE WHERE username = ? AND email = ?
+    `, username, email)
 	if err != nil {
-		log.Printf("error updating user %v token validity\n %v", username, err)
+		log.Printf("error verifying email of user %v\n %v", username, err)
 		return err
 	}
 
 	rows, err := resp.RowsAffected()
 	if err != nil {
-		log.Printf("error getting number of rows affected by token validity update\n %v", err)
+		log.Printf("error getting number of rows affected by email verification\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("user %v with email %v", username, email)}
+	}
+
+	return nil
+}
+
+// Returns users whose username or email contains args.Query, without their
+// passwords
+func (d *sqlDb) SearchUsers(args *models.UserSearchArgs) ([]models.User, error) {
+	pattern := "%" + args.Query + "%"
+
+	rows, err := d.db.Query(`
+        SELECT Users.username, Users.email, Users.emailverified, Users.role, Users.frozen, Users.deleted,
+		COALESCE(Balances.balance, 0)
+		FROM Users
+		LEFT JOIN Balances ON Users.username = Balances.username
+		WHERE (Users.username LIKE ? OR Users.email LIKE ?) AND Users.username > ?
+		ORDER BY Users.username LIMIT ?
+    `, pattern, pattern, args.After, args.Count)
+	if err != nil {
+		log.Printf("error searching users for '%v'\n%v", args.Query, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		u := models.User{}
+		err := rows.Scan(&u.Username, &u.Email, &u.EmailVerified, &u.Role, &u.Frozen, &u.Deleted, &u.Balance)
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+func (d *sqlDb) SetUserFrozen(username string, frozen bool) error {
+	return d.setUserColumn(username, "frozen", frozen)
+}
+
+func (d *sqlDb) SetUserRole(username, role string) error {
+	return d.setUserColumn(username, "role", role)
+}
+
+func (d *sqlDb) setUserColumn(username, column string, value interface{}) error {
+	resp, err := d.db.Exec(`
+        UPDATE Users SET `+column+` = ? WHERE username = ?
+    `, value, username)
+	if err != nil {
+		log.Printf("error setting %v of user %v\n %v", column, username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by update\n %v", err)
 		return err
 	}
 
@@ -125,5 +254,5 @@ func (d *sqlDb) UpdateTokenValidity(username string, valid bool) error {
 		return &NotFound{fmt.Sprintf("user %v", username)}
 	}
 
-	return err
+	return nil
 }
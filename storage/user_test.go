@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+)
+
+// Gives the user something in most of the tables AnonymiseUser clears: a
+// ledger, a delegated session, a site with a key, a public profile on the
+// site's list, an audit key and a login throttle
+func createTestAccount(t *testing.T, d *sqlDb, username string) {
+	now := time.Now().UTC()
+	createTestUser(t, d, username)
+	createTestDelegation(t, d, username, username+"-session", 100)
+
+	for _, err := range []error{
+		d.CreateDeposit(&models.Deposit{Id: username + "-deposit", Username: username, Amount: 100, Time: now}),
+		d.CreatePayment(&models.Payment{Id: username + "-payment", Username: username, Amount: 30, Time: now,
+			Url: "https://example.com/"}),
+		d.CreateSite(&models.Site{Id: username + "-site", Username: username, Name: "Site", Domain: "example.com",
+			Verified: true, Created: now}),
+		d.CreateApiKey(&models.ApiKey{Id: username + "-key", SiteId: username + "-site", Name: "Key",
+			Prefix: username, Hash: "hash", Scope: "entitlements", Created: now}),
+		d.SetPublicProfile(&models.PublicProfile{Id: username + "-profile", Username: username,
+			DisplayName: username, Created: now}),
+		d.CreateSupporterSite(&models.SupporterSite{Id: username + "-supporter", Username: username,
+			SiteId: username + "-site", Created: now}),
+		d.CreateAuditKey(username, []byte("key")),
+		d.SetLoginThrottle(&models.LoginThrottle{Kind: "user", Subject: username, Failures: 1, LastFailure: now}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Returns how many rows of each table have column equal to value
+func countTestRows(t *testing.T, d *sqlDb, column, value string) map[string]int {
+	rows, err := d.db.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := []string{}
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	counts := map[string]int{}
+	for _, table := range tables {
+		var hasColumn bool
+		err := d.db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&hasColumn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !hasColumn {
+			continue
+		}
+		var count int
+		if err := d.db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE `+column+` = ?`, value).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count > 0 {
+			counts[table] = count
+		}
+	}
+	return counts
+}
+
+func TestAnonymiseUser(t *testing.T) {
+	d := newTestDB(t)
+	createTestAccount(t, d, "alice")
+	createTestAccount(t, d, "bob")
+	// bob appears on alice's site too, which goes with her account
+	err := d.CreateSupporterSite(&models.SupporterSite{Id: "bob-on-alice", Username: "bob", SiteId: "alice-site",
+		Created: time.Now().UTC()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobBefore := countTestRows(t, d, "username", "bob")
+
+	err = d.WithTx(context.Background(), func(tx Tx) error {
+		return tx.AnonymiseUser("alice", "anonymous")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.GetUser("alice"); !IsNotFound(err) {
+		t.Fatalf("getting the deleted user returned %v, want NotFound", err)
+	}
+	if left := countTestRows(t, d, "username", "alice"); len(left) != 0 {
+		t.Fatalf("rows of the deleted user left behind %v", left)
+	}
+	for _, check := range [][2]string{{"siteid", "alice-site"}, {"subject", "alice"}, {"id", "alice-session"}} {
+		if left := countTestRows(t, d, check[0], check[1]); len(left) != 0 {
+			t.Fatalf("rows with %v %v left behind %v", check[0], check[1], left)
+		}
+	}
+
+	// the ledger is kept for accounting, under the anonymous user
+	anonymous, err := d.GetUser("anonymous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !anonymous.Deleted || anonymous.Password != "" || anonymous.Email != "" || anonymous.Balance != 70 {
+		t.Fatalf("anonymised user %+v, want deleted with no password or email and a balance of 70", anonymous)
+	}
+	if _, err := d.GetDeposit("anonymous", "alice-deposit"); err != nil {
+		t.Fatalf("getting the moved deposit returned %v", err)
+	}
+
+	bobAfter := countTestRows(t, d, "username", "bob")
+	bobBefore["SupporterSites"]--
+	for table, count := range bobBefore {
+		if bobAfter[table] != count {
+			t.Fatalf("user bob has %v rows in %v after another user was deleted, want %v", bobAfter[table], table, count)
+		}
+	}
+}
+
+func TestAnonymiseUserNotFound(t *testing.T) {
+	d := newTestDB(t)
+
+	err := d.WithTx(context.Background(), func(tx Tx) error {
+		return tx.AnonymiseUser("alice", "anonymous")
+	})
+	if !IsNotFound(err) {
+		t.Fatalf("anonymising a missing user returned %v, want NotFound", err)
+	}
+	if _, err := d.GetUser("anonymous"); !IsNotFound(err) {
+		t.Fatalf("getting the anonymous user of a failed deletion returned %v, want NotFound", err)
+	}
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/crowdpower/fund/models"
+	"github.com/crowdpower/fund/utils"
+)
+
+type webAuthn interface {
+	CreateWebAuthnCredential(credential *models.WebAuthnCredential) error
+	GetWebAuthnCredentials(username string) ([]models.WebAuthnCredential, error)
+	UpdateWebAuthnCredentialUse(username, id string, signCount uint32, lastUsed time.Time) error
+	DeleteWebAuthnCredential(username, id string) error
+	SetWebAuthnChallenge(challenge *models.WebAuthnChallenge) error
+	TakeWebAuthnChallenge(username, ceremony string, now time.Time) (*models.WebAuthnChallenge, error)
+}
+
+func (d *sqlDb) CreateWebAuthnCredential(credential *models.WebAuthnCredential) error {
+	_, err := d.db.Exec(`
+        INSERT INTO WebAuthnCredentials (id, username, name, publickey, attestationtype, aaguid, signcount, created, lastused)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, credential.Id, credential.Username, credential.Name, credential.PublicKey, credential.AttestationType,
+		credential.Aaguid, credential.SignCount, utils.SqlTime(credential.Created), utils.SqlTime(credential.LastUsed))
+	if err != nil {
+		log.Printf("error inserting passkey %v into the database\n %v", credential.Id, err)
+	}
+	return err
+}
+
+func (d *sqlDb) GetWebAuthnCredentials(username string) ([]models.WebAuthnCredential, error) {
+	rows, err := d.db.Query(`
+        SELECT id, username, name, publickey, attestationtype, aaguid, signcount, created, lastused
+        FROM WebAuthnCredentials WHERE username = ? ORDER BY created
+    `, username)
+	if err != nil {
+		log.Printf("error reading passkeys from database for user %v\n%v", username, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []models.WebAuthnCredential{}
+	for rows.Next() {
+		c := models.WebAuthnCredential{}
+		err := rows.Scan(&c.Id, &c.Username, &c.Name, &c.PublicKey, &c.AttestationType, &c.Aaguid, &c.SignCount,
+			utils.ScanTime(&c.Created), utils.ScanTime(&c.LastUsed))
+		if err != nil {
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		credentials = append(credentials, c)
+	}
+
+	return credentials, nil
+}
+
+func (d *sqlDb) UpdateWebAuthnCredentialUse(username, id string, signCount uint32, lastUsed time.Time) error {
+	_, err := d.db.Exec(`
+        UPDATE WebAuthnCredentials SET signcount = ?, lastused = ? WHERE id = ? AND username = ?
+    `, signCount, utils.SqlTime(lastUsed), id, username)
+	if err != nil {
+		log.Printf("error updating passkey %v for user %v\n %v", id, username, err)
+	}
+	return err
+}
+
+func (d *sqlDb) DeleteWebAuthnCredential(username, id string) error {
+	resp, err := d.db.Exec(`
+        DELETE FROM WebAuthnCredentials WHERE id = ? AND username = ?
+    `, id, username)
+	if err != nil {
+		log.Printf("error deleting passkey %v for user %v\n %v", id, username, err)
+		return err
+	}
+
+	rows, err := resp.RowsAffected()
+	if err != nil {
+		log.Printf("error getting number of rows affected by delete\n %v", err)
+		return err
+	}
+
+	if rows == 0 {
+		return &NotFound{fmt.Sprintf("passkey %v", id)}
+	}
+
+	return nil
+}
+
+// Stores the state of a ceremony, replacing any unfinished ceremony of the
+// same kind for the user
+func (d *sqlDb) SetWebAuthnChallenge(challenge *models.WebAuthnChallenge) error {
+	_, err := d.db.Exec(`
+        INSERT OR REPLACE INTO WebAuthnChallenges (username, ceremony, data, expires) VALUES (?, ?, ?, ?)
+    `, challenge.Username, challenge.Ceremony, challenge.Data, utils.SqlTime(challenge.Expires))
+	if err != nil {
+		log.Printf("error storing %v challenge for user %v\n %v", challenge.Ceremony, challenge.Username, err)
+	}
+	return err
+}
+
+// Returns and deletes the state of a ceremony, so each challenge can only be
+// answered once. Returns NotFound if there is none or it has expired
+func (d *sqlDb) TakeWebAuthnChallenge(username, ceremony string, now time.Time) (*models.WebAuthnChallenge, error) {
+	rows, err := d.db.Query(`
+        SELECT username, ceremony, data, expires FROM WebAuthnChallenges WHERE username = ? AND ceremony = ?
+    `, username, ceremony)
+	if err != nil {
+		log.Printf("error reading %v challenge from database for user %v\n%v", ceremony, username, err)
+		return nil, err
+	}
+
+	var challenge *models.WebAuthnChallenge
+	if rows.Next() {
+		c := &models.WebAuthnChallenge{}
+		err := rows.Scan(&c.Username, &c.Ceremony, &c.Data, utils.ScanTime(&c.Expires))
+		if err != nil {
+			rows.Close()
+			log.Printf("error parsing database rows\n%v", err)
+			return nil, err
+		}
+		challenge = c
+	}
+	rows.Close()
+
+	if challenge == nil {
+		return nil, &NotFound{fmt.Sprintf("%v challenge for user %v", ceremony, username)}
+	}
+
+	_, err = d.db.Exec(`
+        DELETE FROM WebAuthnChallenges WHERE username = ? AND ceremony = ?
+    `, username, ceremony)
+	if err != nil {
+		log.Printf("error deleting %v challenge for user %v\n %v", ceremony, username, err)
+		return nil, err
+	}
+
+	if !now.Before(challenge.Expires) {
+		return nil, &NotFound{fmt.Sprintf("%v challenge for user %v", ceremony, username)}
+	}
+
+	return challenge, nil
+}
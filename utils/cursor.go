@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// A position in a sorted listing: the sort the listing was requested with,
+// and the sort column value and id of the last row on the previous page.
+// Clients only ever see the encoded form, which should be treated as opaque
+type Cursor struct {
+	Sort  string      `json:"s,omitempty"`
+	Order string      `json:"o,omitempty"`
+	Value interface{} `json:"v"`
+	Id    string      `json:"i"`
+}
+
+func (c Cursor) IsZero() bool {
+	return c.Id == ""
+}
+
+func (c Cursor) Encode() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		// values come from scanned columns, which always marshal
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(token string) (Cursor, error) {
+	var c Cursor
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, fmt.Errorf("malformed cursor")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&c); err != nil || c.Id == "" {
+		return Cursor{}, fmt.Errorf("malformed cursor")
+	}
+
+	// integer columns must be compared as integers, not as the float64 that
+	// encoding/json would otherwise produce
+	if n, ok := c.Value.(json.Number); ok {
+		i, err := n.Int64()
+		if err != nil {
+			return Cursor{}, fmt.Errorf("malformed cursor")
+		}
+		c.Value = i
+	}
+	return c, nil
+}
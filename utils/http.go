@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strconv"
 	"time"
@@ -38,17 +40,16 @@ func SendSuccess(w http.ResponseWriter, data interface{}, status int) {
 	}
 }
 
-func SendPage(w http.ResponseWriter, r *http.Request, data interface{}, offset int, count int, more bool) {
+// Sends a page of a listing. If next is not the zero cursor, the response
+// links to the following page, keeping the rest of the request's query
+func SendPage(w http.ResponseWriter, r *http.Request, data interface{}, next Cursor) {
 	nextLink := ""
-	if more {
-		query := r.URL.RawQuery
-		if query != "" {
-			query += "&"
-		} else {
-			query += "?"
-		}
-		query += fmt.Sprintf("offset=%v&count=%v", offset, count)
-		nextLink = fmt.Sprintf("https://%v%v%v", r.Host, r.RequestURI, query)
+	if !next.IsZero() {
+		query := r.URL.Query()
+		query.Del("offset")
+		query.Set("cursor", next.Encode())
+		link := url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path, RawQuery: query.Encode()}
+		nextLink = link.String()
 	}
 
 	resp := httpResponse{NextLink: nextLink, Data: data}
@@ -79,7 +80,18 @@ func SendError(w http.ResponseWriter, message string, status int) {
 	}
 }
 
-// takes a pointer to the target structure, structure may be modified on error
+// Returns the address of the client that made the request, without its port
+func ClientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// takes a pointer to the target structure, structure may be modified on error.
+// Pointer fields are set whenever their parameter is present, even if it is
+// empty, and slice fields collect every repetition of their parameter
 func ParseArgs(r *http.Request, target interface{}) error {
 	q := r.URL.Query()
 	targTypes := reflect.TypeOf(target).Elem()
@@ -89,28 +101,71 @@ func ParseArgs(r *http.Request, target interface{}) error {
 		targVal := targVals.Field(i)
 
 		key := targType.Tag.Get("query")
-		val := q.Get(key)
-		if val == "" {
+		vals, ok := q[key]
+		if !ok || len(vals) == 0 {
 			continue
 		}
 
 		switch targType.Type.Kind() {
-		case reflect.String:
-			targVal.SetString(val)
-		case reflect.Int:
-			intVal, err := strconv.Atoi(val)
+		case reflect.Slice:
+			list := reflect.MakeSlice(targType.Type, 0, len(vals))
+			for _, val := range vals {
+				elem, err := parseArg(key, val, targType.Type.Elem())
+				if err != nil {
+					return err
+				}
+				list = reflect.Append(list, elem)
+			}
+			targVal.Set(list)
+		case reflect.Ptr:
+			elem, err := parseArg(key, vals[0], targType.Type.Elem())
 			if err != nil {
-				return fmt.Errorf("parameter '%v' must be be an integer", key)
+				return err
+			}
+			ptr := reflect.New(targType.Type.Elem())
+			ptr.Elem().Set(elem)
+			targVal.Set(ptr)
+		default:
+			if vals[0] == "" {
+				continue
 			}
-			targVal.SetInt(int64(intVal))
-		case reflect.TypeOf(time.Time{}).Kind():
-			timeVal, err := time.Parse(time.RFC3339, val)
+			elem, err := parseArg(key, vals[0], targType.Type)
 			if err != nil {
-				return fmt.Errorf("parameter '%v' must be be a time value", key)
+				return err
 			}
-			targVal.Set(reflect.ValueOf(timeVal))
+			targVal.Set(elem)
 		}
 	}
 
 	return nil
 }
+
+func parseArg(key string, val string, t reflect.Type) (reflect.Value, error) {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		timeVal, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("parameter '%v' must be be a time value", key)
+		}
+		return reflect.ValueOf(timeVal), nil
+	case reflect.TypeOf(Cursor{}):
+		cursor, err := DecodeCursor(val)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("parameter '%v' must be a cursor taken from a nextLink", key)
+		}
+		return reflect.ValueOf(cursor), nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(val).Convert(t), nil
+	case reflect.Int:
+		intVal, err := strconv.Atoi(val)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("parameter '%v' must be be an integer", key)
+		}
+		return reflect.ValueOf(intVal).Convert(t), nil
+	}
+
+	return reflect.Value{}, fmt.Errorf("parameter '%v' has unsupported type %v", key, t)
+}
@@ -1,17 +1,13 @@
 package utils
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
-	"strconv"
 	"strings"
 	"time"
 )
 
-const (
-	TimeFormat = "2006-01-02 15:04:05"
-)
-
 type SqlCondition struct {
 	Column     string
 	Comparator string
@@ -19,7 +15,9 @@ type SqlCondition struct {
 }
 
 // Takes an array of SQL conditions, and returns a SQL WHERE statement with
-// an array of arguments. Excludes SQL conditions where Arg is the zero value
+// an array of arguments. Excludes SQL conditions where Arg is the zero value,
+// so filters that must match zero values should use a pointer Arg, which is
+// only excluded when nil. A []string Arg produces an IN list
 func SqlWhere(conditions []SqlCondition) (string, []interface{}) {
 	formatted := []string{}
 	args := make([]interface{}, 0)
@@ -29,30 +27,98 @@ func SqlWhere(conditions []SqlCondition) (string, []interface{}) {
 		comp := condition.Comparator
 		arg := condition.Arg
 
-		strVal := ""
+		var val interface{}
 
 		switch a := arg.(type) {
 		case string:
-			strVal = a
+			if a != "" {
+				val = a
+			}
 		case int:
-			if a == 0 {
-				break
+			if a != 0 {
+				val = a
+			}
+		case *string:
+			if a != nil {
+				val = *a
+			}
+		case *int:
+			if a != nil {
+				val = *a
 			}
-			strVal = strconv.Itoa(a)
 		case time.Time:
-			if a.IsZero() {
+			if !a.IsZero() {
+				val = SqlTime(a)
+			}
+		case []string:
+			if len(a) == 0 {
 				break
 			}
-			strVal = a.Format(TimeFormat)
+			placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(a)), ", ")
+			formatted = append(formatted, fmt.Sprintf("%v IN (%v)", col, placeholders))
+			for _, v := range a {
+				args = append(args, v)
+			}
 		default:
 			log.Printf("type %T not supported by ConstructSqlWhere", a)
 		}
 
-		if strVal != "" {
+		if val != nil {
 			formatted = append(formatted, fmt.Sprintf("%v %v ?", col, comp))
-			args = append(args, strVal)
+			args = append(args, val)
 		}
 	}
 
 	return fmt.Sprintf("WHERE %v", strings.Join(formatted, " AND ")), args
 }
+
+// The order of a listing. Rows with equal values in Column are ordered by id
+// in the same direction, so that the order is total and cursors are stable
+type SqlSort struct {
+	Column string
+	Desc   bool
+}
+
+func SqlOrderBy(sort SqlSort) string {
+	direction := "ASC"
+	if sort.Desc {
+		direction = "DESC"
+	}
+	return fmt.Sprintf("ORDER BY %v %v, id %v", sort.Column, direction, direction)
+}
+
+// Returns a SQL condition matching the rows that come after the cursor in a
+// listing ordered by sort
+func SqlAfterCursor(sort SqlSort, cursor Cursor) (string, []interface{}) {
+	comp := ">"
+	if sort.Desc {
+		comp = "<"
+	}
+	return fmt.Sprintf("(%v %v ? OR (%v = ? AND id %v ?))", sort.Column, comp, sort.Column, comp),
+		[]interface{}{cursor.Value, cursor.Value, cursor.Id}
+}
+
+// Times are stored as INTEGER nanoseconds since the Unix epoch, which makes
+// comparisons exact regardless of the time zone a value was given in
+func SqlTime(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+type sqlTimeScanner struct {
+	t *time.Time
+}
+
+func (s sqlTimeScanner) Scan(src interface{}) error {
+	nanos, ok := src.(int64)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into a time, expected INTEGER nanoseconds", src)
+	}
+	*s.t = time.Unix(0, nanos).UTC()
+	return nil
+}
+
+// Returns a destination for rows.Scan that reads a time stored by SqlTime
+// into t, in UTC
+func ScanTime(t *time.Time) sql.Scanner {
+	return sqlTimeScanner{t}
+}
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Returns the lower-cased host name a payment url points to, accepting urls
+// given without a scheme. Returns an empty string if no host can be found
+func Domain(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err == nil && u.Host == "" && !strings.Contains(rawUrl, "://") {
+		u, err = url.Parse("//" + rawUrl)
+	}
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Returns true if host is domain or one of its subdomains
+func InDomain(host, domain string) bool {
+	return host != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
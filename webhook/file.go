@@ -0,0 +1,39 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Appends every webhook to a file instead of sending it, for development
+type fileSender struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileSender(path string) Sender {
+	return &fileSender{path: path}
+}
+
+func (s *fileSender) Send(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("error opening webhook file %v\n%v", s.path, err)
+		return err
+	}
+	defer f.Close()
+
+	timestamp := time.Now().Unix()
+	_, err = fmt.Fprintf(f, "POST %v\nFund-Timestamp: %v\nFund-Signature: %v\n\n%s\n\n", msg.Url, timestamp,
+		Sign(msg.Secret, timestamp, msg.Body), msg.Body)
+	if err != nil {
+		log.Printf("error writing webhook to %v\n%v", s.path, err)
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package webhook
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const httpTimeout = time.Second * 10
+
+// Ranges that aren't public but that the net package's checks don't cover
+var nonPublicNets = parseCidrs(
+	"0.0.0.0/8",      // this network
+	"100.64.0.0/10",  // shared address space, carrier-grade NAT
+	"192.0.0.0/24",   // protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved, and broadcast
+	"64:ff9b:1::/48", // local-use NAT64
+	"100::/64",       // discard-only
+	"2001:db8::/32",  // documentation
+)
+
+// NAT64 addresses, which wrap an IPv4 address in their last 4 bytes
+var nat64Net = parseCidrs("64:ff9b::/96")[0]
+
+type httpSender struct {
+	client *http.Client
+}
+
+// Webhooks are only sent to public addresses, so users can't point them at
+// services on our own network
+func NewHttpSender() Sender {
+	dialer := &net.Dialer{Timeout: httpTimeout, Control: dialPublic}
+	return &httpSender{&http.Client{
+		Transport: &http.Transport{
+			// no proxy, the address dialled must be the webhook's own
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: httpTimeout,
+		},
+		Timeout: httpTimeout,
+		// a redirect could send the body somewhere the user didn't choose
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+func (s *httpSender) Send(msg Message) error {
+	req, err := http.NewRequest(http.MethodPost, msg.Url, bytes.NewReader(msg.Body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Fund-Webhook")
+	req.Header.Set("Fund-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("Fund-Signature", Sign(msg.Secret, timestamp, msg.Body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Printf("error sending webhook to %v\n%v", msg.Url, err)
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %v responded with status %v", msg.Url, resp.StatusCode)
+	}
+	return nil
+}
+
+// Whether webhooks may be sent to ip: not loopback, private, link-local,
+// multicast, unspecified or in another range that isn't public. A NAT64
+// address is public if the IPv4 address it wraps is
+func PublicIp(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if ip.To4() == nil && nat64Net.Contains(ip) {
+		return PublicIp(ip[12:16])
+	}
+	return true
+}
+
+func parseCidrs(cidrs ...string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// Refuses to connect to addresses that aren't public. It checks the address
+// about to be connected to, after the host name has been resolved, so a name
+// that resolves to a public address when checked and a private one when used
+// can't get round it
+func dialPublic(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !PublicIp(ip) {
+		return fmt.Errorf("webhook address %v is not public", address)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package webhook
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPublicIp(t *testing.T) {
+	for ip, public := range map[string]bool{
+		"8.8.8.8":            true,
+		"2606:4700::1111":    true,
+		"64:ff9b::808:808":   true,
+		"127.0.0.1":          false,
+		"10.1.2.3":           false,
+		"169.254.169.254":    false,
+		"0.1.2.3":            false,
+		"100.64.0.1":         false,
+		"198.18.0.1":         false,
+		"255.255.255.255":    false,
+		"::1":                false,
+		"fd00::1":            false,
+		"fe80::1":            false,
+		"::ffff:10.0.0.1":    false,
+		"64:ff9b::a00:1":     false,
+		"64:ff9b::7f00:1":    false,
+		"64:ff9b:1::808:808": false,
+	} {
+		if got := PublicIp(net.ParseIP(ip)); got != public {
+			t.Errorf("PublicIp(%v) = %v, want %v", ip, got, public)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// A JSON body to POST to a user's webhook, signed with the secret the user
+// was given for it
+type Message struct {
+	Url    string
+	Secret string
+	Body   []byte
+}
+
+// Delivers webhooks to users' endpoints. HttpSender delivers for real,
+// FileSender and MemorySender are stand-ins for development and tests
+type Sender interface {
+	Send(msg Message) error
+}
+
+type Config struct {
+	Driver string `mapstructure:"driver"`
+	Path   string `mapstructure:"path"`
+}
+
+// Returns the sender selected by config.Driver: "http", "file" or "memory"
+func New(config Config) (Sender, error) {
+	switch config.Driver {
+	case "http":
+		return NewHttpSender(), nil
+	case "file":
+		return NewFileSender(config.Path), nil
+	case "memory", "":
+		return NewMemorySender(), nil
+	}
+	return nil, fmt.Errorf("unknown webhook driver '%v'", config.Driver)
+}
+
+// Returns the signature sent with a body in the Fund-Signature header: the
+// hex HMAC-SHA256, keyed with the secret, of the Fund-Timestamp header, a
+// '.', and the body. Receivers should compute it themselves and compare, and
+// reject old timestamps so deliveries can't be replayed
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}